@@ -37,6 +37,14 @@ if [ "$1" = "install" ];then
     echo "TODO: ${platform}"
   fi
 
+  if [ "$2" = "user" ];then
+    # a per-user daemon next to the system one, configure in ~/.config/sshx
+    mkdir -p ~/.config/systemd/user
+    cp ./scripts/sshx-user.service ~/.config/systemd/user/sshx.service
+    systemctl --user enable sshx.service
+    systemctl --user start sshx.service
+  fi
+
   if [ "$2" = "signaling" ];then
     if [ "$platform" = "Linux" ];then
       cp ./scripts/signaling /usr/local/bin/
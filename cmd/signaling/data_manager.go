@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"sync"
 	"time"
 
@@ -13,62 +14,147 @@ const (
 	MAX_BUFFER_NUMBER   = 64
 )
 
-type DManager struct {
-	datas map[string]chan types.SignalingInfo
-	mu    sync.Mutex
-	alive map[string]int
+var (
+	// ErrTooManyIDs is returned when a new id would exceed the tracked id cap
+	ErrTooManyIDs = errors.New("too many ids")
+	// ErrQueueFull is returned when an info was dropped on a full queue
+	ErrQueueFull = errors.New("queue full")
+)
+
+// DManager queues signaling infos for a node until the node pulls them
+type DManager interface {
+	// Set queues info for id, info is dropped with ErrQueueFull if the queue
+	// is full
+	Set(id string, info types.SignalingInfo) error
+	// Pop takes the oldest queued info of id without blocking, ok is false
+	// if there is none
+	Pop(id string) (info types.SignalingInfo, ok bool, err error)
+}
+
+// MemoryDManager keeps queues in process, for a single signaling server
+type MemoryDManager struct {
+	datas  map[string]chan types.SignalingInfo
+	mu     sync.Mutex
+	alive  map[string]time.Time
+	maxIds int
+	// queued infos per SIG_TYPE_*
+	queued map[int]int
+	// closed by Close to stop the sweeper
+	done      chan struct{}
+	closeOnce sync.Once
 }
 
-func NewDManager() *DManager {
-	return &DManager{
-		datas: make(map[string]chan types.SignalingInfo),
-		alive: make(map[string]int),
+// NewMemoryDManager creates a store tracking at most maxIds queues, 0 for
+// no limit
+func NewMemoryDManager(maxIds int) *MemoryDManager {
+	dm := &MemoryDManager{
+		datas:  make(map[string]chan types.SignalingInfo),
+		alive:  make(map[string]time.Time),
+		maxIds: maxIds,
+		queued: make(map[int]int),
+		done:   make(chan struct{}),
 	}
+	go dm.sweep()
+	return dm
 }
 
-func (dm *DManager) Get(id string) chan types.SignalingInfo {
+func (dm *MemoryDManager) Get(id string) chan types.SignalingInfo {
 	dm.mu.Lock()
 	defer dm.mu.Unlock()
 	return dm.datas[id]
 }
 
-func (dm *DManager) Clean(id string) {
+func (dm *MemoryDManager) Clean(id string) {
 	dm.mu.Lock()
 	defer dm.mu.Unlock()
+	dm.clean(id)
+}
+
+func (dm *MemoryDManager) clean(id string) {
 	if dm.datas[id] != nil {
 		close(dm.datas[id])
+		for v := range dm.datas[id] {
+			dm.queued[v.Flag]--
+		}
 	}
 	delete(dm.datas, id)
 	delete(dm.alive, id)
 }
 
-func (dm *DManager) resetAlive(id string) {
-	dm.mu.Lock()
-	defer dm.mu.Unlock()
-	dm.alive[id] = LIFE_TIME_IN_SECOND
+// sweep drops queues nobody pushed to for LIFE_TIME_IN_SECOND
+func (dm *MemoryDManager) sweep() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		var now time.Time
+		select {
+		case now = <-ticker.C:
+		case <-dm.done:
+			return
+		}
+		dm.mu.Lock()
+		for id, expire := range dm.alive {
+			if now.After(expire) {
+				logrus.Debug("expire queue of ", id)
+				dm.clean(id)
+			}
+		}
+		dm.mu.Unlock()
+	}
 }
 
-func (dm *DManager) Set(id string, info types.SignalingInfo) {
-	if dm.datas[id] == nil {
-		dm.mu.Lock()
-		dm.datas[id] = make(chan types.SignalingInfo, MAX_BUFFER_NUMBER)
+// Close stops the sweeper, queues are no longer expired afterwards
+func (dm *MemoryDManager) Close() {
+	dm.closeOnce.Do(func() {
+		close(dm.done)
+	})
+}
+
+func (dm *MemoryDManager) Set(id string, info types.SignalingInfo) error {
+	dm.mu.Lock()
+	ch := dm.datas[id]
+	if ch == nil {
+		if dm.maxIds > 0 && len(dm.datas) >= dm.maxIds {
+			dm.mu.Unlock()
+			return ErrTooManyIDs
+		}
+		ch = make(chan types.SignalingInfo, MAX_BUFFER_NUMBER)
+		dm.datas[id] = ch
+	}
+	// send under the lock so Clean can not close the channel meanwhile
+	select {
+	case ch <- info:
+		dm.alive[id] = time.Now().Add(LIFE_TIME_IN_SECOND * time.Second)
+		dm.queued[info.Flag]++
+	default:
 		dm.mu.Unlock()
-		dm.resetAlive(id)
-		go func(dmc *DManager) {
-			logrus.Debug("create watch dog for ", id)
-			for dmc.alive[id] > 0 {
-				time.Sleep(time.Second)
-				dmc.mu.Lock()
-				dmc.alive[id]--
-				dmc.mu.Unlock()
-			}
-			logrus.Debug("execute watch dog for ", id)
-			dm.Clean(id)
-		}(dm)
+		return ErrQueueFull
 	}
+	dm.mu.Unlock()
+	return nil
+}
+
+func (dm *MemoryDManager) Pop(id string) (types.SignalingInfo, bool, error) {
 	select {
-	case dm.datas[id] <- info:
-		dm.resetAlive(id)
+	case v, ok := <-dm.Get(id):
+		if ok {
+			dm.mu.Lock()
+			dm.queued[v.Flag]--
+			dm.mu.Unlock()
+		}
+		return v, ok, nil
 	default:
+		return types.SignalingInfo{}, false, nil
+	}
+}
+
+// Stats returns the number of tracked ids and queued infos per SIG_TYPE_*
+func (dm *MemoryDManager) Stats() (int, map[int]int) {
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+	queued := make(map[int]int, len(dm.queued))
+	for k, v := range dm.queued {
+		queued[k] = v
 	}
+	return len(dm.datas), queued
 }
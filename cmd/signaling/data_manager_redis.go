@@ -0,0 +1,331 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/suutaku/sshx/pkg/types"
+)
+
+const (
+	redisKeyPrefix   = "sshx:signaling:"
+	redisPeersPrefix = "sshx:peers:"
+	// sorted set of ids with queues, scored by the expiry of their queue
+	redisIdsKey = "sshx:ids"
+	// sorted set of group/id pairs in the directory, scored by their expiry
+	redisPeerIdsKey  = "sshx:peer-ids"
+	redisTimeout     = 5 * time.Second
+	redisMaxIdleConn = 16
+)
+
+// redisError is an error reply of the server, the connection stays usable
+type redisError string
+
+func (e redisError) Error() string {
+	return string(e)
+}
+
+// respConn speaks the redis serialization protocol over one connection
+type respConn struct {
+	conn net.Conn
+	rd   *bufio.Reader
+}
+
+func (rc *respConn) do(args ...string) (interface{}, error) {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "*%d\r\n", len(args))
+	for _, v := range args {
+		fmt.Fprintf(&buf, "$%d\r\n%s\r\n", len(v), v)
+	}
+	rc.conn.SetDeadline(time.Now().Add(redisTimeout))
+	_, err := rc.conn.Write(buf.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	return rc.readReply()
+}
+
+func (rc *respConn) readLine() (string, error) {
+	line, err := rc.rd.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	if !strings.HasSuffix(line, "\r\n") || len(line) < 3 {
+		return "", fmt.Errorf("malformed redis reply %q", line)
+	}
+	return line[:len(line)-2], nil
+}
+
+func (rc *respConn) readReply() (interface{}, error) {
+	line, err := rc.readLine()
+	if err != nil {
+		return nil, err
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		data := make([]byte, n+2)
+		_, err = io.ReadFull(rc.rd, data)
+		if err != nil {
+			return nil, err
+		}
+		return data[:n], nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		ret := make([]interface{}, n)
+		for i := range ret {
+			ret[i], err = rc.readReply()
+			if err != nil {
+				return nil, err
+			}
+		}
+		return ret, nil
+	}
+	return nil, fmt.Errorf("unknown redis reply %q", line)
+}
+
+// RedisDManager keeps queues in a redis compatible server, so that several
+// signaling servers behind a load balancer share them
+type RedisDManager struct {
+	addr     string
+	password string
+	db       int
+	idle     chan *respConn
+	maxIds   int
+}
+
+// NewRedisDManager parses a url like redis://:password@host:6379/0, at
+// most maxIds ids have queues, 0 for no limit
+func NewRedisDManager(rawURL string, maxIds int) (*RedisDManager, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "redis" {
+		return nil, fmt.Errorf("unsupported redis url scheme %q", u.Scheme)
+	}
+	ret := &RedisDManager{
+		addr:   u.Host,
+		idle:   make(chan *respConn, redisMaxIdleConn),
+		maxIds: maxIds,
+	}
+	if u.Port() == "" {
+		ret.addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if u.User != nil {
+		ret.password, _ = u.User.Password()
+	}
+	if db := strings.Trim(u.Path, "/"); db != "" {
+		ret.db, err = strconv.Atoi(db)
+		if err != nil {
+			return nil, fmt.Errorf("invalid redis database %q", db)
+		}
+	}
+	// fail early on a wrong address or password
+	err = ret.Ping()
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+func (rm *RedisDManager) dial() (*respConn, error) {
+	conn, err := net.DialTimeout("tcp", rm.addr, redisTimeout)
+	if err != nil {
+		return nil, err
+	}
+	rc := &respConn{conn: conn, rd: bufio.NewReader(conn)}
+	if rm.password != "" {
+		_, err = rc.do("AUTH", rm.password)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if rm.db != 0 {
+		_, err = rc.do("SELECT", strconv.Itoa(rm.db))
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return rc, nil
+}
+
+func (rm *RedisDManager) do(args ...string) (interface{}, error) {
+	var rc *respConn
+	select {
+	case rc = <-rm.idle:
+	default:
+		var err error
+		rc, err = rm.dial()
+		if err != nil {
+			return nil, err
+		}
+	}
+	ret, err := rc.do(args...)
+	if _, ok := err.(redisError); err != nil && !ok {
+		rc.conn.Close()
+		return nil, err
+	}
+	select {
+	case rm.idle <- rc:
+	default:
+		rc.conn.Close()
+	}
+	return ret, err
+}
+
+func (rm *RedisDManager) Set(id string, info types.SignalingInfo) error {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(info)
+	if err != nil {
+		return err
+	}
+	err = rm.track(id)
+	if err != nil {
+		return err
+	}
+	key := redisKeyPrefix + id
+	ret, err := rm.do("RPUSH", key, buf.String())
+	if err != nil {
+		return err
+	}
+	// drop the newest one on a full queue, like the in memory queue does
+	if n, ok := ret.(int64); ok && n > MAX_BUFFER_NUMBER {
+		_, err = rm.do("RPOP", key)
+		if err != nil {
+			return err
+		}
+		return ErrQueueFull
+	}
+	_, err = rm.do("EXPIRE", key, strconv.Itoa(LIFE_TIME_IN_SECOND))
+	return err
+}
+
+// track counts id against maxIds, ids leave the set when their queue
+// expires. Servers sharing the store may exceed the limit by the pushes
+// they take at the same time
+func (rm *RedisDManager) track(id string) error {
+	return rm.trackIn(redisIdsKey, id, LIFE_TIME_IN_SECOND*time.Second)
+}
+
+// trackIn adds member to the sorted set key until ttl passes, failing with
+// ErrTooManyIDs if it is new and the set already holds maxIds members
+func (rm *RedisDManager) trackIn(key, member string, ttl time.Duration) error {
+	if rm.maxIds <= 0 {
+		return nil
+	}
+	now := time.Now()
+	expire := strconv.FormatInt(now.Add(ttl).Unix(), 10)
+	score, err := rm.do("ZSCORE", key, member)
+	if err != nil {
+		return err
+	}
+	if score == nil {
+		_, err = rm.do("ZREMRANGEBYSCORE", key, "-inf", strconv.FormatInt(now.Unix()-1, 10))
+		if err != nil {
+			return err
+		}
+		n, err := rm.do("ZCARD", key)
+		if err != nil {
+			return err
+		}
+		if count, _ := n.(int64); count >= int64(rm.maxIds) {
+			return ErrTooManyIDs
+		}
+	}
+	_, err = rm.do("ZADD", key, expire, member)
+	return err
+}
+
+// Ping checks the redis server is reachable
+func (rm *RedisDManager) Ping() error {
+	_, err := rm.do("PING")
+	return err
+}
+
+func (rm *RedisDManager) Pop(id string) (types.SignalingInfo, bool, error) {
+	var info types.SignalingInfo
+	ret, err := rm.do("LPOP", redisKeyPrefix+id)
+	if err != nil || ret == nil {
+		return info, false, err
+	}
+	data, ok := ret.([]byte)
+	if !ok {
+		return info, false, fmt.Errorf("unexpected redis reply %v", ret)
+	}
+	err = gob.NewDecoder(bytes.NewReader(data)).Decode(&info)
+	if err != nil {
+		return info, false, err
+	}
+	return info, true, nil
+}
+
+func (rm *RedisDManager) Seen(group string, peer types.PeerInfo) error {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(peer)
+	if err != nil {
+		return err
+	}
+	// count peers like MemoryDirectory does, once per group they announce in
+	err = rm.trackIn(redisPeerIdsKey, group+"/"+peer.ID, PEER_LIFE_TIME)
+	if err != nil {
+		return err
+	}
+	key := redisPeersPrefix + group
+	_, err = rm.do("HSET", key, peer.ID, buf.String())
+	if err != nil {
+		return err
+	}
+	_, err = rm.do("EXPIRE", key, strconv.Itoa(int(PEER_LIFE_TIME.Seconds())))
+	return err
+}
+
+func (rm *RedisDManager) Peers(group string) ([]types.PeerInfo, error) {
+	key := redisPeersPrefix + group
+	ret, err := rm.do("HGETALL", key)
+	if err != nil {
+		return nil, err
+	}
+	fields, _ := ret.([]interface{})
+	peers := make([]types.PeerInfo, 0, len(fields)/2)
+	for i := 0; i+1 < len(fields); i += 2 {
+		data, _ := fields[i+1].([]byte)
+		var peer types.PeerInfo
+		err = gob.NewDecoder(bytes.NewReader(data)).Decode(&peer)
+		if err != nil || time.Since(peer.LastSeen) > PEER_LIFE_TIME {
+			id, _ := fields[i].([]byte)
+			rm.do("HDEL", key, string(id))
+			continue
+		}
+		peers = append(peers, peer)
+	}
+	return peers, nil
+}
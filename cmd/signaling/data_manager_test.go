@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/suutaku/sshx/pkg/types"
+)
+
+// respStub answers the redis commands the signaling server uses from
+// memory, keys never expire
+type respStub struct {
+	mu     sync.Mutex
+	lists  map[string][]string
+	zsets  map[string]map[string]float64
+	hashes map[string]map[string]string
+}
+
+func newRespStub(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	rs := &respStub{
+		lists:  make(map[string][]string),
+		zsets:  make(map[string]map[string]float64),
+		hashes: make(map[string]map[string]string),
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go rs.serve(conn)
+		}
+	}()
+	return "redis://" + l.Addr().String()
+}
+
+func (rs *respStub) serve(conn net.Conn) {
+	defer conn.Close()
+	rc := &respConn{conn: conn, rd: bufio.NewReader(conn)}
+	for {
+		req, err := rc.readReply()
+		if err != nil {
+			return
+		}
+		items, _ := req.([]interface{})
+		args := make([]string, len(items))
+		for i, v := range items {
+			b, _ := v.([]byte)
+			args[i] = string(b)
+		}
+		rs.mu.Lock()
+		reply := rs.exec(args)
+		rs.mu.Unlock()
+		if _, err := io.WriteString(conn, reply); err != nil {
+			return
+		}
+	}
+}
+
+func bulk(s string) string {
+	return fmt.Sprintf("$%d\r\n%s\r\n", len(s), s)
+}
+
+func (rs *respStub) exec(args []string) string {
+	if len(args) == 0 {
+		return "-ERR empty command\r\n"
+	}
+	switch strings.ToUpper(args[0]) {
+	case "PING", "AUTH", "SELECT":
+		return "+OK\r\n"
+	case "EXPIRE":
+		return ":1\r\n"
+	case "RPUSH":
+		rs.lists[args[1]] = append(rs.lists[args[1]], args[2:]...)
+		return fmt.Sprintf(":%d\r\n", len(rs.lists[args[1]]))
+	case "LPOP", "RPOP":
+		l := rs.lists[args[1]]
+		if len(l) == 0 {
+			return "$-1\r\n"
+		}
+		var v string
+		if strings.ToUpper(args[0]) == "LPOP" {
+			v, rs.lists[args[1]] = l[0], l[1:]
+		} else {
+			v, rs.lists[args[1]] = l[len(l)-1], l[:len(l)-1]
+		}
+		return bulk(v)
+	case "ZADD":
+		if rs.zsets[args[1]] == nil {
+			rs.zsets[args[1]] = make(map[string]float64)
+		}
+		score, _ := strconv.ParseFloat(args[2], 64)
+		rs.zsets[args[1]][args[3]] = score
+		return ":1\r\n"
+	case "ZSCORE":
+		score, ok := rs.zsets[args[1]][args[2]]
+		if !ok {
+			return "$-1\r\n"
+		}
+		return bulk(strconv.FormatFloat(score, 'f', -1, 64))
+	case "ZCARD":
+		return fmt.Sprintf(":%d\r\n", len(rs.zsets[args[1]]))
+	case "ZREMRANGEBYSCORE":
+		max, _ := strconv.ParseFloat(args[3], 64)
+		n := 0
+		for k, v := range rs.zsets[args[1]] {
+			if v <= max {
+				delete(rs.zsets[args[1]], k)
+				n++
+			}
+		}
+		return fmt.Sprintf(":%d\r\n", n)
+	case "HSET":
+		if rs.hashes[args[1]] == nil {
+			rs.hashes[args[1]] = make(map[string]string)
+		}
+		rs.hashes[args[1]][args[2]] = args[3]
+		return ":1\r\n"
+	case "HDEL":
+		delete(rs.hashes[args[1]], args[2])
+		return ":1\r\n"
+	case "HGETALL":
+		keys := make([]string, 0, len(rs.hashes[args[1]]))
+		for k := range rs.hashes[args[1]] {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		ret := fmt.Sprintf("*%d\r\n", 2*len(keys))
+		for _, k := range keys {
+			ret += bulk(k) + bulk(rs.hashes[args[1]][k])
+		}
+		return ret
+	}
+	return "-ERR unknown command " + args[0] + "\r\n"
+}
+
+// dmanagers returns every DManager implementation tracking at most maxIds
+func dmanagers(t *testing.T, maxIds int) map[string]DManager {
+	rdm, err := NewRedisDManager(newRespStub(t), maxIds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mdm := NewMemoryDManager(maxIds)
+	t.Cleanup(mdm.Close)
+	return map[string]DManager{
+		"memory": mdm,
+		"redis":  rdm,
+	}
+}
+
+func TestDManagerOrder(t *testing.T) {
+	for name, dm := range dmanagers(t, 0) {
+		t.Run(name, func(t *testing.T) {
+			if _, ok, err := dm.Pop("a"); ok || err != nil {
+				t.Fatalf("pop of empty queue: ok %v, err %v", ok, err)
+			}
+			for i := 0; i < 3; i++ {
+				err := dm.Set("a", types.SignalingInfo{Flag: i, Source: "b", Target: "a"})
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			for i := 0; i < 3; i++ {
+				info, ok, err := dm.Pop("a")
+				if err != nil || !ok {
+					t.Fatalf("pop %d: ok %v, err %v", i, ok, err)
+				}
+				if info.Flag != i || info.Source != "b" {
+					t.Fatalf("pop %d: got %+v", i, info)
+				}
+			}
+			if _, ok, _ := dm.Pop("a"); ok {
+				t.Fatal("queue not empty after popping all infos")
+			}
+		})
+	}
+}
+
+func TestDManagerQueueFull(t *testing.T) {
+	for name, dm := range dmanagers(t, 0) {
+		t.Run(name, func(t *testing.T) {
+			for i := 0; i < MAX_BUFFER_NUMBER; i++ {
+				if err := dm.Set("a", types.SignalingInfo{Flag: i}); err != nil {
+					t.Fatalf("set %d: %v", i, err)
+				}
+			}
+			if err := dm.Set("a", types.SignalingInfo{Flag: -1}); err != ErrQueueFull {
+				t.Fatalf("set on full queue: got %v, want %v", err, ErrQueueFull)
+			}
+			// the newest info is dropped
+			for i := 0; i < MAX_BUFFER_NUMBER; i++ {
+				info, ok, err := dm.Pop("a")
+				if err != nil || !ok || info.Flag != i {
+					t.Fatalf("pop %d: got %+v, ok %v, err %v", i, info, ok, err)
+				}
+			}
+		})
+	}
+}
+
+func TestDManagerMaxIds(t *testing.T) {
+	for name, dm := range dmanagers(t, 2) {
+		t.Run(name, func(t *testing.T) {
+			for _, id := range []string{"a", "b"} {
+				if err := dm.Set(id, types.SignalingInfo{}); err != nil {
+					t.Fatalf("set %s: %v", id, err)
+				}
+			}
+			if err := dm.Set("c", types.SignalingInfo{}); err != ErrTooManyIDs {
+				t.Fatalf("set of a third id: got %v, want %v", err, ErrTooManyIDs)
+			}
+			// known ids still take infos
+			if err := dm.Set("a", types.SignalingInfo{}); err != nil {
+				t.Fatalf("set of a known id: %v", err)
+			}
+		})
+	}
+}
+
+func TestMemoryDManagerClose(t *testing.T) {
+	dm := NewMemoryDManager(0)
+	dm.Close()
+	// closing twice is fine, queues still work without the sweeper
+	dm.Close()
+	if err := dm.Set("a", types.SignalingInfo{Flag: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if info, ok, err := dm.Pop("a"); err != nil || !ok || info.Flag != 1 {
+		t.Fatalf("pop after close: got %+v, ok %v, err %v", info, ok, err)
+	}
+}
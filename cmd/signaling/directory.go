@@ -0,0 +1,184 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/gob"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"github.com/suutaku/sshx/pkg/types"
+)
+
+const (
+	// a node announces every 10 seconds, it is offline after missing a few
+	ONLINE_TIMEOUT = 30 * time.Second
+	// forget nodes not seen for this long
+	PEER_LIFE_TIME = 24 * time.Hour
+)
+
+// Directory records which nodes are online, per group
+type Directory interface {
+	Seen(group string, peer types.PeerInfo) error
+	Peers(group string) ([]types.PeerInfo, error)
+}
+
+// MemoryDirectory keeps the peer directory in process
+type MemoryDirectory struct {
+	mu     sync.Mutex
+	groups map[string]map[string]types.PeerInfo
+	count  int
+	maxIds int
+}
+
+// NewMemoryDirectory creates a directory of at most maxIds peers, 0 for no
+// limit
+func NewMemoryDirectory(maxIds int) *MemoryDirectory {
+	return &MemoryDirectory{
+		groups: make(map[string]map[string]types.PeerInfo),
+		maxIds: maxIds,
+	}
+}
+
+func (md *MemoryDirectory) Seen(group string, peer types.PeerInfo) error {
+	md.mu.Lock()
+	defer md.mu.Unlock()
+	if md.groups[group] == nil {
+		md.groups[group] = make(map[string]types.PeerInfo)
+	}
+	if _, ok := md.groups[group][peer.ID]; !ok {
+		if md.maxIds > 0 && md.count >= md.maxIds {
+			md.expire()
+			if md.count >= md.maxIds {
+				return ErrTooManyIDs
+			}
+		}
+		md.count++
+	}
+	md.groups[group][peer.ID] = peer
+	return nil
+}
+
+func (md *MemoryDirectory) expire() {
+	for _, peers := range md.groups {
+		for k, v := range peers {
+			if time.Since(v.LastSeen) > PEER_LIFE_TIME {
+				delete(peers, k)
+				md.count--
+			}
+		}
+	}
+}
+
+func (md *MemoryDirectory) Peers(group string) ([]types.PeerInfo, error) {
+	md.mu.Lock()
+	defer md.mu.Unlock()
+	ret := make([]types.PeerInfo, 0, len(md.groups[group]))
+	for k, v := range md.groups[group] {
+		if time.Since(v.LastSeen) > PEER_LIFE_TIME {
+			delete(md.groups[group], k)
+			md.count--
+			continue
+		}
+		ret = append(ret, v)
+	}
+	return ret, nil
+}
+
+// groupsFromEnv reads SSHX_SIGNALING_GROUPS, like "home:token1,work:token2"
+func groupsFromEnv() map[string]string {
+	ret := make(map[string]string)
+	for _, v := range strings.Split(os.Getenv("SSHX_SIGNALING_GROUPS"), ",") {
+		kv := strings.SplitN(strings.TrimSpace(v), ":", 2)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			if v != "" {
+				logrus.Error("ignore invalid group ", v)
+			}
+			continue
+		}
+		ret[kv[0]] = kv[1]
+	}
+	return ret
+}
+
+// authGroup checks basic auth credentials against the configured groups.
+// ok is false if credentials were given but are wrong.
+func (sv *Server) authGroup(r *http.Request) (group string, ok bool) {
+	name, token, given := r.BasicAuth()
+	if !given {
+		return "", true
+	}
+	expect, exist := sv.groups[name]
+	if !exist {
+		// compare anyway, not to tell which groups exist
+		expect = token + "x"
+	}
+	if subtle.ConstantTimeCompare([]byte(expect), []byte(token)) != 1 {
+		return "", false
+	}
+	return name, true
+}
+
+func (sv *Server) announce() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		group, ok := sv.authGroup(r)
+		if !ok || group == "" {
+			// nobody could list a peer announced without a group
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		var info types.PeerInfo
+		if err := gob.NewDecoder(r.Body).Decode(&info); err != nil {
+			logrus.Error("binary decode failed:", err)
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+		vars := mux.Vars(r)
+		info.ID = vars["self_id"]
+		info.LastSeen = time.Now()
+		info.Online = false
+		err := sv.dir.Seen(group, info)
+		if err == ErrTooManyIDs {
+			sv.metrics.rejected.With("max_ids").Inc()
+			tooManyRequests(w)
+			return
+		}
+		if err != nil {
+			logrus.Error("announce failed:", err)
+			http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+			return
+		}
+	})
+}
+
+func (sv *Server) peers() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		group, ok := sv.authGroup(r)
+		if !ok || group == "" {
+			w.Header().Set("WWW-Authenticate", `Basic realm="sshx"`)
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		peers, err := sv.dir.Peers(group)
+		if err != nil {
+			logrus.Error("list peers failed:", err)
+			http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+			return
+		}
+		for i := range peers {
+			peers[i].Online = time.Since(peers[i].LastSeen) < ONLINE_TIMEOUT
+		}
+		sort.Slice(peers, func(i, j int) bool {
+			return peers[i].ID < peers[j].ID
+		})
+		w.Header().Add("Content-Type", "application/binary")
+		if err := gob.NewEncoder(w).Encode(peers); err != nil {
+			logrus.Error("binary encode failed:", err)
+		}
+	})
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/suutaku/sshx/pkg/types"
+)
+
+// directories returns every Directory implementation of at most maxIds peers
+func directories(t *testing.T, maxIds int) map[string]Directory {
+	rdm, err := NewRedisDManager(newRespStub(t), maxIds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return map[string]Directory{
+		"memory": NewMemoryDirectory(maxIds),
+		"redis":  rdm,
+	}
+}
+
+func TestDirectoryMaxIds(t *testing.T) {
+	for name, dir := range directories(t, 2) {
+		t.Run(name, func(t *testing.T) {
+			for _, id := range []string{"a", "b"} {
+				if err := dir.Seen("home", types.PeerInfo{ID: id, LastSeen: time.Now()}); err != nil {
+					t.Fatalf("seen %s: %v", id, err)
+				}
+			}
+			if err := dir.Seen("home", types.PeerInfo{ID: "c", LastSeen: time.Now()}); err != ErrTooManyIDs {
+				t.Fatalf("seen of a third id: got %v, want %v", err, ErrTooManyIDs)
+			}
+			// known peers still announce
+			if err := dir.Seen("home", types.PeerInfo{ID: "a", LastSeen: time.Now()}); err != nil {
+				t.Fatalf("seen of a known id: %v", err)
+			}
+		})
+	}
+}
+
+func TestAnnounceWithoutGroup(t *testing.T) {
+	dir := NewMemoryDirectory(0)
+	dm := NewMemoryDManager(0)
+	t.Cleanup(dm.Close)
+	sv := NewServer("", TurnConf{}, LimitConf{}, dm, dir)
+	sv.groups = map[string]string{"home": "secret"}
+	ts := httptest.NewServer(sv.Handler())
+	t.Cleanup(ts.Close)
+
+	announce := func(group, token string) int {
+		var buf bytes.Buffer
+		gob.NewEncoder(&buf).Encode(types.PeerInfo{})
+		req, err := http.NewRequest(http.MethodPost, ts.URL+"/announce/a", &buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if group != "" {
+			req.SetBasicAuth(group, token)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+	if code := announce("", ""); code != http.StatusUnauthorized {
+		t.Fatalf("announce without group: got %d, want %d", code, http.StatusUnauthorized)
+	}
+	if code := announce("home", "wrong"); code != http.StatusUnauthorized {
+		t.Fatalf("announce with a wrong token: got %d, want %d", code, http.StatusUnauthorized)
+	}
+	if dir.count != 0 {
+		t.Fatalf("%d peers stored from refused announces", dir.count)
+	}
+	if code := announce("home", "secret"); code != http.StatusOK {
+		t.Fatalf("announce of a group member: got %d, want %d", code, http.StatusOK)
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/suutaku/sshx/internal/qos"
+)
+
+const (
+	// signaling infos are small, offers with many candidates stay well below
+	MAX_REQUEST_SIZE = 64 * 1024
+	// forget idle limiter keys after this long
+	limiterIdleTime = time.Minute
+)
+
+type LimitConf struct {
+	// requests per second of one client address, 0 for no limit
+	SourceRate int64
+	// pushes per second to one node id, 0 for no limit
+	TargetRate int64
+	// turn credentials per second of one node id, 0 for no limit
+	TurnRate int64
+	// number of node ids with queued infos, 0 for no limit
+	MaxIds int
+	// take the client address from X-Forwarded-For, behind a load balancer.
+	// Without it all clients share the SourceRate of the balancer address
+	TrustProxy bool
+}
+
+func envInt(name string, def int64) int64 {
+	str := os.Getenv(name)
+	if str == "" {
+		return def
+	}
+	v, err := strconv.ParseInt(str, 10, 64)
+	if err != nil {
+		logrus.Error("invalid ", name, ": ", err)
+		return def
+	}
+	return v
+}
+
+func limitConfFromEnv() LimitConf {
+	return LimitConf{
+		SourceRate: envInt("SSHX_SIGNALING_SOURCE_RATE", 50),
+		TargetRate: envInt("SSHX_SIGNALING_TARGET_RATE", 20),
+		TurnRate:   envInt("SSHX_SIGNALING_TURN_RATE", 1),
+		MaxIds:     int(envInt("SSHX_SIGNALING_MAX_IDS", 100000)),
+		TrustProxy: os.Getenv("SSHX_SIGNALING_TRUST_PROXY") != "",
+	}
+}
+
+type limiterEntry struct {
+	bucket *qos.Bucket
+	used   time.Time
+}
+
+// limiter keeps a token bucket per key, bursts up to twice the rate
+type limiter struct {
+	mu        sync.Mutex
+	rate      int64
+	entries   map[string]*limiterEntry
+	lastSweep time.Time
+}
+
+func newLimiter(rate int64) *limiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &limiter{
+		rate:      rate,
+		entries:   make(map[string]*limiterEntry),
+		lastSweep: time.Now(),
+	}
+}
+
+func (l *limiter) Allow(key string) bool {
+	if l == nil {
+		return true
+	}
+	now := time.Now()
+	l.mu.Lock()
+	if now.Sub(l.lastSweep) > limiterIdleTime {
+		for k, v := range l.entries {
+			if now.Sub(v.used) > limiterIdleTime {
+				delete(l.entries, k)
+			}
+		}
+		l.lastSweep = now
+	}
+	entry := l.entries[key]
+	if entry == nil {
+		entry = &limiterEntry{bucket: qos.NewBucketWithBurst(l.rate, 2*l.rate)}
+		l.entries[key] = entry
+	}
+	entry.used = now
+	l.mu.Unlock()
+	return entry.bucket.Allow(1)
+}
+
+func (sv *Server) clientAddr(r *http.Request) string {
+	if sv.limits.TrustProxy {
+		if fwd := r.Header.Get("X-Forwarded-For"); fwd != "" {
+			return strings.TrimSpace(strings.Split(fwd, ",")[0])
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func tooManyRequests(w http.ResponseWriter) {
+	w.Header().Set("Retry-After", "1")
+	http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+}
+
+// limit applies the per source rate and the request size limit to h
+func (sv *Server) limit(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !sv.sourceLimit.Allow(sv.clientAddr(r)) {
+			logrus.Debug("rate limit source ", sv.clientAddr(r))
+			sv.metrics.rejected.With("source_rate").Inc()
+			tooManyRequests(w)
+			return
+		}
+		if r.ContentLength > MAX_REQUEST_SIZE {
+			sv.metrics.rejected.With("too_large").Inc()
+			http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, MAX_REQUEST_SIZE)
+		h.ServeHTTP(w, r)
+	})
+}
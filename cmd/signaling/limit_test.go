@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/suutaku/sshx/pkg/types"
+)
+
+func newTestServer(t *testing.T, lc LimitConf) *httptest.Server {
+	dm := NewMemoryDManager(lc.MaxIds)
+	t.Cleanup(dm.Close)
+	sv := NewServer("", TurnConf{}, lc, dm, NewMemoryDirectory(lc.MaxIds))
+	ts := httptest.NewServer(sv.Handler())
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+// hammer sends n requests at once and counts the answers by status
+func hammer(t *testing.T, n int, newReq func(i int) *http.Request) map[int]int {
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	codes := make(map[int]int)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			res, err := http.DefaultClient.Do(newReq(i))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			res.Body.Close()
+			mu.Lock()
+			codes[res.StatusCode]++
+			mu.Unlock()
+		}(i)
+	}
+	wg.Wait()
+	return codes
+}
+
+func TestLimitSourceRate(t *testing.T) {
+	const rate = 10
+	ts := newTestServer(t, LimitConf{SourceRate: rate})
+	start := time.Now()
+	codes := hammer(t, 200, func(int) *http.Request {
+		req, _ := http.NewRequest(http.MethodGet, ts.URL+"/pull/a", nil)
+		return req
+	})
+	// the burst plus what refilled while the requests ran
+	max := 2*rate + int(time.Since(start).Seconds()*rate) + 1
+	if codes[http.StatusOK] < 2*rate || codes[http.StatusOK] > max {
+		t.Fatalf("%d requests passed, want %d to %d", codes[http.StatusOK], 2*rate, max)
+	}
+	if codes[http.StatusOK]+codes[http.StatusTooManyRequests] != 200 {
+		t.Fatalf("unexpected answers %v", codes)
+	}
+}
+
+func TestLimitTrustProxy(t *testing.T) {
+	const rate = 5
+	tests := []struct {
+		name  string
+		trust bool
+		// requests passing of 10 clients sending 2*rate requests each
+		want int
+	}{
+		{"shared bucket", false, 2 * rate},
+		{"bucket per client", true, 10 * 2 * rate},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := newTestServer(t, LimitConf{SourceRate: rate, TrustProxy: tt.trust})
+			codes := hammer(t, 10*2*rate, func(i int) *http.Request {
+				req, _ := http.NewRequest(http.MethodGet, ts.URL+"/pull/a", nil)
+				req.Header.Set("X-Forwarded-For", "10.0.0."+strconv.Itoa(i%10))
+				return req
+			})
+			// allow for refills while the requests ran
+			if got := codes[http.StatusOK]; got < tt.want || got > tt.want+rate {
+				t.Fatalf("%d requests passed, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLimitTargetRate(t *testing.T) {
+	const rate = 5
+	ts := newTestServer(t, LimitConf{TargetRate: rate})
+	codes := hammer(t, 50, func(i int) *http.Request {
+		var buf bytes.Buffer
+		gob.NewEncoder(&buf).Encode(types.SignalingInfo{Source: "b", Target: "a"})
+		req, _ := http.NewRequest(http.MethodPost, ts.URL+"/push/a", &buf)
+		return req
+	})
+	if got := codes[http.StatusOK]; got < 2*rate || got > 2*rate+rate {
+		t.Fatalf("%d pushes passed, want %d", got, 2*rate)
+	}
+}
+
+func TestPushQueueFull(t *testing.T) {
+	ts := newTestServer(t, LimitConf{})
+	for i := 0; i <= MAX_BUFFER_NUMBER; i++ {
+		var buf bytes.Buffer
+		gob.NewEncoder(&buf).Encode(types.SignalingInfo{Source: "b", Target: "a"})
+		res, err := http.Post(ts.URL+"/push/a", "application/binary", &buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		want := http.StatusOK
+		if i == MAX_BUFFER_NUMBER {
+			want = http.StatusServiceUnavailable
+		}
+		if res.StatusCode != want {
+			t.Fatalf("push %d: got %s, want %d", i, res.Status, want)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"flag"
 	"os"
 
 	"github.com/sirupsen/logrus"
@@ -8,17 +9,53 @@ import (
 )
 
 func main() {
-	port := os.Getenv("SSHX_SIGNALING_PORT")
-	if port == "" {
-		port = "5003"
+	defaultPort := os.Getenv("SSHX_SIGNALING_PORT")
+	if defaultPort == "" {
+		defaultPort = "5003"
 	}
+	port := flag.String("port", defaultPort, "listening port, defaults to SSHX_SIGNALING_PORT or 5003")
+	accessLog := flag.Bool("access-log", false, "log every request")
+	logJSON := flag.Bool("log-json", false, "log in json format")
+	flag.Parse()
 
-	server := NewServer(port)
-
+	if *logJSON {
+		logrus.SetFormatter(&logrus.JSONFormatter{})
+	}
 	if utils.DebugOn() {
 		logrus.SetLevel(logrus.DebugLevel)
 	} else {
 		logrus.SetLevel(logrus.InfoLevel)
 	}
+
+	tc := turnConfFromEnv()
+	if tc.Listen != "" {
+		relay, err := startTurn(tc)
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		defer relay.Close()
+	}
+
+	lc := limitConfFromEnv()
+	if lc.SourceRate > 0 && !lc.TrustProxy {
+		logrus.Infof("rate limit %d requests per second by client address, behind a load balancer set SSHX_SIGNALING_TRUST_PROXY", lc.SourceRate)
+	}
+	var dm DManager
+	var dir Directory
+	if redisURL := os.Getenv("SSHX_SIGNALING_REDIS"); redisURL != "" {
+		rdm, err := NewRedisDManager(redisURL, lc.MaxIds)
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		logrus.Info("share signaling queues through ", rdm.addr)
+		dm = rdm
+		dir = rdm
+	} else {
+		// only built without redis, its sweeper runs until Close
+		dm = NewMemoryDManager(lc.MaxIds)
+		dir = NewMemoryDirectory(lc.MaxIds)
+	}
+	server := NewServer(*port, tc, lc, dm, dir)
+	server.accessLog = *accessLog
 	server.Start()
 }
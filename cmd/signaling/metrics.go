@@ -0,0 +1,132 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"github.com/suutaku/sshx/internal/metrics"
+	"github.com/suutaku/sshx/pkg/types"
+)
+
+// statsReporter is implemented by stores able to count their content
+type statsReporter interface {
+	Stats() (ids int, queued map[int]int)
+}
+
+// pinger is implemented by stores depending on an external service
+type pinger interface {
+	Ping() error
+}
+
+var sigTypeNames = map[int]string{
+	types.SIG_TYPE_UNKNOWN:   "unknown",
+	types.SIG_TYPE_CANDIDATE: "candidate",
+	types.SIG_TYPE_ANSWER:    "answer",
+	types.SIG_TYPE_OFFER:     "offer",
+}
+
+func sigTypeName(flag int) string {
+	if name, ok := sigTypeNames[flag]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+type serverMetrics struct {
+	registry *metrics.Registry
+	requests *metrics.CounterVec
+	latency  *metrics.HistogramVec
+	pushed   *metrics.CounterVec
+	pulled   *metrics.CounterVec
+	dropped  *metrics.CounterVec
+	rejected *metrics.CounterVec
+}
+
+func newServerMetrics(dm DManager) *serverMetrics {
+	reg := metrics.NewRegistry()
+	ret := &serverMetrics{
+		registry: reg,
+		requests: reg.Counter("sshx_signaling_requests_total", "HTTP requests by handler and status code.", "handler", "code"),
+		latency:  reg.Histogram("sshx_signaling_request_duration_seconds", "HTTP request latencies by handler.", metrics.DefBuckets, "handler"),
+		pushed:   reg.Counter("sshx_signaling_pushed_total", "Signaling infos queued by type.", "type"),
+		pulled:   reg.Counter("sshx_signaling_pulled_total", "Signaling infos delivered by type.", "type"),
+		dropped:  reg.Counter("sshx_signaling_dropped_total", "Signaling infos dropped on a full queue by type.", "type"),
+		rejected: reg.Counter("sshx_signaling_rejected_total", "Requests rejected by reason.", "reason"),
+	}
+	if sr, ok := dm.(statsReporter); ok {
+		reg.GaugeFunc("sshx_signaling_active_ids", "Node ids with a queue.", nil,
+			func(emit func(float64, ...string)) {
+				ids, _ := sr.Stats()
+				emit(float64(ids))
+			})
+		reg.GaugeFunc("sshx_signaling_queued", "Queued signaling infos by type.", []string{"type"},
+			func(emit func(float64, ...string)) {
+				_, queued := sr.Stats()
+				for _, flag := range []int{types.SIG_TYPE_OFFER, types.SIG_TYPE_ANSWER, types.SIG_TYPE_CANDIDATE} {
+					emit(float64(queued[flag]), sigTypeName(flag))
+				}
+			})
+	}
+	return ret
+}
+
+// statusRecorder remembers the status code and size of a response
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	size   int
+}
+
+func (sr *statusRecorder) WriteHeader(code int) {
+	sr.status = code
+	sr.ResponseWriter.WriteHeader(code)
+}
+
+func (sr *statusRecorder) Write(b []byte) (int, error) {
+	n, err := sr.ResponseWriter.Write(b)
+	sr.size += n
+	return n, err
+}
+
+// observe records metrics and an access log entry for every request
+func (sv *Server) observe(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		h.ServeHTTP(rec, r)
+		elapsed := time.Since(start)
+		handler := "unknown"
+		if route := mux.CurrentRoute(r); route != nil && route.GetName() != "" {
+			handler = route.GetName()
+		}
+		sv.metrics.requests.With(handler, strconv.Itoa(rec.status)).Inc()
+		sv.metrics.latency.With(handler).Observe(elapsed.Seconds())
+		if !sv.accessLog {
+			return
+		}
+		logrus.WithFields(logrus.Fields{
+			"remote":   sv.clientAddr(r),
+			"method":   r.Method,
+			"path":     r.URL.Path,
+			"status":   rec.status,
+			"size":     rec.size,
+			"duration": elapsed.String(),
+		}).Info("access")
+	})
+}
+
+func (sv *Server) healthz() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if p, ok := sv.dm.(pinger); ok {
+			if err := p.Ping(); err != nil {
+				logrus.Error("health check failed:", err)
+				http.Error(w, err.Error(), http.StatusServiceUnavailable)
+				return
+			}
+		}
+		w.Write([]byte("ok\n"))
+	})
+}
@@ -11,24 +11,51 @@ import (
 )
 
 type Server struct {
-	port string
-	dm   *DManager
+	port   string
+	dm     DManager
+	dir    Directory
+	turn   TurnConf
+	groups map[string]string
+	limits LimitConf
+	// per client address and per target id request rates
+	sourceLimit *limiter
+	targetLimit *limiter
+	turnLimit   *limiter
+	metrics     *serverMetrics
+	accessLog   bool
 }
 
-func NewServer(port string) *Server {
+func NewServer(port string, tc TurnConf, lc LimitConf, dm DManager, dir Directory) *Server {
 	return &Server{
-		port: port,
-		dm:   NewDManager(),
+		port:        port,
+		dm:          dm,
+		dir:         dir,
+		turn:        tc,
+		groups:      groupsFromEnv(),
+		limits:      lc,
+		sourceLimit: newLimiter(lc.SourceRate),
+		targetLimit: newLimiter(lc.TargetRate),
+		turnLimit:   newLimiter(lc.TurnRate),
+		metrics:     newServerMetrics(dm),
 	}
 }
 
-func (sv *Server) Start() {
-
+// Handler routes all endpoints of the server
+func (sv *Server) Handler() http.Handler {
 	r := mux.NewRouter()
-	r.Handle("/pull/{self_id}", sv.pull())
-	r.Handle("/push/{target_id}", sv.push())
+	r.Handle("/pull/{self_id}", sv.pull()).Name("pull")
+	r.Handle("/push/{target_id}", sv.push()).Name("push")
+	r.Handle("/turn/{self_id}", sv.turnCredential()).Name("turn")
+	r.Handle("/announce/{self_id}", sv.announce()).Methods(http.MethodPost).Name("announce")
+	r.Handle("/peers", sv.peers()).Methods(http.MethodGet).Name("peers")
+	r.Handle("/healthz", sv.healthz()).Name("healthz")
+	r.Handle("/metrics", sv.metrics.registry.Handler()).Name("metrics")
+	r.Use(sv.observe, sv.limit)
+	return r
+}
 
-	http.Handle("/", r)
+func (sv *Server) Start() {
+	http.Handle("/", sv.Handler())
 
 	logrus.Infof("Listening on port %s", sv.port)
 	logrus.Fatal(http.ListenAndServe(fmt.Sprintf(":%s", sv.port), nil))
@@ -37,15 +64,21 @@ func (sv *Server) Start() {
 func (sv *Server) pull() http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		vars := mux.Vars(r)
-		select {
-		case v := <-sv.dm.Get(vars["self_id"]):
-			logrus.Debug("pull from ", vars["self_id"], v.Flag)
-			w.Header().Add("Content-Type", "application/binary")
-			if err := gob.NewEncoder(w).Encode(v); err != nil {
-				logrus.Error("binary encode failed:", err)
-				return
-			}
-		default:
+		v, ok, err := sv.dm.Pop(vars["self_id"])
+		if err != nil {
+			logrus.Error("pull failed:", err)
+			http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+			return
+		}
+		if !ok {
+			return
+		}
+		logrus.Debug("pull from ", vars["self_id"], v.Flag)
+		sv.metrics.pulled.With(sigTypeName(v.Flag)).Inc()
+		w.Header().Add("Content-Type", "application/binary")
+		if err := gob.NewEncoder(w).Encode(v); err != nil {
+			logrus.Error("binary encode failed:", err)
+			return
 		}
 	})
 }
@@ -59,7 +92,32 @@ func (sv *Server) push() http.Handler {
 			return
 		}
 		vars := mux.Vars(r)
-		sv.dm.Set(vars["target_id"], info)
+		if !sv.targetLimit.Allow(vars["target_id"]) {
+			logrus.Debug("rate limit target ", vars["target_id"])
+			sv.metrics.rejected.With("target_rate").Inc()
+			tooManyRequests(w)
+			return
+		}
+		err := sv.dm.Set(vars["target_id"], info)
+		if err == ErrQueueFull {
+			// the target does not pull, the caller may retry later
+			logrus.Debug("queue of ", vars["target_id"], " is full")
+			sv.metrics.dropped.With(sigTypeName(info.Flag)).Inc()
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "queue of the target is full", http.StatusServiceUnavailable)
+			return
+		}
+		if err == ErrTooManyIDs {
+			sv.metrics.rejected.With("max_ids").Inc()
+			tooManyRequests(w)
+			return
+		}
+		if err != nil {
+			logrus.Error("push failed:", err)
+			http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+			return
+		}
 		logrus.Debug("push from ", info.Source, " to ", vars["target_id"], info.Flag)
+		sv.metrics.pushed.With(sigTypeName(info.Flag)).Inc()
 	})
 }
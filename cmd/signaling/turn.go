@@ -0,0 +1,155 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/gob"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/pion/turn/v2"
+	"github.com/sirupsen/logrus"
+	"github.com/suutaku/sshx/pkg/types"
+)
+
+const defaultTurnTTL = time.Hour
+
+type TurnConf struct {
+	// shared secret with the TURN server, credentials are disabled if empty
+	Secret string
+	// TURN urls handed to nodes, like turn:turn.example.com:3478
+	URLs []string
+	TTL  time.Duration
+	// run an embedded relay on this UDP address if not empty
+	Listen   string
+	Realm    string
+	PublicIP string
+	// hand credentials to callers without group credentials too, anyone
+	// may relay through the TURN server then
+	Open bool
+}
+
+func turnConfFromEnv() TurnConf {
+	tc := TurnConf{
+		Secret:   os.Getenv("SSHX_TURN_SECRET"),
+		TTL:      defaultTurnTTL,
+		Listen:   os.Getenv("SSHX_TURN_LISTEN"),
+		Realm:    os.Getenv("SSHX_TURN_REALM"),
+		PublicIP: os.Getenv("SSHX_TURN_PUBLIC_IP"),
+		Open:     os.Getenv("SSHX_TURN_OPEN") != "",
+	}
+	if urls := os.Getenv("SSHX_TURN_URLS"); urls != "" {
+		tc.URLs = strings.Split(urls, ",")
+	}
+	if ttl := os.Getenv("SSHX_TURN_TTL"); ttl != "" {
+		d, err := time.ParseDuration(ttl)
+		if err != nil {
+			logrus.Error("invalid SSHX_TURN_TTL: ", err)
+		} else {
+			tc.TTL = d
+		}
+	}
+	if tc.Realm == "" {
+		tc.Realm = "sshx"
+	}
+	return tc
+}
+
+// turnPassword computes base64(HMAC-SHA1(secret, username))
+func turnPassword(secret, username string) string {
+	mac := hmac.New(sha1.New, []byte(secret))
+	mac.Write([]byte(username))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (tc TurnConf) credential(id string) types.TurnCredential {
+	username := fmt.Sprintf("%d:%s", time.Now().Add(tc.TTL).Unix(), id)
+	return types.TurnCredential{
+		URLs:     tc.URLs,
+		Username: username,
+		Password: turnPassword(tc.Secret, username),
+		TTL:      int64(tc.TTL.Seconds()),
+	}
+}
+
+// authHandler accepts usernames of the form expiry[:id] which did not expire
+func (tc TurnConf) authHandler(username, realm string, srcAddr net.Addr) ([]byte, bool) {
+	expiry, err := strconv.ParseInt(strings.SplitN(username, ":", 2)[0], 10, 64)
+	if err != nil {
+		logrus.Debug("invalid turn username ", username, " from ", srcAddr)
+		return nil, false
+	}
+	if expiry < time.Now().Unix() {
+		logrus.Debug("expired turn username ", username, " from ", srcAddr)
+		return nil, false
+	}
+	return turn.GenerateAuthKey(username, realm, turnPassword(tc.Secret, username)), true
+}
+
+// turnCredential issues credentials to members of a group, the relay is
+// open to anyone who gets one
+func (sv *Server) turnCredential() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if sv.turn.Secret == "" || len(sv.turn.URLs) == 0 {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+		group, ok := sv.authGroup(r)
+		if !ok || (group == "" && !sv.turn.Open) {
+			w.Header().Set("WWW-Authenticate", `Basic realm="sshx"`)
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		vars := mux.Vars(r)
+		caller := group + "/" + vars["self_id"]
+		if group == "" {
+			caller = sv.clientAddr(r)
+		}
+		if !sv.turnLimit.Allow(caller) {
+			logrus.Debug("rate limit turn credentials of ", caller)
+			sv.metrics.rejected.With("turn_rate").Inc()
+			tooManyRequests(w)
+			return
+		}
+		w.Header().Add("Content-Type", "application/binary")
+		if err := gob.NewEncoder(w).Encode(sv.turn.credential(vars["self_id"])); err != nil {
+			logrus.Error("binary encode failed:", err)
+		}
+	})
+}
+
+// startTurn runs an embedded TURN relay for small deployments
+func startTurn(tc TurnConf) (*turn.Server, error) {
+	if tc.Secret == "" {
+		return nil, fmt.Errorf("SSHX_TURN_SECRET is required for the embedded TURN server")
+	}
+	publicIP := net.ParseIP(tc.PublicIP)
+	if publicIP == nil {
+		return nil, fmt.Errorf("invalid SSHX_TURN_PUBLIC_IP %q", tc.PublicIP)
+	}
+	udpListener, err := net.ListenPacket("udp4", tc.Listen)
+	if err != nil {
+		return nil, err
+	}
+	logrus.Infof("TURN relay listening on %s", tc.Listen)
+	return turn.NewServer(turn.ServerConfig{
+		Realm:       tc.Realm,
+		AuthHandler: tc.authHandler,
+		PacketConnConfigs: []turn.PacketConnConfig{
+			{
+				PacketConn: udpListener,
+				RelayAddressGenerator: &turn.RelayAddressGeneratorStatic{
+					RelayAddress: publicIP,
+					Address:      "0.0.0.0",
+				},
+			},
+		},
+	})
+}
@@ -1,17 +1,34 @@
 package main
 
 import (
+	"encoding/gob"
 	"fmt"
 
 	cli "github.com/jawher/mow.cli"
+	"github.com/sirupsen/logrus"
 	"github.com/suutaku/sshx/pkg/conf"
+	"github.com/suutaku/sshx/pkg/impl"
+	"github.com/suutaku/sshx/pkg/types"
 )
 
 func cmdGetConfig(cmd *cli.Cmd) {
-	cmd.Spec = "[KEYS...]"
+	cmd.Spec = "[ -o=<format> ] [KEYS...]"
+	outputOpt := cmd.StringOpt("o output", OUTPUT_TABLE, outputHelp)
 	keys := cmd.StringsArg("KEYS", nil, "get cofigure by key [[key1] [key2]],[key1.key2]. if key is empty, list all configure info")
 	cmd.Action = func() {
-		cm := conf.NewConfManager(getRootPath())
+		if err := checkOutput(*outputOpt); err != nil {
+			logrus.Error(err)
+			cli.Exit(1)
+		}
+		cm := confManager()
+		if *outputOpt != OUTPUT_TABLE {
+			names := *keys
+			if len(names) == 0 {
+				names = sortedKeys(cm.Viper.AllKeys())
+			}
+			writeConfig(cm, *outputOpt, names)
+			return
+		}
 		if keys == nil || len(*keys) == 0 {
 			cm.Show()
 			return
@@ -23,23 +40,109 @@ func cmdGetConfig(cmd *cli.Cmd) {
 	}
 }
 
+// writeConfig prints a flat key value map, csv gets one key,value row each
+func writeConfig(cm *conf.ConfManager, format string, keys []string) {
+	var err error
+	if format == OUTPUT_CSV {
+		records := make([]confRecord, 0, len(keys))
+		for _, k := range keys {
+			records = append(records, confRecord{Key: k, Value: cm.Viper.Get(k)})
+		}
+		err = writeRecords(format, records)
+	} else {
+		values := make(map[string]interface{}, len(keys))
+		for _, k := range keys {
+			values[k] = cm.Viper.Get(k)
+		}
+		err = writeRecords(format, values)
+	}
+	if err != nil {
+		logrus.Error(err)
+		cli.Exit(1)
+	}
+}
+
 func cmdSetConfig(cmd *cli.Cmd) {
 	cmd.Spec = "KEY VALUE"
 	key := cmd.StringArg("KEY", "", "configure key, [key] ]value], [key1.key2] [value]")
 	value := cmd.StringArg("VALUE", "", "configure value")
 	cmd.Action = func() {
-		cm := conf.NewConfManager(getRootPath())
+		cm := confManager()
 		if key == nil || *key == "" {
 			return
 		}
-		if value == nil || *value == "" {
+		if value == nil {
 			return
 		}
-		cm.Set(*key, *value)
+		err := cm.Set(*key, *value)
+		if err != nil {
+			logrus.Error(err)
+			cli.Exit(1)
+		}
+	}
+}
+
+// reloadDaemon asks the daemon to apply the configure file now
+func reloadDaemon() error {
+	sender := impl.NewSender(impl.NewSTAT(), types.OPTION_TYPE_RELOAD)
+	if sender == nil {
+		return fmt.Errorf("cannot create sender")
+	}
+	conn, err := sender.Send()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	var msg string
+	err = gob.NewEncoder(conn).Encode(msg)
+	if err != nil {
+		return err
+	}
+	err = gob.NewDecoder(conn).Decode(&msg)
+	if err != nil {
+		return err
+	}
+	if msg != "" {
+		return fmt.Errorf("configure not applied: %s", msg)
+	}
+	return nil
+}
+
+// cmdReloadConfig asks the daemon to apply the configure file now
+func cmdReloadConfig(cmd *cli.Cmd) {
+	cmd.Action = func() {
+		err := reloadDaemon()
+		if err != nil {
+			logrus.Error(err)
+			cli.Exit(1)
+		}
+		logrus.Info("configure applied")
 	}
 }
 
 func cmdConfig(cmd *cli.Cmd) {
 	cmd.Command("set", "set configure with key value", cmdSetConfig)
 	cmd.Command("get", "get configure value with key", cmdGetConfig)
+	cmd.Command("reload", "apply the configure file to the running daemon", cmdReloadConfig)
+	cmd.Command("init", "create a configure file with a new identity", cmdInitConfig)
+	cmd.Command("validate", "check a configure file", cmdValidateConfig)
+	cmd.Command("key", "print the key peers pin for this node in acl.keys", cmdKeyConfig)
+}
+
+func cmdKeyConfig(cmd *cli.Cmd) {
+	cmd.Action = func() {
+		// the key belongs to a configured node, not to a stray home
+		cm := confManager()
+		cert, err := conf.LoadIdentity(cm.Path)
+		if err != nil {
+			logrus.Error(err)
+			cli.Exit(1)
+		}
+		key, err := conf.Fingerprint(cert)
+		if err != nil {
+			logrus.Error(err)
+			cli.Exit(1)
+		}
+		fmt.Println(key)
+	}
 }
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	cli "github.com/jawher/mow.cli"
+	"github.com/pion/webrtc/v3"
+	"github.com/sirupsen/logrus"
+	"github.com/suutaku/sshx/pkg/conf"
+	"golang.org/x/term"
+)
+
+// prompt asks for a value on the terminal, def is kept on an empty answer
+func prompt(in *bufio.Reader, question, def string) string {
+	fmt.Printf("%s [%s]: ", question, def)
+	line, err := in.ReadString('\n')
+	if err != nil {
+		return def
+	}
+	if line = strings.TrimSpace(line); line != "" {
+		return line
+	}
+	return def
+}
+
+func splitList(str string) []string {
+	ret := make([]string, 0)
+	for _, v := range strings.Split(str, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			ret = append(ret, v)
+		}
+	}
+	return ret
+}
+
+func cmdInitConfig(cmd *cli.Cmd) {
+	cmd.Spec = "[ -f ] [ -y ] [ --id ] [ --signaling ] [ --stun ] [ --group ] [ --token ] [ --tcp-port ] [ --direct-port ]"
+	forceOpt := cmd.BoolOpt("f force", false, "overwrite an existing configure file")
+	yesOpt := cmd.BoolOpt("y yes", false, "do not ask, use flags and defaults")
+	def := conf.NewDefaultConfigure()
+	stun := make([]string, 0)
+	for _, v := range def.RTCConf.ICEServers {
+		stun = append(stun, v.URLs...)
+	}
+	idOpt := cmd.StringOpt("id", def.ID, "node id, a new uuid by default")
+	signalingOpt := cmd.StringOpt("signaling", def.SignalingServerAddr, "signaling server url")
+	stunOpt := cmd.StringOpt("stun", strings.Join(stun, ","), "comma separated stun urls")
+	groupOpt := cmd.StringOpt("group", "", "presence group")
+	tokenOpt := cmd.StringOpt("token", "", "presence group token")
+	portOpt := cmd.IntOpt("tcp-port", int(def.LocalTCPPort), "loopback port of the daemon for local commands, 0 for its socket only")
+	directOpt := cmd.IntOpt("direct-port", int(def.DirectPort), "port of direct connections, 0 for 8099, -1 to disable them")
+	cmd.Action = func() {
+		home := getRootPath()
+		file := conf.ConfigPath(home)
+		if _, err := os.Stat(file); err == nil && !*forceOpt {
+			logrus.Error(file, " exists, use -f to overwrite it")
+			cli.Exit(1)
+		}
+		if !*yesOpt && term.IsTerminal(int(os.Stdin.Fd())) {
+			in := bufio.NewReader(os.Stdin)
+			*idOpt = prompt(in, "Node id", *idOpt)
+			*signalingOpt = prompt(in, "Signaling server", *signalingOpt)
+			*stunOpt = prompt(in, "STUN servers, comma separated", *stunOpt)
+			*groupOpt = prompt(in, "Presence group, empty for none", *groupOpt)
+			if *groupOpt != "" {
+				*tokenOpt = prompt(in, "Presence token", *tokenOpt)
+			}
+		}
+		c := def
+		c.ID = *idOpt
+		c.SignalingServerAddr = *signalingOpt
+		c.RTCConf.ICEServers = nil
+		if urls := splitList(*stunOpt); len(urls) > 0 {
+			c.RTCConf.ICEServers = []webrtc.ICEServer{{URLs: urls}}
+		}
+		c.Presence.Group = *groupOpt
+		c.Presence.Token = *tokenOpt
+		c.LocalTCPPort = int32(*portOpt)
+		c.DirectPort = int32(*directOpt)
+		err := conf.WriteConfigure(home, c)
+		if err != nil {
+			logrus.Error(err)
+			cli.Exit(1)
+		}
+		logrus.Info("wrote ", file, " for node ", c.ID)
+	}
+}
+
+func cmdValidateConfig(cmd *cli.Cmd) {
+	cmd.Spec = "[ FILE ]"
+	fileArg := cmd.StringArg("FILE", "", "configure file, the one of the daemon by default")
+	cmd.Action = func() {
+		file := *fileArg
+		if file == "" {
+			file = conf.ConfigPath(getRootPath())
+		}
+		err := conf.ValidateFile(file)
+		if err != nil {
+			for _, v := range strings.Split(err.Error(), "; ") {
+				fmt.Println(v)
+			}
+			cli.Exit(1)
+		}
+		fmt.Println(file, "is valid")
+	}
+}
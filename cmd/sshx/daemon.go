@@ -1,14 +1,32 @@
 package main
 
 import (
+	"os"
+	"os/signal"
+	"syscall"
+
 	cli "github.com/jawher/mow.cli"
+	"github.com/sirupsen/logrus"
 	"github.com/suutaku/sshx/internal/node"
 )
 
 func cmdDaemon(cmd *cli.Cmd) {
 	cmd.Action = func() {
-		n := node.NewNode(getRootPath())
-		defer n.Stop()
+		n, err := node.NewNode(getRootPath())
+		if err != nil {
+			logrus.Error(err)
+			cli.Exit(1)
+		}
+		// stop removes the control socket
+		sig := make(chan os.Signal, 1)
+		done := make(chan struct{})
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		go func() {
+			<-sig
+			n.Stop()
+			close(done)
+		}()
 		n.Start()
+		<-done
 	}
 }
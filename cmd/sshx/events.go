@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	cli "github.com/jawher/mow.cli"
+	"github.com/sirupsen/logrus"
+	"github.com/suutaku/sshx/pkg/impl"
+	"github.com/suutaku/sshx/pkg/types"
+)
+
+func cmdEvents(cmd *cli.Cmd) {
+	cmd.Spec = "[ -o=<format> ]"
+	outputOpt := cmd.StringOpt("o output", "text", "output format: text or json, one event per line")
+	cmd.Action = func() {
+		if *outputOpt != "text" && *outputOpt != OUTPUT_JSON {
+			logrus.Errorf("unknown output format %q, want text or json", *outputOpt)
+			cli.Exit(1)
+		}
+		imp := impl.NewSTAT()
+		sender := impl.NewSender(imp, types.OPTION_TYPE_SUBSCRIBE)
+		if sender == nil {
+			logrus.Error("cannot create sender")
+			cli.Exit(1)
+		}
+		conn, err := sender.Send()
+		if err != nil {
+			logrus.Error(err)
+			cli.Exit(1)
+		}
+		defer conn.Close()
+		dec := gob.NewDecoder(conn)
+		enc := json.NewEncoder(os.Stdout)
+		for {
+			var e types.Event
+			err := dec.Decode(&e)
+			if err != nil {
+				logrus.Error("event stream closed: ", err)
+				cli.Exit(1)
+			}
+			rec := newEventRecord(e)
+			if *outputOpt == OUTPUT_JSON {
+				enc.Encode(rec)
+				continue
+			}
+			line := fmt.Sprintf("%s %-11s %s %s %s", e.Time.Format("15:04:05.000"), rec.Type, rec.PairId, rec.Application, rec.TargetId)
+			if rec.Transport != "" {
+				line += " via " + rec.Transport
+			}
+			if rec.ParentPairId != "" {
+				line += " parent " + rec.ParentPairId
+			}
+			if rec.Detail != "" && rec.Type != types.EVENT_TRANSPORT {
+				line += ": " + rec.Detail
+			}
+			fmt.Println(line)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	cli "github.com/jawher/mow.cli"
+	"github.com/jedib0t/go-pretty/v6/table"
+	"github.com/sirupsen/logrus"
+	"github.com/suutaku/sshx/pkg/conf"
+)
+
+func cmdAddHost(cmd *cli.Cmd) {
+	cmd.Spec = "[ -u=<user> ] [ -i=<identity> ] [ -t=<transport> ] [ --tag=<tag>... ] NAME ID"
+	userOpt := cmd.StringOpt("u user", "", "ssh user when the address has none")
+	identOpt := cmd.StringOpt("i identity", "", "private key for ssh")
+	transportOpt := cmd.StringOpt("t transport", "", "direct or webrtc, both are tried by default")
+	tagsOpt := cmd.StringsOpt("tag", nil, "tag of the host, may be repeated")
+	nameArg := cmd.StringArg("NAME", "", "name used in place of the node id")
+	idArg := cmd.StringArg("ID", "", "node id of the peer, its address for the direct transport")
+	cmd.Action = func() {
+		cm := confManager()
+		_, exists := cm.Current().Hosts[strings.ToLower(*nameArg)]
+		err := cm.AddHost(*nameArg, conf.HostConf{
+			ID:        *idArg,
+			User:      *userOpt,
+			Identity:  *identOpt,
+			Transport: *transportOpt,
+			Tags:      *tagsOpt,
+		})
+		if err != nil {
+			logrus.Error(err)
+			cli.Exit(1)
+		}
+		if exists {
+			logrus.Info("replaced ", *nameArg)
+			return
+		}
+		logrus.Info("added ", *nameArg)
+	}
+}
+
+func cmdRemoveHost(cmd *cli.Cmd) {
+	cmd.Spec = "NAME..."
+	namesArg := cmd.StringsArg("NAME", nil, "names to remove")
+	cmd.Action = func() {
+		cm := confManager()
+		for _, v := range *namesArg {
+			err := cm.RemoveHost(v)
+			if err != nil {
+				logrus.Error(err)
+				cli.Exit(1)
+			}
+		}
+	}
+}
+
+func cmdListHosts(cmd *cli.Cmd) {
+	cmd.Spec = "[ -q | -o=<format> ] [ --tag=<tag> ]"
+	quietOpt := cmd.BoolOpt("q quiet", false, "print names only, for shell completion")
+	outputOpt := cmd.StringOpt("o output", OUTPUT_TABLE, outputHelp)
+	tagOpt := cmd.StringOpt("tag", "", "list hosts with this tag only")
+	cmd.Action = func() {
+		if err := checkOutput(*outputOpt); err != nil {
+			logrus.Error(err)
+			cli.Exit(1)
+		}
+		hosts := confManager().Current().Hosts
+		names := make([]string, 0, len(hosts))
+		for k, v := range hosts {
+			if *tagOpt == "" || v.HasTag(*tagOpt) {
+				names = append(names, k)
+			}
+		}
+		sort.Strings(names)
+		if *quietOpt {
+			for _, v := range names {
+				fmt.Println(v)
+			}
+			return
+		}
+		if *outputOpt != OUTPUT_TABLE {
+			records := make([]hostRecord, 0, len(names))
+			for _, v := range names {
+				records = append(records, newHostRecord(v, hosts[v]))
+			}
+			if err := writeRecords(*outputOpt, records); err != nil {
+				logrus.Error(err)
+				cli.Exit(1)
+			}
+			return
+		}
+		t := table.NewWriter()
+		t.SetOutputMirror(os.Stdout)
+		t.AppendHeader(table.Row{"#", "Name", "ID", "User", "Identity", "Transport", "Tags"})
+		t.AppendSeparator()
+		for i, v := range names {
+			h := hosts[v]
+			t.AppendRows([]table.Row{
+				{i + 1, v, h.ID, h.User, h.Identity, h.Transport, strings.Join(h.Tags, ",")},
+			})
+		}
+		t.AppendSeparator()
+		t.Render()
+	}
+}
+
+func cmdHosts(cmd *cli.Cmd) {
+	cmd.Command("add", "add or replace a host of the address book", cmdAddHost)
+	cmd.Command("rm", "remove hosts from the address book", cmdRemoveHost)
+	cmd.Command("ls", "list the address book", cmdListHosts)
+}
@@ -8,8 +8,6 @@ import (
 	"github.com/suutaku/sshx/internal/utils"
 )
 
-var defaultHomePath = "/etc/sshx"
-
 func main() {
 	if utils.DebugOn() {
 		logrus.SetLevel(logrus.DebugLevel)
@@ -17,6 +15,23 @@ func main() {
 		logrus.SetLevel(logrus.InfoLevel)
 	}
 	app := cli.App("sshx", "a webrtc based ssh remote toolbox")
+	profile := app.String(cli.StringOpt{
+		Name:   "profile",
+		Desc:   "signaling network of the command, see profiles in the configure",
+		EnvVar: "SSHX_PROFILE",
+	})
+	app.Before = func() {
+		if *profile == "" {
+			return
+		}
+		_, err := confManager().Current().Profile(*profile)
+		if err != nil {
+			logrus.Error(err)
+			cli.Exit(1)
+		}
+		// senders read the profile from the environment
+		os.Setenv("SSHX_PROFILE", *profile)
+	}
 	app.Command("daemon", "launch a sshx daemon", cmdDaemon)
 	app.Command("conf", "list configure informations", cmdConfig)
 	app.Command("conn", "connect to remote host", cmdConnect)
@@ -27,6 +42,10 @@ func main() {
 	app.Command("fs", "sshfs filesystem", cmdSSHFS)
 	app.Command("msg", "a message console", cmdMessage)
 	app.Command("trans", "transfer a file", cmdTransfer)
+	app.Command("events", "stream connection lifecycle events of the daemon", cmdEvents)
+	app.Command("peers", "list peers of our group on the signaling server", cmdPeers)
+	app.Command("hosts", "manage the address book of named peers", cmdHosts)
+	app.Command("tunnels", "manage port forwards kept up by the daemon", cmdTunnels)
 	app.Run(os.Args)
 
 }
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/suutaku/sshx/pkg/conf"
+	"github.com/suutaku/sshx/pkg/impl"
+	"github.com/suutaku/sshx/pkg/types"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	OUTPUT_TABLE = "table"
+	OUTPUT_JSON  = "json"
+	OUTPUT_YAML  = "yaml"
+	OUTPUT_CSV   = "csv"
+)
+
+const outputHelp = "output format: table, json, yaml or csv"
+
+func checkOutput(format string) error {
+	switch format {
+	case OUTPUT_TABLE, OUTPUT_JSON, OUTPUT_YAML, OUTPUT_CSV:
+		return nil
+	}
+	return fmt.Errorf("unknown output format %q, want table, json, yaml or csv", format)
+}
+
+// field names of the records below are part of the cli interface,
+// rename nothing and only append new fields
+
+type statRecord struct {
+	PairId          string `json:"pair_id" yaml:"pair_id"`
+	ParentPairId    string `json:"parent_pair_id" yaml:"parent_pair_id"`
+	TargetId        string `json:"target_id" yaml:"target_id"`
+	Application     string `json:"application" yaml:"application"`
+	Transport       string `json:"transport" yaml:"transport"`
+	StartTime       string `json:"start_time" yaml:"start_time"`
+	BytesIn         int64  `json:"bytes_in" yaml:"bytes_in"`
+	BytesOut        int64  `json:"bytes_out" yaml:"bytes_out"`
+	MessagesIn      int64  `json:"messages_in" yaml:"messages_in"`
+	MessagesOut     int64  `json:"messages_out" yaml:"messages_out"`
+	Errors          int64  `json:"errors" yaml:"errors"`
+	LocalCandidate  string `json:"local_candidate" yaml:"local_candidate"`
+	RemoteCandidate string `json:"remote_candidate" yaml:"remote_candidate"`
+	// 0 if unknown
+	RTTMs float64 `json:"rtt_ms" yaml:"rtt_ms"`
+}
+
+type peerRecord struct {
+	ID           string   `json:"id" yaml:"id"`
+	Online       bool     `json:"online" yaml:"online"`
+	Version      string   `json:"version" yaml:"version"`
+	Applications []string `json:"applications" yaml:"applications"`
+	LastSeen     string   `json:"last_seen" yaml:"last_seen"`
+}
+
+type eventRecord struct {
+	Time         string `json:"time" yaml:"time"`
+	Type         string `json:"type" yaml:"type"`
+	PairId       string `json:"pair_id" yaml:"pair_id"`
+	ParentPairId string `json:"parent_pair_id" yaml:"parent_pair_id"`
+	TargetId     string `json:"target_id" yaml:"target_id"`
+	Application  string `json:"application" yaml:"application"`
+	Transport    string `json:"transport" yaml:"transport"`
+	Detail       string `json:"detail" yaml:"detail"`
+}
+
+type hostRecord struct {
+	Name      string   `json:"name" yaml:"name"`
+	ID        string   `json:"id" yaml:"id"`
+	User      string   `json:"user" yaml:"user"`
+	Identity  string   `json:"identity" yaml:"identity"`
+	Transport string   `json:"transport" yaml:"transport"`
+	Tags      []string `json:"tags" yaml:"tags"`
+}
+
+type tunnelRecord struct {
+	Name       string `json:"name" yaml:"name"`
+	LocalPort  int32  `json:"local_port" yaml:"local_port"`
+	Host       string `json:"host" yaml:"host"`
+	RemotePort int32  `json:"remote_port" yaml:"remote_port"`
+	Profile    string `json:"profile" yaml:"profile"`
+	State      string `json:"state" yaml:"state"`
+	Active     int64  `json:"active" yaml:"active"`
+	Total      int64  `json:"total" yaml:"total"`
+	Restarts   int64  `json:"restarts" yaml:"restarts"`
+	Error      string `json:"error" yaml:"error"`
+}
+
+type confRecord struct {
+	Key   string      `json:"key" yaml:"key"`
+	Value interface{} `json:"value" yaml:"value"`
+}
+
+func appLabel(code int32) string {
+	return strings.ToLower(strings.TrimPrefix(impl.GetImplName(code), "*"))
+}
+
+func newStatRecord(v types.Status) statRecord {
+	return statRecord{
+		PairId:          v.PairId,
+		ParentPairId:    v.ParentPairId,
+		TargetId:        v.TargetId,
+		Application:     appLabel(v.ImplType),
+		Transport:       v.Transport,
+		StartTime:       v.StartTime.UTC().Format(time.RFC3339),
+		BytesIn:         v.BytesIn,
+		BytesOut:        v.BytesOut,
+		MessagesIn:      v.MessagesIn,
+		MessagesOut:     v.MessagesOut,
+		Errors:          v.Errors,
+		LocalCandidate:  v.LocalCandidate,
+		RemoteCandidate: v.RemoteCandidate,
+		RTTMs:           float64(v.RTT) / float64(time.Millisecond),
+	}
+}
+
+func newEventRecord(e types.Event) eventRecord {
+	return eventRecord{
+		Time:         e.Time.UTC().Format(time.RFC3339Nano),
+		Type:         e.Type,
+		PairId:       e.PairId,
+		ParentPairId: e.ParentPairId,
+		TargetId:     e.TargetId,
+		Application:  appLabel(e.ImplType),
+		Transport:    e.Transport,
+		Detail:       e.Detail,
+	}
+}
+
+func newPeerRecord(v types.PeerInfo) peerRecord {
+	apps := v.Apps
+	if apps == nil {
+		apps = []string{}
+	}
+	return peerRecord{
+		ID:           v.ID,
+		Online:       v.Online,
+		Version:      v.Version,
+		Applications: apps,
+		LastSeen:     v.LastSeen.UTC().Format(time.RFC3339),
+	}
+}
+
+func newHostRecord(name string, h conf.HostConf) hostRecord {
+	tags := h.Tags
+	if tags == nil {
+		tags = []string{}
+	}
+	return hostRecord{
+		Name:      name,
+		ID:        h.ID,
+		User:      h.User,
+		Identity:  h.Identity,
+		Transport: h.Transport,
+		Tags:      tags,
+	}
+}
+
+func newTunnelRecord(v types.TunnelStatus) tunnelRecord {
+	return tunnelRecord{
+		Name:       v.Name,
+		LocalPort:  v.LocalPort,
+		Host:       v.Host,
+		RemotePort: v.RemotePort,
+		Profile:    v.Profile,
+		State:      tunnelState(v),
+		Active:     v.Active,
+		Total:      v.Total,
+		Restarts:   v.Restarts,
+		Error:      v.Error,
+	}
+}
+
+// writeRecords prints a slice of records in a machine readable format
+func writeRecords(format string, records interface{}) error {
+	switch format {
+	case OUTPUT_JSON:
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(records)
+	case OUTPUT_YAML:
+		out, err := yaml.Marshal(records)
+		if err != nil {
+			return err
+		}
+		_, err = os.Stdout.Write(out)
+		return err
+	case OUTPUT_CSV:
+		return writeCSV(records)
+	}
+	return checkOutput(format)
+}
+
+// writeCSV writes one row per element of a slice of structs, the header
+// comes from the json tags
+func writeCSV(records interface{}) error {
+	rv := reflect.ValueOf(records)
+	if rv.Kind() != reflect.Slice {
+		return fmt.Errorf("cannot write %T as csv", records)
+	}
+	rt := rv.Type().Elem()
+	w := csv.NewWriter(os.Stdout)
+	header := make([]string, rt.NumField())
+	for i := range header {
+		header[i] = strings.Split(rt.Field(i).Tag.Get("json"), ",")[0]
+	}
+	if err := w.Write(header); err != nil {
+		return err
+	}
+	for i := 0; i < rv.Len(); i++ {
+		row := make([]string, rt.NumField())
+		for j := range row {
+			row[j] = csvValue(rv.Index(i).Field(j).Interface())
+		}
+		if err := w.Write(row); err != nil {
+			return err
+		}
+	}
+	w.Flush()
+	return w.Error()
+}
+
+func csvValue(v interface{}) string {
+	switch val := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return val
+	case []string:
+		return strings.Join(val, ";")
+	case float64:
+		return strconv.FormatFloat(val, 'f', -1, 64)
+	case []interface{}:
+		items := make([]string, len(val))
+		for i := range val {
+			items[i] = csvValue(val[i])
+		}
+		return strings.Join(items, ";")
+	case map[string]interface{}, map[interface{}]interface{}:
+		out, _ := json.Marshal(val)
+		return string(out)
+	}
+	return fmt.Sprint(v)
+}
+
+// sortedKeys lists settings keys in a stable order
+func sortedKeys(keys []string) []string {
+	ret := append([]string{}, keys...)
+	sort.Strings(ret)
+	return ret
+}
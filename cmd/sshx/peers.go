@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/gob"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	cli "github.com/jawher/mow.cli"
+	"github.com/jedib0t/go-pretty/v6/table"
+	"github.com/sirupsen/logrus"
+	"github.com/suutaku/sshx/pkg/conf"
+	"github.com/suutaku/sshx/pkg/types"
+)
+
+// fetchPeers asks the signaling server of c for the peers of its group
+func fetchPeers(c conf.Configure) ([]types.PeerInfo, error) {
+	if c.Presence.Group == "" {
+		return nil, fmt.Errorf("no group configured, set presence.group and presence.token")
+	}
+	req, err := http.NewRequest(http.MethodGet, c.SignalingServerAddr+"/peers", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.SetBasicAuth(c.Presence.Group, c.Presence.Token)
+	client := http.Client{Timeout: 10 * time.Second}
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("signaling server responded %s", res.Status)
+	}
+	var peers []types.PeerInfo
+	err = gob.NewDecoder(res.Body).Decode(&peers)
+	return peers, err
+}
+
+func cmdPeers(cmd *cli.Cmd) {
+	cmd.Spec = "[ -a ] [ -o=<format> ]"
+	allOpt := cmd.BoolOpt("a all", false, "list offline peers too")
+	outputOpt := cmd.StringOpt("o output", OUTPUT_TABLE, outputHelp)
+	cmd.Action = func() {
+		if err := checkOutput(*outputOpt); err != nil {
+			logrus.Error(err)
+			cli.Exit(1)
+		}
+		cm := confManager()
+		c, err := cm.Current().Profile(conf.ActiveProfile())
+		if err != nil {
+			logrus.Error(err)
+			cli.Exit(1)
+		}
+		peers, err := fetchPeers(c)
+		if err != nil {
+			logrus.Error(err)
+			cli.Exit(1)
+		}
+		if *outputOpt != OUTPUT_TABLE {
+			records := make([]peerRecord, 0, len(peers))
+			for _, v := range peers {
+				if v.Online || *allOpt {
+					records = append(records, newPeerRecord(v))
+				}
+			}
+			if err := writeRecords(*outputOpt, records); err != nil {
+				logrus.Error(err)
+				cli.Exit(1)
+			}
+			return
+		}
+		t := table.NewWriter()
+		t.SetOutputMirror(os.Stdout)
+		t.AppendHeader(table.Row{"#", "ID", "Status", "Version", "Applications", "Last Seen"})
+		t.AppendSeparator()
+		count := 0
+		for _, v := range peers {
+			if !v.Online && !*allOpt {
+				continue
+			}
+			status := "offline"
+			if v.Online {
+				status = "online"
+			}
+			if v.ID == c.ID {
+				status += " (self)"
+			}
+			count++
+			t.AppendRows([]table.Row{
+				{count, v.ID, status, v.Version, strings.Join(v.Apps, ","), v.LastSeen.Format("2 Jan 2006 15:04:05")},
+			})
+		}
+		t.AppendSeparator()
+		t.Render()
+	}
+}
@@ -2,9 +2,14 @@ package main
 
 import (
 	"fmt"
+	"strconv"
+	"strings"
+	"time"
 
 	cli "github.com/jawher/mow.cli"
 	"github.com/sirupsen/logrus"
+	"github.com/suutaku/sshx/internal/qos"
+	"github.com/suutaku/sshx/pkg/conf"
 	"github.com/suutaku/sshx/pkg/impl"
 	"github.com/suutaku/sshx/pkg/types"
 )
@@ -21,39 +26,167 @@ func cmdStopProxy(cmd *cli.Cmd) {
 	}
 }
 
+// runProxy registers proxy with the daemon, so stat lists it and proxy
+// stop closes it with its children, and serves it until it ends
+func runProxy(proxy *impl.Proxy) {
+	proxy.Preper()
+	proxy.NoNeedConnect()
+
+	sender := impl.NewSender(proxy, types.OPTION_TYPE_UP)
+	_, err := sender.SendDetach()
+	if err != nil {
+		logrus.Error(err)
+	} else {
+		proxy.SetPairId(string(sender.PairId))
+	}
+	err = proxy.Start()
+	if err != nil {
+		logrus.Error(err)
+	}
+	proxy.Close()
+	if proxy.PairId() == "" {
+		return
+	}
+	// drop the registration unless proxy stop did already
+	down := impl.NewSender(proxy, types.OPTION_TYPE_DOWN)
+	down.PairId = []byte(proxy.PairId())
+	down.SendDetach()
+}
+
 func cmdStartProxy(cmd *cli.Cmd) {
 	// cmd.Spec = "-P [-d] ADDR"
-	cmd.Spec = "-P -R ADDR"
-	proxyPort := cmd.IntOpt("P", 0, "local proxy port")
-	remotePort := cmd.IntOpt("R", 0, "remote proxy port")
+	cmd.Spec = "-P -R [-l] [ -u [ --idle ] ] ADDR"
+	local := cmd.StringOpt("P", "", "local port, or unix:/path to listen on a unix socket")
+	remote := cmd.StringOpt("R", "", "port on the loopback of the peer, or host:port or unix:/path it dials if allowed by its acl.destinations")
+	limit := cmd.StringOpt("l limit", "", "rate limit in bytes per second, like 5M")
+	udp := cmd.BoolOpt("u udp", false, "forward udp datagrams instead of tcp")
+	idle := cmd.IntOpt("idle", 60, "seconds after which a udp client without traffic is forgotten")
 	// detach := cmd.BoolOpt("d", false, "detach process")
 	addr := cmd.StringArg("ADDR", "", "remote target address [username]@[host]:[port]")
 	cmd.Action = func() {
-		if proxyPort == nil || *proxyPort == 0 {
-			fmt.Println("please set a proxy port")
+		proxyPort, socket, err := parseListen(*local)
+		if err != nil {
+			logrus.Error(err)
+			cli.Exit(1)
+		}
+		remotePort, remoteAddr, err := parseTarget(*remote)
+		if err != nil {
+			logrus.Error(err)
+			cli.Exit(1)
 		}
-		if addr == nil || *addr == "" {
-			fmt.Println("please set a remote device")
+		if *udp && (socket != "" || remoteAddr != "") {
+			logrus.Error("udp proxies forward a local port to a port of the peer")
+			cli.Exit(1)
 		}
+		rate, err := qos.ParseRate(*limit)
+		if err != nil {
+			logrus.Error(err)
+			return
+		}
+		proxy := impl.NewProxy(proxyPort, remotePort, *addr)
+		proxy.ListenSocket = socket
+		proxy.RemoteAddr = remoteAddr
+		proxy.SetLimit(rate)
+		proxy.UDP = *udp
+		proxy.Idle = time.Duration(*idle) * time.Second
+		runProxy(proxy)
+	}
+}
 
-		proxy := impl.NewProxy(int32(*proxyPort), int32(*remotePort), *addr)
-		proxy.Preper()
-		proxy.NoNeedConnect()
+func cmdSocksProxy(cmd *cli.Cmd) {
+	cmd.Spec = "[-P] [-l] ADDR"
+	local := cmd.StringOpt("P", "1080", "local socks5 and http CONNECT port, or unix:/path")
+	limit := cmd.StringOpt("l limit", "", "rate limit in bytes per second, like 5M")
+	addr := cmd.StringArg("ADDR", "", "peer which dials the requested hosts, it needs us in its acl.forward")
+	cmd.Action = func() {
+		proxyPort, socket, err := parseListen(*local)
+		if err != nil {
+			logrus.Error(err)
+			cli.Exit(1)
+		}
+		rate, err := qos.ParseRate(*limit)
+		if err != nil {
+			logrus.Error(err)
+			return
+		}
+		proxy := impl.NewProxy(proxyPort, 0, *addr)
+		proxy.ListenSocket = socket
+		proxy.SetLimit(rate)
+		proxy.Socks = true
+		runProxy(proxy)
+	}
+}
 
-		sender := impl.NewSender(proxy, types.OPTION_TYPE_UP)
-		_, err := sender.SendDetach()
+func cmdReverseProxy(cmd *cli.Cmd) {
+	cmd.Spec = "-R [-l] ADDR"
+	ports := cmd.StringOpt("R", "", "REMOTE:LOCAL, the peer listens on REMOTE and forwards to our LOCAL port")
+	limit := cmd.StringOpt("l limit", "", "rate limit in bytes per second, like 5M")
+	addr := cmd.StringArg("ADDR", "", "peer which listens, it needs us in its acl.listen")
+	cmd.Action = func() {
+		remotePort, localPort, err := parsePortPair(*ports)
 		if err != nil {
 			logrus.Error(err)
+			cli.Exit(1)
 		}
-		err = proxy.Start()
+		rate, err := qos.ParseRate(*limit)
 		if err != nil {
 			logrus.Error(err)
+			return
+		}
+		proxy := impl.NewProxy(localPort, remotePort, *addr)
+		proxy.SetLimit(rate)
+		proxy.Reverse = true
+		runProxy(proxy)
+	}
+}
+
+// parseListen takes a port or unix:/path
+func parseListen(s string) (int32, string, error) {
+	if strings.HasPrefix(s, "unix:") {
+		network, addr, err := conf.ParseDestination(s)
+		if err != nil || network != "unix" {
+			return 0, "", fmt.Errorf("cannot listen on %q: %v", s, err)
+		}
+		return 0, addr, nil
+	}
+	port, err := strconv.ParseUint(s, 10, 16)
+	if err != nil || port == 0 {
+		return 0, "", fmt.Errorf("%q is not a port or unix:/path", s)
+	}
+	return int32(port), "", nil
+}
+
+// parseTarget takes a port of the peer, host:port or unix:/path
+func parseTarget(s string) (int32, string, error) {
+	if port, err := strconv.ParseUint(s, 10, 16); err == nil && port != 0 {
+		return int32(port), "", nil
+	}
+	if _, _, err := conf.ParseDestination(s); err != nil {
+		return 0, "", fmt.Errorf("%v, want a port, host:port or unix:/path", err)
+	}
+	return 0, s, nil
+}
+
+// parsePortPair splits REMOTE:LOCAL, a single port is used for both
+func parsePortPair(s string) (int32, int32, error) {
+	sps := strings.SplitN(s, ":", 2)
+	if len(sps) == 1 {
+		sps = append(sps, sps[0])
+	}
+	ret := make([]int32, 2)
+	for i, v := range sps {
+		port, err := strconv.ParseUint(v, 10, 16)
+		if err != nil || port == 0 {
+			return 0, 0, fmt.Errorf("bad port %q in %q, want REMOTE:LOCAL like 8080:3000", v, s)
 		}
-		proxy.Close()
+		ret[i] = int32(port)
 	}
+	return ret[0], ret[1], nil
 }
 
 func cmdProxy(cmd *cli.Cmd) {
 	cmd.Command("start", "start proxy service", cmdStartProxy)
+	cmd.Command("socks", "serve socks5 and http CONNECT through a peer", cmdSocksProxy)
+	cmd.Command("reverse", "expose a local port on a peer", cmdReverseProxy)
 	cmd.Command("stop", "stop proxy service", cmdStopProxy)
 }
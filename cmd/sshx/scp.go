@@ -3,15 +3,17 @@ package main
 import (
 	cli "github.com/jawher/mow.cli"
 	"github.com/sirupsen/logrus"
+	"github.com/suutaku/sshx/internal/qos"
 	"github.com/suutaku/sshx/pkg/impl"
 	"github.com/suutaku/sshx/pkg/types"
 )
 
 func cmdCopy(cmd *cli.Cmd) {
-	cmd.Spec = "[ -i ] SRC DEST"
+	cmd.Spec = "[ -i ] [ -l ] SRC DEST"
 	srcPath := cmd.StringArg("SRC", "", "[username]@[host]:/path")
 	destPath := cmd.StringArg("DEST", "", "[username]@[host]:/path")
 	ident := cmd.StringOpt("i identification", "", "a private path, default empty for ~/.ssh/id_rsa")
+	limit := cmd.StringOpt("l limit", "", "rate limit in bytes per second, like 5M")
 	cmd.Action = func() {
 		if srcPath == nil || *destPath == "" {
 			return
@@ -19,8 +21,17 @@ func cmdCopy(cmd *cli.Cmd) {
 		if destPath == nil || *destPath == "" {
 			return
 		}
+		rate, err := qos.ParseRate(*limit)
+		if err != nil {
+			logrus.Error(err)
+			return
+		}
 		imp := impl.NewSCP(*srcPath, *destPath, *ident)
-		err := imp.Preper()
+		if imp == nil {
+			return
+		}
+		imp.SetLimit(rate)
+		err = imp.Preper()
 		if err != nil {
 			logrus.Error(err)
 			return
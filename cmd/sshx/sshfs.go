@@ -5,6 +5,7 @@ import (
 
 	cli "github.com/jawher/mow.cli"
 	"github.com/sirupsen/logrus"
+	"github.com/suutaku/sshx/internal/qos"
 	"github.com/suutaku/sshx/pkg/impl"
 	"github.com/suutaku/sshx/pkg/types"
 )
@@ -38,17 +39,24 @@ func splitMountPoint(mtopt string) (root, mt string) {
 }
 
 func cmdMount(cmd *cli.Cmd) {
-	cmd.Spec = "[-i] HOST MOUNTOPTION"
+	cmd.Spec = "[-i] [-l] HOST MOUNTOPTION"
 	host := cmd.StringArg("HOST", "", "moumt root path")
 	mtpOpt := cmd.StringArg("MOUNTOPTION", "", "moumt option with [root]:[mount point]")
 	ident := cmd.StringOpt("i identification", "", "a private path, default empty for ~/.ssh/id_rsa")
+	limit := cmd.StringOpt("l limit", "", "rate limit in bytes per second, like 5M")
 	cmd.Action = func() {
 		if host == nil || *(host) == "" {
 			return
 		}
+		rate, err := qos.ParseRate(*limit)
+		if err != nil {
+			logrus.Error(err)
+			return
+		}
 		root, mtp := splitMountPoint(*mtpOpt)
 		imp := impl.NewSSHFS(mtp, root, *host, *ident)
-		err := imp.Preper()
+		imp.SetLimit(rate)
+		err = imp.Preper()
 		if err != nil {
 			logrus.Error(err)
 			return
@@ -1,6 +1,11 @@
 package main
 
 import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
 	"github.com/suutaku/sshx/pkg/types"
 
 	cli "github.com/jawher/mow.cli"
@@ -8,34 +13,171 @@ import (
 	"github.com/suutaku/sshx/pkg/impl"
 )
 
+// queryRemoteStatus reads the pairs a peer is serving for us
+func queryRemoteStatus(remote string) ([]types.Status, error) {
+	imp := impl.NewRemoteStat(remote)
+	sender := impl.NewSender(imp, types.OPTION_TYPE_UP)
+	if sender == nil {
+		return nil, fmt.Errorf("cannot create sender")
+	}
+	conn, err := sender.Send()
+	if err != nil {
+		return nil, err
+	}
+	imp.SetConn(conn)
+	defer imp.Close()
+	return imp.GetStatus()
+}
+
+// queryStatus reads the pairs of the local daemon, or of remote, and the
+// problems of the local connection services
+func queryStatus(remote string) ([]types.Status, map[string]string, error) {
+	if remote != "" {
+		status, err := queryRemoteStatus(remote)
+		return status, nil, err
+	}
+	imp := impl.NewSTAT()
+	err := imp.Preper()
+	if err != nil {
+		return nil, nil, err
+	}
+	sender := impl.NewSender(imp, types.OPTION_TYPE_STAT)
+	if sender == nil {
+		return nil, nil, fmt.Errorf("cannot create sender")
+	}
+	conn, err := sender.Send()
+	if err != nil {
+		return nil, nil, err
+	}
+	imp.SetConn(conn)
+	defer imp.Close()
+	logrus.Debug("impl responsed")
+	status, err := imp.GetStatus()
+	return status, imp.Health(), err
+}
+
+// warnHealth reports connection services which do not work, below the
+// pairs
+func warnHealth(health map[string]string) {
+	names := make([]string, 0, len(health))
+	for k := range health {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		logrus.Warn(name, ": ", health[name])
+	}
+}
+
+// statFilter keeps pairs matching all given conditions
+type statFilter struct {
+	app    int32
+	hasApp bool
+	peer   string
+	parent string
+}
+
+func newStatFilter(app, peer, parent string) (statFilter, error) {
+	f := statFilter{peer: peer, parent: parent}
+	if app != "" {
+		code, ok := impl.GetImplCode(app)
+		if !ok {
+			return f, fmt.Errorf("unknown application %q, want one of %s", app, strings.ToLower(strings.Join(impl.RegisteredApps(), ", ")))
+		}
+		f.app, f.hasApp = code, true
+	}
+	return f, nil
+}
+
+func (f statFilter) apply(status []types.Status) []types.Status {
+	ret := make([]types.Status, 0, len(status))
+	for _, v := range status {
+		if f.hasApp && v.ImplType != f.app {
+			continue
+		}
+		if f.peer != "" && v.TargetId != f.peer {
+			continue
+		}
+		if f.parent != "" && v.ParentPairId != f.parent {
+			continue
+		}
+		ret = append(ret, v)
+	}
+	return ret
+}
+
+// watchStatus refreshes a table of pairs and their throughput
+func watchStatus(interval time.Duration, remote string, filter statFilter) {
+	var prev []types.Status
+	var last time.Time
+	for {
+		status, health, err := queryStatus(remote)
+		if err != nil {
+			logrus.Error(err)
+			return
+		}
+		status = filter.apply(status)
+		now := time.Now()
+		// clear screen and move the cursor home
+		fmt.Print("\033[H\033[2J")
+		fmt.Printf("%s, refresh every %s\n", now.Format("15:04:05"), interval)
+		impl.ShowRates(status, prev, now.Sub(last))
+		warnHealth(health)
+		prev, last = status, now
+		time.Sleep(interval)
+	}
+}
+
 func cmdStatus(cmd *cli.Cmd) {
-	cmd.Spec = "[ -t ]"
+	cmd.Spec = "[ -t | -o=<format> | -w [ -i ] ] [ --app=<name> ] [ --peer=<id> ] [ --parent=<pair> ] [ --remote=<peer> ]"
 	treeOpt := cmd.BoolOpt("t", false, "display in tree view")
+	watchOpt := cmd.BoolOpt("w watch", false, "refresh traffic of pairs like top")
+	intervalOpt := cmd.IntOpt("i interval", 2, "refresh interval in seconds")
+	outputOpt := cmd.StringOpt("o output", OUTPUT_TABLE, outputHelp)
+	appOpt := cmd.StringOpt("app", "", "only pairs of this application, like ssh or proxy")
+	peerOpt := cmd.StringOpt("peer", "", "only pairs with this target id")
+	parentOpt := cmd.StringOpt("parent", "", "only children of this pair")
+	remoteOpt := cmd.StringOpt("remote", "", "pairs a peer (id or address book name) is serving, only those with us unless we are admin in its acl")
 	cmd.Action = func() {
-		imp := impl.NewSTAT()
-		err := imp.Preper()
+		if err := checkOutput(*outputOpt); err != nil {
+			logrus.Error(err)
+			cli.Exit(1)
+		}
+		filter, err := newStatFilter(*appOpt, *peerOpt, *parentOpt)
 		if err != nil {
 			logrus.Error(err)
-			return
+			cli.Exit(1)
 		}
-
-		sender := impl.NewSender(imp, types.OPTION_TYPE_STAT)
-		if sender == nil {
-			logrus.Error("cannot create sender")
+		if *watchOpt {
+			if *intervalOpt < 1 {
+				*intervalOpt = 1
+			}
+			watchStatus(time.Duration(*intervalOpt)*time.Second, *remoteOpt, filter)
 			return
 		}
-		conn, err := sender.Send()
+		status, health, err := queryStatus(*remoteOpt)
 		if err != nil {
 			logrus.Error(err)
+			cli.Exit(1)
+		}
+		status = filter.apply(status)
+		if *outputOpt != OUTPUT_TABLE {
+			records := make([]statRecord, 0, len(status))
+			for _, v := range status {
+				records = append(records, newStatRecord(v))
+			}
+			if err := writeRecords(*outputOpt, records); err != nil {
+				logrus.Error(err)
+				cli.Exit(1)
+			}
+			warnHealth(health)
 			return
 		}
-		imp.SetConn(conn)
-		logrus.Debug("impl responsed")
 		displayStyle := impl.DISPLAY_TABLE
 		if *treeOpt {
 			displayStyle = impl.DISPLAY_TREE
 		}
-		imp.ShowStatus(displayStyle)
-		imp.Close()
+		impl.NewSTAT().Display(status, displayStyle)
+		warnHealth(health)
 	}
 }
@@ -1,27 +1,39 @@
 package main
 
 import (
+	"encoding/gob"
+
 	cli "github.com/jawher/mow.cli"
 	"github.com/sirupsen/logrus"
+	"github.com/suutaku/sshx/internal/qos"
 	"github.com/suutaku/sshx/pkg/impl"
 	"github.com/suutaku/sshx/pkg/types"
 )
 
 func cmdUpload(cmd *cli.Cmd) {
-	cmd.Spec = "[-t] [-f] [-q]"
+	cmd.Spec = "[-t] [-f...] [-q] [-r] [-l]"
 	hostId := cmd.StringOpt("t target", "", "target device id")
-	filePath := cmd.StringOpt("f file", "", "path of file to upload")
+	filePaths := cmd.StringsOpt("f file", nil, "path of file or directory to upload, can be repeated")
 	showQR := cmd.BoolOpt("q qrcode", false, "show QR code (upload from or download to mobile device)")
+	resume := cmd.BoolOpt("r resume", false, "resume an interrupted transfer of the same file")
+	limit := cmd.StringOpt("l limit", "", "rate limit in bytes per second, like 5M")
 	cmd.Action = func() {
 
 		if hostId == nil || *hostId == "" {
 			*hostId = "127.0.0.1"
 		}
 
-		imp := impl.NewTransferService(*hostId, *filePath, true, *showQR)
+		imp := impl.NewTransferService(*hostId, *filePaths, true, *showQR)
+		rate, err := qos.ParseRate(*limit)
+		if err != nil {
+			logrus.Error(err)
+			return
+		}
+		imp.Resume = *resume
+		imp.SetLimit(rate)
 		imp.Init()
 		imp.NoNeedConnect()
-		err := imp.Preper()
+		err = imp.Preper()
 		if err != nil {
 			logrus.Error(err)
 			return
@@ -43,23 +55,32 @@ func cmdUpload(cmd *cli.Cmd) {
 
 }
 func cmdDownload(cmd *cli.Cmd) {
-	cmd.Spec = "[-t] [-f] [-q]"
+	cmd.Spec = "[-t] [-f...] [-q] [-r] [-l]"
 	hostId := cmd.StringOpt("t target", "", "target device id")
-	filePath := cmd.StringOpt("f file", "", "path of file to download")
+	filePaths := cmd.StringsOpt("f file", nil, "path of remote file or directory to download, can be repeated")
 	showQR := cmd.BoolOpt("q qrcode", false, "show QR code (upload from or download to mobile device)")
+	resume := cmd.BoolOpt("r resume", false, "resume an interrupted transfer of the same file")
+	limit := cmd.StringOpt("l limit", "", "rate limit in bytes per second, like 5M")
 	cmd.Action = func() {
 		if hostId == nil || *hostId == "" {
 			*hostId = "127.0.0.1"
 		}
 
-		imp := impl.NewTransferService(*hostId, *filePath, false, *showQR)
+		imp := impl.NewTransferService(*hostId, *filePaths, false, *showQR)
 		if imp == nil {
 			logrus.Error("Please input a remote file path when using download command")
 			return
 		}
+		rate, err := qos.ParseRate(*limit)
+		if err != nil {
+			logrus.Error(err)
+			return
+		}
+		imp.Resume = *resume
+		imp.SetLimit(rate)
 		imp.Init()
 		imp.NoNeedConnect()
-		err := imp.Preper()
+		err = imp.Preper()
 		if err != nil {
 			logrus.Error(err)
 			return
@@ -80,7 +101,39 @@ func cmdDownload(cmd *cli.Cmd) {
 	}
 }
 
+func decideTransfer(cmd *cli.Cmd, accept bool) {
+	cmd.Spec = "PID"
+	pairId := cmd.StringArg("PID", "", "pair id of the inbound transfer, shown in the notification")
+	cmd.Action = func() {
+		if pairId == nil || *pairId == "" {
+			return
+		}
+		sender := impl.NewSender(&impl.Transfer{}, types.OPTION_TYPE_ATTACH)
+		sender.PairId = []byte(*pairId)
+		conn, err := sender.Send()
+		if err != nil {
+			logrus.Error(err)
+			return
+		}
+		defer conn.Close()
+		err = gob.NewEncoder(conn).Encode(impl.TransferDecision{Accept: accept})
+		if err != nil {
+			logrus.Error(err)
+		}
+	}
+}
+
+func cmdAcceptTransfer(cmd *cli.Cmd) {
+	decideTransfer(cmd, true)
+}
+
+func cmdRejectTransfer(cmd *cli.Cmd) {
+	decideTransfer(cmd, false)
+}
+
 func cmdTransfer(cmd *cli.Cmd) {
-	cmd.Command("upload", "upload file to target device", cmdUpload)
-	cmd.Command("download", "download file from target device", cmdDownload)
+	cmd.Command("upload", "upload files or directories to target device", cmdUpload)
+	cmd.Command("download", "download files or directories from target device", cmdDownload)
+	cmd.Command("accept", "accept an inbound transfer waiting for decision", cmdAcceptTransfer)
+	cmd.Command("reject", "reject an inbound transfer waiting for decision", cmdRejectTransfer)
 }
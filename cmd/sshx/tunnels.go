@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/gob"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	cli "github.com/jawher/mow.cli"
+	"github.com/jedib0t/go-pretty/v6/table"
+	"github.com/sirupsen/logrus"
+	"github.com/suutaku/sshx/pkg/conf"
+	"github.com/suutaku/sshx/pkg/impl"
+	"github.com/suutaku/sshx/pkg/types"
+)
+
+// queryTunnels asks the daemon for the state of its tunnels
+func queryTunnels() ([]types.TunnelStatus, error) {
+	sender := impl.NewSender(impl.NewSTAT(), types.OPTION_TYPE_TUNNELS)
+	if sender == nil {
+		return nil, fmt.Errorf("cannot create sender")
+	}
+	conn, err := sender.Send()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	var msg string
+	err = gob.NewEncoder(conn).Encode(msg)
+	if err != nil {
+		return nil, err
+	}
+	var ret []types.TunnelStatus
+	err = gob.NewDecoder(conn).Decode(&ret)
+	return ret, err
+}
+
+// configuredTunnels is what ls shows without a daemon
+func configuredTunnels(c conf.Configure) []types.TunnelStatus {
+	ret := make([]types.TunnelStatus, 0, len(c.Tunnels))
+	for name, v := range c.Tunnels {
+		ret = append(ret, types.TunnelStatus{
+			Name:       name,
+			LocalPort:  v.LocalPort,
+			Host:       v.Host,
+			RemotePort: v.RemotePort,
+			Profile:    v.Profile,
+			Enabled:    !v.Disabled,
+		})
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Name < ret[j].Name
+	})
+	return ret
+}
+
+func tunnelState(v types.TunnelStatus) string {
+	switch {
+	case !v.Enabled:
+		return "disabled"
+	case v.Listening:
+		return "listening"
+	case v.Error != "":
+		return "retrying"
+	}
+	return "stopped"
+}
+
+func cmdListTunnels(cmd *cli.Cmd) {
+	cmd.Spec = "[ -o=<format> ]"
+	outputOpt := cmd.StringOpt("o output", OUTPUT_TABLE, outputHelp)
+	cmd.Action = func() {
+		if err := checkOutput(*outputOpt); err != nil {
+			logrus.Error(err)
+			cli.Exit(1)
+		}
+		tunnels, err := queryTunnels()
+		if err != nil {
+			logrus.Warn("daemon not reachable, showing the configure only: ", err)
+			tunnels = configuredTunnels(confManager().Current())
+		}
+		if *outputOpt != OUTPUT_TABLE {
+			records := make([]tunnelRecord, 0, len(tunnels))
+			for _, v := range tunnels {
+				records = append(records, newTunnelRecord(v))
+			}
+			if err := writeRecords(*outputOpt, records); err != nil {
+				logrus.Error(err)
+				cli.Exit(1)
+			}
+			return
+		}
+		t := table.NewWriter()
+		t.SetOutputMirror(os.Stdout)
+		t.AppendHeader(table.Row{"#", "Name", "Local", "Host", "Remote", "Profile", "State", "Conns", "Restarts", "Error"})
+		t.AppendSeparator()
+		for i, v := range tunnels {
+			t.AppendRows([]table.Row{
+				{i + 1, v.Name, v.LocalPort, v.Host, v.RemotePort, v.Profile, tunnelState(v), fmt.Sprintf("%d/%d", v.Active, v.Total), v.Restarts, v.Error},
+			})
+		}
+		t.AppendSeparator()
+		t.Render()
+	}
+}
+
+// applyTunnels tells a running daemon about the new configure, it also
+// picks the file up by itself
+func applyTunnels() {
+	err := reloadDaemon()
+	if err != nil {
+		logrus.Warn("saved, the daemon applies it when it starts: ", err)
+		return
+	}
+	logrus.Info("applied")
+}
+
+func cmdAddTunnel(cmd *cli.Cmd) {
+	cmd.Spec = "-L=<port> -R=<port> [ --profile=<name> ] [ --disabled ] NAME HOST"
+	localOpt := cmd.IntOpt("L local", 0, "local port, listening on 127.0.0.1")
+	remoteOpt := cmd.IntOpt("R remote", 0, "port on the peer")
+	profileOpt := cmd.StringOpt("profile", "", "profile to reach the peer, the default one if empty")
+	disabledOpt := cmd.BoolOpt("disabled", false, "add it without starting it")
+	nameArg := cmd.StringArg("NAME", "", "name of the tunnel")
+	hostArg := cmd.StringArg("HOST", "", "node id or name of the address book")
+	cmd.Action = func() {
+		cm := confManager()
+		err := cm.AddTunnel(*nameArg, conf.TunnelConf{
+			LocalPort:  int32(*localOpt),
+			Host:       *hostArg,
+			RemotePort: int32(*remoteOpt),
+			Profile:    strings.ToLower(*profileOpt),
+			Disabled:   *disabledOpt,
+		})
+		if err != nil {
+			logrus.Error(err)
+			cli.Exit(1)
+		}
+		applyTunnels()
+	}
+}
+
+func cmdRemoveTunnel(cmd *cli.Cmd) {
+	cmd.Spec = "NAME..."
+	namesArg := cmd.StringsArg("NAME", nil, "names to remove")
+	cmd.Action = func() {
+		cm := confManager()
+		for _, v := range *namesArg {
+			err := cm.RemoveTunnel(v)
+			if err != nil {
+				logrus.Error(err)
+				cli.Exit(1)
+			}
+		}
+		applyTunnels()
+	}
+}
+
+// setTunnelsEnabled switches tunnels on or off in the configure
+func setTunnelsEnabled(names []string, enabled bool) {
+	cm := confManager()
+	for _, v := range names {
+		t, ok := cm.Current().Tunnels[strings.ToLower(v)]
+		if !ok {
+			logrus.Error("no tunnel named ", v)
+			cli.Exit(1)
+		}
+		t.Disabled = !enabled
+		err := cm.AddTunnel(v, t)
+		if err != nil {
+			logrus.Error(err)
+			cli.Exit(1)
+		}
+	}
+	applyTunnels()
+}
+
+func cmdEnableTunnel(cmd *cli.Cmd) {
+	cmd.Spec = "NAME..."
+	namesArg := cmd.StringsArg("NAME", nil, "names to enable")
+	cmd.Action = func() {
+		setTunnelsEnabled(*namesArg, true)
+	}
+}
+
+func cmdDisableTunnel(cmd *cli.Cmd) {
+	cmd.Spec = "NAME..."
+	namesArg := cmd.StringsArg("NAME", nil, "names to disable")
+	cmd.Action = func() {
+		setTunnelsEnabled(*namesArg, false)
+	}
+}
+
+func cmdTunnels(cmd *cli.Cmd) {
+	cmd.Command("ls", "list tunnels and their state", cmdListTunnels)
+	cmd.Command("add", "add or replace a tunnel kept up by the daemon", cmdAddTunnel)
+	cmd.Command("rm", "remove tunnels", cmdRemoveTunnel)
+	cmd.Command("enable", "start tunnels and keep them started", cmdEnableTunnel)
+	cmd.Command("disable", "stop tunnels and keep them stopped", cmdDisableTunnel)
+}
@@ -4,19 +4,30 @@ import (
 	"errors"
 	"os"
 
+	cli "github.com/jawher/mow.cli"
 	"github.com/sirupsen/logrus"
+	"github.com/suutaku/sshx/internal/utils"
+	"github.com/suutaku/sshx/pkg/conf"
 )
 
 func getRootPath() string {
-	rootStr := os.Getenv("SSHX_HOME")
-	if rootStr == "" {
-		rootStr = defaultHomePath
-	}
+	rootStr := utils.GetSSHXHome()
 	if _, err := os.Stat(rootStr); errors.Is(err, os.ErrNotExist) {
-		err := os.Mkdir(rootStr, 0766)
+		err := os.MkdirAll(rootStr, 0700)
 		if err != nil {
 			logrus.Error(err)
 		}
 	}
 	return rootStr
 }
+
+// confManager reads the configure, commands stop if it is not readable or
+// there is none, only the daemon and conf init create one
+func confManager() *conf.ConfManager {
+	cm, err := conf.OpenConfManager(utils.GetSSHXHome())
+	if err != nil {
+		logrus.Error(err)
+		cli.Exit(1)
+	}
+	return cm
+}
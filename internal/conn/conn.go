@@ -1,9 +1,12 @@
 package conn
 
 import (
+	"io"
+	"sync/atomic"
 	"time"
 
 	"github.com/sirupsen/logrus"
+	"github.com/suutaku/sshx/internal/qos"
 	"github.com/suutaku/sshx/pkg/impl"
 	"github.com/suutaku/sshx/pkg/types"
 )
@@ -25,16 +28,32 @@ type Connection interface {
 	IsReady() bool
 	Ready()
 	Name() string
+	Transport() string
+	Traffic() (in, out int64)
+	FillStatus(stat *types.Status)
+}
+
+// counters of one direction, updated atomically
+type counters struct {
+	bytes    int64
+	messages int64
 }
 
 type BaseConnection struct {
-	impl     impl.Impl
-	nodeId   string
-	targetId string
-	poolId   types.PoolId
-	Exit     chan error
-	Direct   int32
-	ready    bool
+	// traffic from and to the peer, first for 64 bit alignment
+	in        counters
+	out       counters
+	errors    int64
+	impl      impl.Impl
+	nodeId    string
+	targetId  string
+	poolId    types.PoolId
+	Exit      chan error
+	Direct    int32
+	ready     bool
+	shaper    *qos.Shaper
+	created   time.Time
+	transport string
 }
 
 func NewBaseConnection(impl impl.Impl, nodeId, targetId string, poolId types.PoolId, direct, implc int32) *BaseConnection {
@@ -46,6 +65,7 @@ func NewBaseConnection(impl impl.Impl, nodeId, targetId string, poolId types.Poo
 		poolId:   poolId,
 		impl:     impl,
 		Direct:   direct,
+		created:  time.Now(),
 	}
 	if ret.PoolId().Raw() == 0 {
 		ret.poolId = *types.NewPoolId(time.Now().UnixNano(), implc)
@@ -53,10 +73,65 @@ func NewBaseConnection(impl impl.Impl, nodeId, targetId string, poolId types.Poo
 	return ret
 }
 
+func (bc *BaseConnection) SetShaper(shaper *qos.Shaper) {
+	bc.shaper = shaper
+}
+
+// shape applies rate limits and priority to writes of this pair
+func (bc *BaseConnection) shape(w io.Writer) io.Writer {
+	if bc.shaper == nil {
+		return w
+	}
+	// only top level ssh sessions are interactive, scp and sshfs are children
+	interactive := bc.impl.Code() == types.APP_TYPE_SSH && bc.impl.ParentId() == ""
+	return bc.shaper.Writer(w, bc.targetId, bc.impl.Code(), bc.impl.GetLimit(), interactive)
+}
+
+// implWriter writes to whatever writer impl currently has
+type implWriter struct {
+	impl impl.Impl
+}
+
+func (w implWriter) Write(b []byte) (int, error) {
+	return w.impl.Writer().Write(b)
+}
+
 func (bc *BaseConnection) Ready() {
+	if !bc.ready {
+		setupLatency.With(bc.transport, appName(bc.impl.Code())).Observe(time.Since(bc.created).Seconds())
+		events.publish(bc.event(types.EVENT_PAIR_READY, ""))
+	}
 	bc.ready = true
 }
 
+func (bc *BaseConnection) Transport() string {
+	return bc.transport
+}
+
+func (bc *BaseConnection) Traffic() (int64, int64) {
+	return atomic.LoadInt64(&bc.in.bytes), atomic.LoadInt64(&bc.out.bytes)
+}
+
+// FillStatus adds live counters of the pair to stat
+func (bc *BaseConnection) FillStatus(stat *types.Status) {
+	stat.Transport = bc.transport
+	stat.BytesIn = atomic.LoadInt64(&bc.in.bytes)
+	stat.BytesOut = atomic.LoadInt64(&bc.out.bytes)
+	stat.MessagesIn = atomic.LoadInt64(&bc.in.messages)
+	stat.MessagesOut = atomic.LoadInt64(&bc.out.messages)
+	stat.Errors = atomic.LoadInt64(&bc.errors)
+}
+
+// countIn counts writes to w as messages received from the peer
+func (bc *BaseConnection) countIn(w io.Writer) io.Writer {
+	return countWriter{w, &bc.in, &bc.errors}
+}
+
+// countOut counts writes to w as messages sent to the peer
+func (bc *BaseConnection) countOut(w io.Writer) io.Writer {
+	return countWriter{w, &bc.out, &bc.errors}
+}
+
 func (bc *BaseConnection) IsReady() bool {
 	return bc.ready
 }
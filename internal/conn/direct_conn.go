@@ -2,9 +2,10 @@ package conn
 
 import (
 	"encoding/gob"
-	"fmt"
+	"io"
 	"net"
 	"reflect"
+	"strconv"
 
 	"github.com/sirupsen/logrus"
 	"github.com/suutaku/sshx/internal/utils"
@@ -16,6 +17,8 @@ type DirectConnection struct {
 	BaseConnection
 	net.Conn
 	CleanChan *chan CleanRequest
+	// port the peer listens on for direct connections
+	port int32
 }
 
 func NewDirectConnection(impl impl.Impl, nodeId string, targetId string, poolId types.PoolId, direct int32, cleanChan *chan CleanRequest) *DirectConnection {
@@ -23,12 +26,16 @@ func NewDirectConnection(impl impl.Impl, nodeId string, targetId string, poolId
 		BaseConnection: *NewBaseConnection(impl, nodeId, targetId, poolId, direct, impl.Code()),
 		CleanChan:      cleanChan,
 	}
+	ret.transport = transportDirect
 	return ret
 }
 
 func (dc *DirectConnection) Close() {
 	dc.BaseConnection.Close()
-	dc.Conn.Close()
+	// detached pairs, like the one of a proxy, never dial
+	if dc.Conn != nil {
+		dc.Conn.Close()
+	}
 }
 
 func (dc *DirectConnection) Name() string {
@@ -42,24 +49,25 @@ func (dc *DirectConnection) Name() string {
 func (dc *DirectConnection) Dial() error {
 	if dc.impl.IsNeedConnect() {
 		logrus.Debug("dial ", dc.TargetId(), " directly")
-		conn, err := net.Dial("tcp", fmt.Sprintf("%s:%d", dc.TargetId(), directPort))
+		port := dc.port
+		if port == 0 {
+			port = directPort
+		}
+		conn, err := net.Dial("tcp", net.JoinHostPort(dc.TargetId(), strconv.Itoa(int(port))))
 		if err != nil {
 			return err
 		}
 		info := DirectInfo{
-			ImplCode: dc.impl.Code(),
-			HostId:   dc.nodeId,
-			Id:       dc.poolId.Raw(),
+			ImplCode:   dc.impl.Code(),
+			HostId:     dc.nodeId,
+			Id:         dc.poolId.Raw(),
+			RemotePort: dc.impl.GetRemotePort(),
+			RemoteAddr: dc.impl.GetRemoteAddr(),
 		}
 		logrus.Debug("send direct info")
 		gob.NewEncoder(conn).Encode(info)
-		implConn := dc.impl.Conn()
-		dc.Conn = conn
-		go func() {
-			utils.Pipe(&implConn, &dc.Conn)
-			logrus.Error("direct broken ", dc.Name())
-			*dc.CleanChan <- CleanRequest{dc.PoolId().String(dc.Direction()), dc.Name()}
-		}()
+		dc.Conn = countConn{conn, &dc.BaseConnection}
+		go dc.pipe()
 	} else {
 		logrus.Error("NOT create connection for ", impl.GetImplName(dc.impl.Code()))
 	}
@@ -79,12 +87,34 @@ func (dc *DirectConnection) Response() error {
 	if err != nil {
 		return err
 	}
-	implConn := dc.impl.Conn() //connection from dial ssh
-	go func() {
-		utils.Pipe(&implConn, &dc.Conn)
-		logrus.Error("direct broken ", dc.Name())
-		*dc.CleanChan <- CleanRequest{dc.poolId.String(dc.Direction()), dc.Name()}
-	}()
-
+	dc.Conn = countConn{dc.Conn, &dc.BaseConnection}
+	go dc.pipe()
 	return nil
 }
+
+// pipe copies between the impl and the peer until either side breaks,
+// writes in both directions go through the shaper like on webrtc pairs
+func (dc *DirectConnection) pipe() {
+	implConn := dc.shapeConn(dc.impl.Conn())
+	peer := dc.shapeConn(dc.Conn)
+	utils.Pipe(&implConn, &peer)
+	logrus.Error("direct broken ", dc.Name())
+	*dc.CleanChan <- CleanRequest{dc.poolId.String(dc.Direction()), dc.Name(), "connection broken"}
+}
+
+// shapedConn sends writes through the shaper of its pair
+type shapedConn struct {
+	net.Conn
+	w io.Writer
+}
+
+func (sc shapedConn) Write(b []byte) (int, error) {
+	return sc.w.Write(b)
+}
+
+func (dc *DirectConnection) shapeConn(conn net.Conn) net.Conn {
+	if dc.shaper == nil {
+		return conn
+	}
+	return shapedConn{conn, dc.shape(conn)}
+}
@@ -2,10 +2,14 @@ package conn
 
 import (
 	"encoding/gob"
+	"errors"
 	"fmt"
 	"net"
+	"sync"
+	"sync/atomic"
 
 	"github.com/sirupsen/logrus"
+	"github.com/suutaku/sshx/pkg/conf"
 	"github.com/suutaku/sshx/pkg/impl"
 	"github.com/suutaku/sshx/pkg/types"
 )
@@ -13,57 +17,139 @@ import (
 const directPort = 8099
 
 type DirectInfo struct {
-	Id       int64
-	ImplCode int32
-	HostId   string
+	Id         int64
+	ImplCode   int32
+	HostId     string
+	RemotePort int32
+	RemoteAddr string
 }
 
 type DirectService struct {
 	BaseConnectionService
+	listening int32
+	port      int32
+	lock      sync.Mutex
+	listener  net.Listener
 }
 
-func NewDirectService(id string) *DirectService {
-	return &DirectService{
+func NewDirectService(id string, port int32) *DirectService {
+	if port == 0 {
+		port = directPort
+	}
+	ret := &DirectService{
 		BaseConnectionService: *NewBaseConnectionService(id),
+		port:                  port,
 	}
+	ret.transport = transportDirect
+	return ret
 }
 
 func (ds *DirectService) Start() error {
 	ds.BaseConnectionService.Start()
-	listenner, err := net.Listen("tcp", fmt.Sprintf(":%d", directPort))
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+	ds.listen()
+	return nil
+}
+
+// SetPort moves the listener to port, pairs already connected stay
+func (ds *DirectService) SetPort(port int32) {
+	if port == 0 {
+		port = directPort
+	}
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+	if port == ds.port {
+		return
+	}
+	logrus.Info("move direct listener from port ", ds.port, " to ", port)
+	ds.port = port
+	if ds.listener != nil {
+		ds.listener.Close()
+		ds.listener = nil
+	}
+	if ds.running {
+		ds.listen()
+	}
+}
+
+func (ds *DirectService) getPort() int32 {
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+	return ds.port
+}
+
+// listen starts accepting on the current port, ds.lock must be held. No
+// pairs go direct while the port is disabled
+func (ds *DirectService) listen() {
+	if ds.port == conf.DIRECT_PORT_DISABLED {
+		logrus.Info("direct connections are disabled")
+		ds.isReady = false
+		return
+	}
+	ds.isReady = true
+	listenner, err := net.Listen("tcp", fmt.Sprintf(":%d", ds.port))
 	if err != nil {
 		logrus.Error(err)
+		atomic.StoreInt32(&ds.listening, 0)
+		return
 	}
+	ds.listener = listenner
+	atomic.StoreInt32(&ds.listening, 1)
+	go ds.serve(listenner)
+}
 
-	go func() {
-		logrus.Debug("runing status ", ds.running)
-		for ds.running {
-			sock, err := listenner.Accept()
-			if err != nil {
-				logrus.Error(err)
-				continue
-			}
-			var info DirectInfo
-			err = gob.NewDecoder(sock).Decode(&info)
-			if err != nil {
-				logrus.Error(err)
-				continue
-			}
-			logrus.Debug("new direct info com ", info)
-			imp := impl.GetImpl(info.ImplCode)
-			imp.SetHostId(info.HostId)
-			poolId := types.NewPoolId(info.Id, imp.Code())
-			// server reset direction
-			conn := NewDirectConnection(imp, ds.Id(), info.HostId, *poolId, CONNECTION_DRECT_IN, &ds.CleanChan)
-			conn.Conn = sock
-			err = conn.Response()
-			if err != nil {
-				logrus.Error(err)
-				continue
-			}
-			ds.AddPair(conn)
+func (ds *DirectService) serve(listenner net.Listener) {
+	defer func() {
+		ds.lock.Lock()
+		if ds.listener == listenner || ds.listener == nil {
+			atomic.StoreInt32(&ds.listening, 0)
 		}
+		ds.lock.Unlock()
 	}()
+	logrus.Debug("runing status ", ds.running)
+	for ds.running {
+		sock, err := listenner.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			logrus.Debug(err)
+			return
+		}
+		if err != nil {
+			logrus.Error(err)
+			continue
+		}
+		var info DirectInfo
+		err = gob.NewDecoder(sock).Decode(&info)
+		if err != nil {
+			logrus.Error(err)
+			continue
+		}
+		logrus.Debug("new direct info com ", info)
+		imp := impl.GetImpl(info.ImplCode)
+		imp.SetHostId(info.HostId)
+		imp.SetRemotePort(info.RemotePort)
+		imp.SetRemoteAddr(info.RemoteAddr)
+		poolId := types.NewPoolId(info.Id, imp.Code())
+		// server reset direction
+		conn := NewDirectConnection(imp, ds.Id(), info.HostId, *poolId, CONNECTION_DRECT_IN, &ds.CleanChan)
+		conn.Conn = sock
+		conn.SetShaper(ds.shaper)
+		err = conn.Response()
+		if err != nil {
+			logrus.Error(err)
+			continue
+		}
+		ds.AddPair(conn)
+	}
+}
+
+func (ds *DirectService) Healthy() error {
+	if ds.getPort() == conf.DIRECT_PORT_DISABLED {
+		return nil
+	}
+	if atomic.LoadInt32(&ds.listening) == 0 {
+		return fmt.Errorf("direct listener on port %d is not running", ds.getPort())
+	}
 	return nil
 }
 
@@ -83,6 +169,8 @@ func (ds *DirectService) CreateConnection(sender *impl.Sender, sock net.Conn, po
 		iface.SetConn(sock)
 	}
 	pair := NewDirectConnection(iface, ds.Id(), iface.HostId(), poolId, CONNECTION_DRECT_OUT, &ds.CleanChan)
+	pair.port = ds.getPort()
+	pair.SetShaper(ds.shaper)
 	err = pair.Dial()
 	if err != nil {
 		return err
@@ -99,6 +187,7 @@ func (ds *DirectService) DestroyConnection(tmp *impl.Sender) error {
 	if pair == nil {
 		return fmt.Errorf("cannot get pair for %s", string(tmp.PairId))
 	}
-	ds.RemovePair(CleanRequest{string(tmp.PairId), (&DirectConnection{}).Name()})
+	// the pair may be of another service, detached pairs are registered by all
+	ds.RemovePair(CleanRequest{string(tmp.PairId), pair.Name(), "down request"})
 	return nil
 }
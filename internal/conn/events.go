@@ -0,0 +1,73 @@
+package conn
+
+import (
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/suutaku/sshx/pkg/impl"
+	"github.com/suutaku/sshx/pkg/types"
+)
+
+// events a subscriber may lag behind before it misses some
+const eventBacklog = 256
+
+// eventBus fans lifecycle events out to subscribers, slow ones lose events
+type eventBus struct {
+	lock sync.Mutex
+	subs map[chan types.Event]struct{}
+}
+
+var events = &eventBus{subs: make(map[chan types.Event]struct{})}
+
+func (eb *eventBus) subscribe() chan types.Event {
+	ch := make(chan types.Event, eventBacklog)
+	eb.lock.Lock()
+	eb.subs[ch] = struct{}{}
+	eb.lock.Unlock()
+	return ch
+}
+
+func (eb *eventBus) unsubscribe(ch chan types.Event) {
+	eb.lock.Lock()
+	delete(eb.subs, ch)
+	eb.lock.Unlock()
+}
+
+func (eb *eventBus) publish(e types.Event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	eb.lock.Lock()
+	defer eb.lock.Unlock()
+	for ch := range eb.subs {
+		select {
+		case ch <- e:
+		default:
+			logrus.Debug("drop event ", e.Type, " of ", e.PairId, " for a slow subscriber")
+		}
+	}
+}
+
+func newEvent(kind, pairId, targetId string, imp impl.Impl, transport, detail string) types.Event {
+	e := types.Event{
+		Type:      kind,
+		PairId:    pairId,
+		TargetId:  targetId,
+		Transport: transport,
+		Detail:    detail,
+	}
+	if imp != nil {
+		e.ImplType = imp.Code()
+		e.ParentPairId = imp.ParentId()
+	}
+	return e
+}
+
+func pairEvent(kind string, pair Connection, detail string) types.Event {
+	return newEvent(kind, pair.PoolId().String(pair.Direction()), pair.TargetId(), pair.GetImpl(), pair.Transport(), detail)
+}
+
+func (bc *BaseConnection) event(kind, detail string) types.Event {
+	return newEvent(kind, bc.poolId.String(bc.Direct), bc.targetId, bc.impl, bc.transport, detail)
+}
@@ -9,6 +9,7 @@ import (
 	"time"
 
 	"github.com/sirupsen/logrus"
+	"github.com/suutaku/sshx/internal/qos"
 	"github.com/suutaku/sshx/internal/utils"
 	"github.com/suutaku/sshx/pkg/impl"
 	"github.com/suutaku/sshx/pkg/types"
@@ -16,21 +17,28 @@ import (
 
 // manage all supported connection implementations
 type ConnectionManager struct {
-	css []ConnectionService
-	stm *StatManager
+	css    []ConnectionService
+	stm    *StatManager
+	shaper *qos.Shaper
 }
 
-func NewConnectionManager(enabledService []ConnectionService) *ConnectionManager {
-	return &ConnectionManager{
-		stm: NewStatManager(),
-		css: enabledService,
+func NewConnectionManager(enabledService []ConnectionService, shaper *qos.Shaper) *ConnectionManager {
+	ret := &ConnectionManager{
+		stm:    NewStatManager(),
+		css:    enabledService,
+		shaper: shaper,
 	}
+	ret.stm.collectPairs(registry)
+	impl.SetStatusSource(ret.stm.Stat)
+	impl.SetLocalDialer(ret.Dial)
+	return ret
 }
 
 func (cm *ConnectionManager) Start() {
 	logrus.Debug("Start connection manager")
 	for _, v := range cm.css {
 		v.SetStateManager(cm.stm)
+		v.SetShaper(cm.shaper)
 		v.Start()
 		typeName := ""
 		if t := reflect.TypeOf(v); t.Kind() == reflect.Ptr {
@@ -42,15 +50,58 @@ func (cm *ConnectionManager) Start() {
 	}
 }
 
+// Health reports the state of every service able to check itself, by name
+func (cm *ConnectionManager) Health() map[string]error {
+	ret := make(map[string]error)
+	for _, v := range cm.css {
+		if hc, ok := v.(HealthChecker); ok {
+			name := reflect.TypeOf(v).Elem().Name()
+			if v.Profile() != "" {
+				name += "/" + v.Profile()
+			}
+			ret[name] = hc.Healthy()
+		}
+	}
+	return ret
+}
+
 func (cm *ConnectionManager) Stop() {
 	for _, v := range cm.css {
 		v.Stop()
 	}
 }
 
+// serves reports whether cs may carry a pair of profile, direct
+// connections do not go through a signaling network
+func serves(cs ConnectionService, profile string) bool {
+	return cs.Transport() == transportDirect || cs.Profile() == profile
+}
+
+func (cm *ConnectionManager) hasProfile(profile string) bool {
+	for _, v := range cm.css {
+		if v.Transport() != transportDirect && v.Profile() == profile {
+			return true
+		}
+	}
+	return false
+}
+
 func (cm *ConnectionManager) CreateConnection(sender *impl.Sender, sock net.Conn, poolId types.PoolId) error {
+	if !cm.hasProfile(sender.Profile) {
+		return fmt.Errorf("unknown profile %s", sender.Profile)
+	}
+	// hosts of the address book may ask for one transport
+	want := ""
+	if imp := sender.GetImpl(); imp != nil {
+		want = imp.PreferredTransport()
+	}
 	for i := 0; i < len(cm.css); i++ {
-
+		if want != "" && cm.css[i].Transport() != want {
+			continue
+		}
+		if !serves(cm.css[i], sender.Profile) {
+			continue
+		}
 		if cm.css[i].IsReady() {
 			go func(cs ConnectionService) {
 				s, c := net.Pipe()
@@ -82,6 +133,29 @@ func (cm *ConnectionManager) CreateConnection(sender *impl.Sender, sock net.Conn
 	return nil
 }
 
+// Dial creates a pair from inside the daemon, like Sender.Send does for
+// commands
+func (cm *ConnectionManager) Dial(sender *impl.Sender) (net.Conn, error) {
+	s, c := net.Pipe()
+	poolId := types.NewPoolId(time.Now().UnixNano(), sender.GetAppCode())
+	err := cm.CreateConnection(sender, c, *poolId)
+	if err != nil {
+		return nil, err
+	}
+	// the answer of the connection service comes first
+	var res impl.Sender
+	err = gob.NewDecoder(s).Decode(&res)
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	if res.Status != 0 {
+		s.Close()
+		return nil, fmt.Errorf("response error")
+	}
+	return s, nil
+}
+
 func (cm *ConnectionManager) DestroyConnection(sender *impl.Sender, conn net.Conn) error {
 	err := cm.css[0].DestroyConnection(sender)
 	if err != nil {
@@ -131,7 +205,19 @@ func (cm *ConnectionManager) Status(sender impl.Sender, conn net.Conn) error {
 	}
 	res = cm.stm.Stat()
 	logrus.Debug("responsed ----->", res)
-	err = gob.NewEncoder(conn).Encode(res)
+	enc := gob.NewEncoder(conn)
+	err = enc.Encode(res)
+	if err != nil {
+		logrus.Error(err)
+		return err
+	}
+	health := make(map[string]string)
+	for k, v := range cm.Health() {
+		if v != nil {
+			health[k] = v.Error()
+		}
+	}
+	err = enc.Encode(health)
 	if err != nil {
 		logrus.Error(err)
 		return err
@@ -140,6 +226,41 @@ func (cm *ConnectionManager) Status(sender impl.Sender, conn net.Conn) error {
 	return nil
 }
 
+// Subscribe streams lifecycle events of all pairs to conn until it is closed
+func (cm *ConnectionManager) Subscribe(sender impl.Sender, conn net.Conn) error {
+	bs := NewBaseConnectionService(sender.GetImpl().HostId())
+	err := bs.ResponseTCP(&sender, conn)
+	if err != nil {
+		return err
+	}
+	ch := events.subscribe()
+	go func() {
+		defer conn.Close()
+		defer events.unsubscribe(ch)
+		closed := make(chan struct{})
+		go func() {
+			// subscribers send nothing, a read returns once they go away
+			conn.Read(make([]byte, 1))
+			close(closed)
+		}()
+		enc := gob.NewEncoder(conn)
+		for {
+			select {
+			case e := <-ch:
+				err := enc.Encode(e)
+				if err != nil {
+					logrus.Debug("subscriber gone: ", err)
+					return
+				}
+			case <-closed:
+				logrus.Debug("subscriber closed")
+				return
+			}
+		}
+	}()
+	return nil
+}
+
 type StatManager struct {
 	stats    map[string]types.Status
 	children map[string][]string
@@ -192,6 +313,9 @@ func (stm *StatManager) getStat() []types.Status {
 	ret := make([]types.Status, 0)
 
 	for _, v := range stm.stats {
+		if pair := stm.cpPool[v.PairId]; pair != nil {
+			pair.FillStatus(&v)
+		}
 		ret = append(ret, []types.Status{v}...)
 	}
 	return ret
@@ -207,25 +331,38 @@ func PoolIdFromInt(id int64) string {
 }
 
 func (stm *StatManager) Stat() []types.Status {
+	stm.lock.Lock()
+	defer stm.lock.Unlock()
 	return stm.getStat()
 }
 
+func (stm *StatManager) pairs() []Connection {
+	stm.lock.Lock()
+	defer stm.lock.Unlock()
+	ret := make([]Connection, 0, len(stm.cpPool))
+	for _, v := range stm.cpPool {
+		ret = append(ret, v)
+	}
+	return ret
+}
+
 func (stm *StatManager) RemovePair(id CleanRequest) {
 	stm.lock.Lock()
 	defer stm.lock.Unlock()
 	children := stm.getChildren(id.Key)
 	logrus.Debug("ready to clear children ", children)
-	// close children
-	for _, v := range children {
-		if stm.cpPool[v] != nil && stm.cpPool[v].Name() == id.ConnectionName {
-			stm.cpPool[v].Close()
-			delete(stm.cpPool, v)
-			stm.removeStat(id.Key)
-		}
-
-	}
 	// close parent
 	if stm.cpPool[id.Key] != nil && stm.cpPool[id.Key].Name() == id.ConnectionName {
+		// close children, of any transport
+		for _, v := range children {
+			if stm.cpPool[v] != nil {
+				events.publish(pairEvent(types.EVENT_PAIR_CLOSED, stm.cpPool[v], "parent "+id.Reason))
+				stm.cpPool[v].Close()
+				delete(stm.cpPool, v)
+				stm.removeStat(v)
+			}
+		}
+		events.publish(pairEvent(types.EVENT_PAIR_CLOSED, stm.cpPool[id.Key], id.Reason))
 		stm.cpPool[id.Key].Close()
 		delete(stm.cpPool, id.Key)
 		stm.removeStat(id.Key)
@@ -234,7 +371,14 @@ func (stm *StatManager) RemovePair(id CleanRequest) {
 }
 
 func (stm *StatManager) doAddPair(pair Connection) error {
+	stm.lock.Lock()
+	defer stm.lock.Unlock()
+	_, replaced := stm.cpPool[pair.PoolId().String(pair.Direction())]
 	stm.cpPool[pair.PoolId().String(pair.Direction())] = pair
+	if !replaced {
+		events.publish(pairEvent(types.EVENT_PAIR_CREATED, pair, ""))
+	}
+	events.publish(pairEvent(types.EVENT_TRANSPORT, pair, pair.Transport()))
 	logrus.Debugf("add pair %s %s successfully\n", pair.PoolId().String(pair.Direction()), pair.Name())
 	stat := types.Status{
 		PairId:    pair.PoolId().String(pair.Direction()),
@@ -247,6 +391,7 @@ func (stm *StatManager) doAddPair(pair Connection) error {
 		logrus.Debug("add child ", pair.PoolId().String(pair.Direction()), " to ", pair.GetImpl().ParentId())
 		stat.ParentPairId = pair.GetImpl().ParentId()
 		stm.addChild(pair.GetImpl().ParentId(), pair.PoolId().String(pair.Direction()))
+		events.publish(pairEvent(types.EVENT_CHILD_ADDED, pair, ""))
 	}
 	stm.putStat(stat)
 	logrus.Debug("put pair on stat ", impl.GetImplName(pair.GetImpl().Code()), " with pair id ", stat.PairId)
@@ -260,7 +405,7 @@ func (stm *StatManager) AddPair(pair Connection) error {
 		return fmt.Errorf("pair was empty")
 	}
 
-	oldPair := stm.cpPool[pair.PoolId().String(pair.Direction())]
+	oldPair := stm.GetPair(pair.PoolId().String(pair.Direction()))
 
 	if oldPair != nil {
 		if oldPair.IsReady() {
@@ -273,7 +418,7 @@ func (stm *StatManager) AddPair(pair Connection) error {
 			return stm.doAddPair(pair)
 		}
 		for !oldPair.IsReady() && !pair.IsReady() {
-			logrus.Debug("watting %s\n", pair.Name())
+			logrus.Debug("watting ", pair.Name())
 			time.Sleep(500 * time.Millisecond)
 		}
 		if oldPair.IsReady() {
@@ -289,5 +434,7 @@ func (stm *StatManager) AddPair(pair Connection) error {
 }
 
 func (stm *StatManager) GetPair(id string) Connection {
+	stm.lock.Lock()
+	defer stm.lock.Unlock()
 	return stm.cpPool[id]
 }
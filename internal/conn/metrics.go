@@ -0,0 +1,109 @@
+package conn
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"github.com/suutaku/sshx/internal/metrics"
+	"github.com/suutaku/sshx/pkg/impl"
+)
+
+const (
+	transportWebRTC = "webrtc"
+	transportDirect = "direct"
+)
+
+var (
+	registry     = metrics.NewRegistry()
+	setupLatency = registry.Histogram("sshx_connection_setup_seconds",
+		"Time from pair creation until it is ready, by transport and application.", metrics.DefBuckets, "transport", "app")
+	iceResults = registry.Counter("sshx_ice_connections_total",
+		"ICE connection state changes to connected or failed.", "state")
+	signalingErrors = registry.Counter("sshx_signaling_errors_total",
+		"Failed requests to the signaling server by operation.", "op")
+	teardowns = registry.Counter("sshx_pair_teardowns_total",
+		"Pairs removed through the clean channel, by transport.", "transport")
+)
+
+// MetricsHandler serves the daemon metrics in the prometheus format
+func MetricsHandler() http.Handler {
+	return registry.Handler()
+}
+
+func appName(code int32) string {
+	return strings.ToLower(strings.TrimPrefix(impl.GetImplName(code), "*"))
+}
+
+func (c *counters) add(n int) {
+	atomic.AddInt64(&c.bytes, int64(n))
+	atomic.AddInt64(&c.messages, 1)
+}
+
+// countWriter counts every write to w as one message
+type countWriter struct {
+	w    io.Writer
+	c    *counters
+	errs *int64
+}
+
+func (cw countWriter) Write(b []byte) (int, error) {
+	n, err := cw.w.Write(b)
+	cw.c.add(n)
+	if err != nil {
+		atomic.AddInt64(cw.errs, 1)
+	}
+	return n, err
+}
+
+// countConn counts reads from and writes to a peer connection
+type countConn struct {
+	net.Conn
+	bc *BaseConnection
+}
+
+func (cc countConn) Read(b []byte) (int, error) {
+	n, err := cc.Conn.Read(b)
+	if n > 0 {
+		cc.bc.in.add(n)
+	}
+	if err != nil && err != io.EOF {
+		atomic.AddInt64(&cc.bc.errors, 1)
+	}
+	return n, err
+}
+
+func (cc countConn) Write(b []byte) (int, error) {
+	n, err := cc.Conn.Write(b)
+	cc.bc.out.add(n)
+	if err != nil {
+		atomic.AddInt64(&cc.bc.errors, 1)
+	}
+	return n, err
+}
+
+// collectPairs reports live pairs and their traffic
+func (stm *StatManager) collectPairs(reg *metrics.Registry) {
+	reg.GaugeFunc("sshx_active_pairs", "Active pairs by application and transport.", []string{"app", "transport"},
+		func(emit func(float64, ...string)) {
+			counts := make(map[[2]string]int)
+			for _, v := range stm.pairs() {
+				counts[[2]string{appName(v.GetImpl().Code()), v.Transport()}]++
+			}
+			for k, v := range counts {
+				emit(float64(v), k[0], k[1])
+			}
+		})
+	reg.CounterFunc("sshx_pair_bytes_total", "Bytes received from and sent to the peer of a live pair.", []string{"pair", "app", "direction"},
+		func(emit func(float64, ...string)) {
+			for _, v := range stm.pairs() {
+				in, out := v.Traffic()
+				id := v.PoolId().String(v.Direction())
+				app := appName(v.GetImpl().Code())
+				emit(float64(in), id, app, "in")
+				emit(float64(out), id, app, "out")
+			}
+		})
+}
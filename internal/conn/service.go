@@ -6,6 +6,7 @@ import (
 	"net"
 
 	"github.com/sirupsen/logrus"
+	"github.com/suutaku/sshx/internal/qos"
 	"github.com/suutaku/sshx/pkg/impl"
 	"github.com/suutaku/sshx/pkg/types"
 )
@@ -14,6 +15,7 @@ import (
 type ConnectionService interface {
 	Start() error
 	SetStateManager(*StatManager) error
+	SetShaper(*qos.Shaper) error
 	CreateConnection(*impl.Sender, net.Conn, types.PoolId) error
 	DestroyConnection(*impl.Sender) error
 	AttachConnection(*impl.Sender, net.Conn) error
@@ -23,11 +25,17 @@ type ConnectionService interface {
 	GetPair(id string) Connection
 	WatchPairs()
 	Id() string
+	// direct or webrtc
+	Transport() string
+	// profile of the signaling network, empty for the default one
+	Profile() string
 }
 
 type CleanRequest struct {
 	Key            string
 	ConnectionName string
+	// why the pair goes away, reported to event subscribers
+	Reason string
 }
 
 type BaseConnectionService struct {
@@ -36,6 +44,9 @@ type BaseConnectionService struct {
 	running   bool
 	CleanChan chan CleanRequest
 	id        string
+	shaper    *qos.Shaper
+	transport string
+	profile   string
 }
 
 func NewBaseConnectionService(id string) *BaseConnectionService {
@@ -45,10 +56,28 @@ func NewBaseConnectionService(id string) *BaseConnectionService {
 	}
 }
 
+// HealthChecker is implemented by services able to tell if they work
+type HealthChecker interface {
+	Healthy() error
+}
+
 func (base *BaseConnectionService) Id() string {
 	return base.id
 }
 
+func (base *BaseConnectionService) Transport() string {
+	return base.transport
+}
+
+func (base *BaseConnectionService) Profile() string {
+	return base.profile
+}
+
+// SetProfile names the signaling network of the service
+func (base *BaseConnectionService) SetProfile(name string) {
+	base.profile = name
+}
+
 func (base *BaseConnectionService) ResponseTCP(sender *impl.Sender, conn net.Conn) error {
 	logrus.Debug("do Response TCP")
 	err := gob.NewEncoder(conn).Encode(sender)
@@ -74,6 +103,7 @@ func (base *BaseConnectionService) GetPair(id string) Connection {
 func (base *BaseConnectionService) WatchPairs() {
 	for base.running {
 		pairId := <-base.CleanChan
+		teardowns.With(base.transport).Inc()
 		base.RemovePair(pairId)
 		logrus.Debug("clean request from clean channel ", pairId)
 	}
@@ -91,6 +121,11 @@ func (base *BaseConnectionService) SetStateManager(stm *StatManager) error {
 	return nil
 }
 
+func (base *BaseConnectionService) SetShaper(shaper *qos.Shaper) error {
+	base.shaper = shaper
+	return nil
+}
+
 func (base *BaseConnectionService) CreateConnection(sender *impl.Sender, conn net.Conn, poolId types.PoolId) error {
 	return nil
 }
@@ -4,8 +4,10 @@ import (
 	"fmt"
 	"io"
 	"reflect"
+	"sync"
 	"time"
 
+	"github.com/suutaku/sshx/internal/utils"
 	"github.com/suutaku/sshx/pkg/impl"
 	"github.com/suutaku/sshx/pkg/types"
 
@@ -13,13 +15,89 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
+const (
+	// larger writes are split into messages of this size, pion refuses
+	// messages above the SCTP max message size
+	maxMessageSize = 32 * 1024
+	// writers block when the send buffer grows above bufferedAmountHigh until
+	// it drains below bufferedAmountLow
+	bufferedAmountHigh = 1024 * 1024
+	bufferedAmountLow  = 256 * 1024
+)
+
+// Wrapper is a flow controlled writer of a data channel
 type Wrapper struct {
 	*webrtc.DataChannel
+	low    chan struct{}
+	closed chan struct{}
+	once   sync.Once
+}
+
+func NewWrapper(dc *webrtc.DataChannel) *Wrapper {
+	ret := &Wrapper{
+		DataChannel: dc,
+		low:         make(chan struct{}, 1),
+		closed:      make(chan struct{}),
+	}
+	dc.SetBufferedAmountLowThreshold(bufferedAmountLow)
+	dc.OnBufferedAmountLow(func() {
+		select {
+		case ret.low <- struct{}{}:
+		default:
+		}
+	})
+	return ret
+}
+
+func (s *Wrapper) isClosed() bool {
+	select {
+	case <-s.closed:
+		return true
+	default:
+	}
+	state := s.DataChannel.ReadyState()
+	return state == webrtc.DataChannelStateClosing || state == webrtc.DataChannelStateClosed
 }
 
 func (s *Wrapper) Write(b []byte) (int, error) {
-	err := s.DataChannel.Send(b)
-	return len(b), err
+	written := 0
+	for len(b) > 0 {
+		if s.isClosed() {
+			return written, io.ErrClosedPipe
+		}
+		if s.DataChannel.BufferedAmount() > bufferedAmountHigh {
+			select {
+			case <-s.low:
+			case <-s.closed:
+			}
+			continue
+		}
+		n := len(b)
+		if n > maxMessageSize {
+			n = maxMessageSize
+		}
+		err := s.DataChannel.Send(b[:n])
+		if err != nil {
+			return written, err
+		}
+		written += n
+		b = b[n:]
+	}
+	return written, nil
+}
+
+// Flush waits until everything buffered was sent or the channel closed
+func (s *Wrapper) Flush() {
+	for s.DataChannel.BufferedAmount() > 0 && !s.isClosed() {
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// Closed wakes up blocked writers, following writes fail
+func (s *Wrapper) Closed() {
+	s.once.Do(func() {
+		close(s.closed)
+	})
 }
 
 type WebRTC struct {
@@ -41,6 +119,7 @@ func NewWebRTC(conf webrtc.Configuration, impl impl.Impl, nodeId string, targetI
 		BaseConnection: *NewBaseConnection(impl, nodeId, targetId, poolId, direct, impl.Code()),
 		stmChan:        stmChan,
 	}
+	ret.transport = transportWebRTC
 	ret.impl.SetPairId(poolId.String(ret.Direction()))
 	return ret
 }
@@ -64,8 +143,11 @@ func (pair *WebRTC) Response() error {
 		pair.Close()
 		return err
 	}
+	inbound := pair.countIn(pair.shape(implWriter{pair.impl}))
+	peer.OnICEConnectionStateChange(pair.observeICE)
 	peer.OnDataChannel(func(dc *webrtc.DataChannel) {
 		//dc.Lock()
+		wrapper := NewWrapper(dc)
 		dc.OnOpen(func() {
 			logrus.Debug("WebRTC Base connection response")
 			err := pair.BaseConnection.Response()
@@ -78,10 +160,8 @@ func (pair *WebRTC) Response() error {
 			pair.Exit <- err
 			pair.Ready()
 			logrus.Info("data channel open 2")
-			n, err := io.Copy(&Wrapper{dc}, pair.impl.Reader())
-			for dc.BufferedAmount() > 0 {
-				time.Sleep(100 * time.Millisecond)
-			}
+			n, err := pair.copyOut(wrapper)
+			wrapper.Flush()
 			logrus.Info("trans2 ", n, err)
 			pair.Exit <- fmt.Errorf("io copy break")
 			dc.Close()
@@ -92,7 +172,7 @@ func (pair *WebRTC) Response() error {
 				pair.Close()
 				return
 			}
-			_, err := pair.impl.Writer().Write(msg.Data)
+			err := pair.deliver(inbound, msg.Data)
 			if err != nil {
 				logrus.Error("sock write failed:", err)
 				pair.Close()
@@ -101,6 +181,7 @@ func (pair *WebRTC) Response() error {
 		})
 		dc.OnClose(func() {
 			logrus.Debug("data channel close 2")
+			wrapper.Closed()
 			pair.Exit <- nil
 			pair.Close()
 		})
@@ -118,11 +199,14 @@ func (pair *WebRTC) Dial() error {
 		logrus.Error(err)
 		return err
 	}
-	dc, err := peer.CreateDataChannel("data", nil)
+	dc, err := peer.CreateDataChannel("data", dataChannelInit(pair.impl))
 	if err != nil {
 		pair.Close()
 		return err
 	}
+	wrapper := NewWrapper(dc)
+	inbound := pair.countIn(pair.shape(implWriter{pair.impl}))
+	peer.OnICEConnectionStateChange(pair.observeICE)
 	go func() {
 		for !pair.IsReady() {
 			time.Sleep(100 * time.Millisecond)
@@ -140,13 +224,11 @@ func (pair *WebRTC) Dial() error {
 		pair.Exit <- nil
 		pair.Ready()
 		// hangs
-		n, err := io.Copy(&Wrapper{dc}, pair.impl.Reader())
+		n, err := pair.copyOut(wrapper)
 		if err != nil {
 			logrus.Error(err)
 		}
-		for dc.BufferedAmount() > 0 {
-			time.Sleep(100 * time.Millisecond)
-		}
+		wrapper.Flush()
 		logrus.Info("trans1 ", n, err)
 		pair.Exit <- err
 		dc.Close()
@@ -158,7 +240,7 @@ func (pair *WebRTC) Dial() error {
 			pair.Close()
 			return
 		}
-		_, err := pair.impl.Writer().Write(msg.Data)
+		err := pair.deliver(inbound, msg.Data)
 		if err != nil {
 			logrus.Error("sock write failed:", err)
 			pair.Close()
@@ -166,6 +248,7 @@ func (pair *WebRTC) Dial() error {
 	})
 	dc.OnClose(func() {
 		logrus.Info("data channel close 1")
+		wrapper.Closed()
 		pair.Exit <- fmt.Errorf("data channel close")
 		pair.Close()
 		logrus.Debug("data channel closed")
@@ -173,11 +256,91 @@ func (pair *WebRTC) Dial() error {
 	pair.PeerConnection = peer
 	return nil
 }
+func isDatagram(imp impl.Impl) bool {
+	d, ok := imp.(impl.Datagram)
+	return ok && d.IsDatagram()
+}
+
+// dataChannelInit lets datagrams get lost or overtake each other like
+// they do on udp, a late datagram is worth less than a missing one
+func dataChannelInit(imp impl.Impl) *webrtc.DataChannelInit {
+	if !isDatagram(imp) {
+		return nil
+	}
+	ordered := false
+	retransmits := uint16(0)
+	return &webrtc.DataChannelInit{
+		Ordered:        &ordered,
+		MaxRetransmits: &retransmits,
+	}
+}
+
+// copyOut sends what the impl writes to the peer, one message per datagram
+// for datagram impls
+func (pair *WebRTC) copyOut(w *Wrapper) (int64, error) {
+	dst := pair.shape(pair.countOut(w))
+	if isDatagram(pair.impl) {
+		return utils.CopyDatagrams(dst, pair.impl.Reader())
+	}
+	return io.Copy(dst, pair.impl.Reader())
+}
+
+// deliver writes a message of the peer to the impl, framed again for
+// datagram impls
+func (pair *WebRTC) deliver(w io.Writer, b []byte) error {
+	if isDatagram(pair.impl) {
+		return utils.WriteDatagram(w, b)
+	}
+	_, err := w.Write(b)
+	return err
+}
+
+func (pair *WebRTC) observeICE(state webrtc.ICEConnectionState) {
+	switch state {
+	case webrtc.ICEConnectionStateConnected, webrtc.ICEConnectionStateFailed:
+		iceResults.With(state.String()).Inc()
+	}
+	events.publish(pair.event(types.EVENT_ICE_STATE, state.String()))
+	// a peer that went away without closing the data channel, like one
+	// whose pair was closed by proxy stop, leaves us here
+	if state == webrtc.ICEConnectionStateFailed {
+		go pair.Close()
+	}
+}
+
+// FillStatus adds the selected ICE candidate types and the round trip time
+func (pair *WebRTC) FillStatus(stat *types.Status) {
+	pair.BaseConnection.FillStatus(stat)
+	if pair.PeerConnection == nil {
+		return
+	}
+	report := pair.PeerConnection.GetStats()
+	for _, v := range report {
+		cp, ok := v.(webrtc.ICECandidatePairStats)
+		if !ok || !cp.Nominated || cp.State != webrtc.StatsICECandidatePairStateSucceeded {
+			continue
+		}
+		stat.RTT = time.Duration(cp.CurrentRoundTripTime * float64(time.Second))
+		if local, ok := report[cp.LocalCandidateID].(webrtc.ICECandidateStats); ok {
+			stat.LocalCandidate = local.CandidateType.String()
+		}
+		if remote, ok := report[cp.RemoteCandidateID].(webrtc.ICECandidateStats); ok {
+			stat.RemoteCandidate = remote.CandidateType.String()
+		}
+		return
+	}
+}
+
 func (pair *WebRTC) Close() {
 	if pair.PeerConnection != nil {
+		reason := "closed"
+		switch state := pair.PeerConnection.ICEConnectionState(); state {
+		case webrtc.ICEConnectionStateFailed, webrtc.ICEConnectionStateDisconnected:
+			reason = "ice " + state.String()
+		}
 		pair.PeerConnection.Close()
 		pair.impl.Close()
-		(*pair.stmChan) <- CleanRequest{pair.poolId.String(pair.Direction()), pair.Name()}
+		(*pair.stmChan) <- CleanRequest{pair.poolId.String(pair.Direction()), pair.Name(), reason}
 	}
 }
 
@@ -206,6 +369,7 @@ func (pair *WebRTC) Offer(target string, reType int32) (types.SignalingInfo, err
 		RemoteRequestType: reType,
 		Source:            pair.nodeId,
 		RemotePort:		   pair.BaseConnection.impl.GetRemotePort(),
+		RemoteAddr:        pair.BaseConnection.impl.GetRemoteAddr(),
 	}
 	return ret, nil
 }
@@ -0,0 +1,167 @@
+package conn
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// newChannelPair connects two in process peers and returns the data
+// channel of each side, onMessage handles messages of the answering side
+func newChannelPair(tb testing.TB, onMessage func(webrtc.DataChannelMessage)) (*webrtc.DataChannel, *webrtc.DataChannel) {
+	offerer, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	answerer, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() {
+		offerer.Close()
+		answerer.Close()
+	})
+	opened := make(chan *webrtc.DataChannel, 1)
+	answerer.OnDataChannel(func(dc *webrtc.DataChannel) {
+		dc.OnMessage(onMessage)
+		dc.OnOpen(func() {
+			opened <- dc
+		})
+	})
+	dc, err := offerer.CreateDataChannel("test", nil)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	ready := make(chan struct{})
+	dc.OnOpen(func() {
+		close(ready)
+	})
+
+	offer, err := offerer.CreateOffer(nil)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	gathered := webrtc.GatheringCompletePromise(offerer)
+	if err = offerer.SetLocalDescription(offer); err != nil {
+		tb.Fatal(err)
+	}
+	<-gathered
+	if err = answerer.SetRemoteDescription(*offerer.LocalDescription()); err != nil {
+		tb.Fatal(err)
+	}
+	answer, err := answerer.CreateAnswer(nil)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	gathered = webrtc.GatheringCompletePromise(answerer)
+	if err = answerer.SetLocalDescription(answer); err != nil {
+		tb.Fatal(err)
+	}
+	<-gathered
+	if err = offerer.SetRemoteDescription(*answerer.LocalDescription()); err != nil {
+		tb.Fatal(err)
+	}
+
+	timeout := time.After(10 * time.Second)
+	var remote *webrtc.DataChannel
+	select {
+	case remote = <-opened:
+	case <-timeout:
+		tb.Fatal("data channel of the answerer did not open")
+	}
+	select {
+	case <-ready:
+	case <-timeout:
+		tb.Fatal("data channel of the offerer did not open")
+	}
+	return dc, remote
+}
+
+func BenchmarkWrapperThroughput(b *testing.B) {
+	var received int64
+	done := make(chan struct{}, 1)
+	var want int64
+	dc, _ := newChannelPair(b, func(msg webrtc.DataChannelMessage) {
+		if atomic.AddInt64(&received, int64(len(msg.Data))) == atomic.LoadInt64(&want) {
+			done <- struct{}{}
+		}
+	})
+	w := NewWrapper(dc)
+	chunk := make([]byte, maxMessageSize)
+	atomic.StoreInt64(&want, int64(b.N*len(chunk)))
+	b.SetBytes(int64(len(chunk)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := w.Write(chunk); err != nil {
+			b.Fatal(err)
+		}
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Minute):
+		b.Fatalf("received %d of %d bytes", atomic.LoadInt64(&received), b.N*len(chunk))
+	}
+}
+
+func TestWrapperBackpressure(t *testing.T) {
+	// the receiver stalls, the window of the peer and then our send buffer
+	// fill up
+	release := make(chan struct{})
+	var received int64
+	dc, _ := newChannelPair(t, func(msg webrtc.DataChannelMessage) {
+		<-release
+		atomic.AddInt64(&received, int64(len(msg.Data)))
+	})
+	w := NewWrapper(dc)
+	const total = 16 * 1024 * 1024
+	written := make(chan error, 1)
+	go func() {
+		_, err := w.Write(make([]byte, total))
+		written <- err
+	}()
+
+	select {
+	case err := <-written:
+		t.Fatalf("write of %d bytes to a stalled peer returned %v", total, err)
+	case <-time.After(time.Second):
+	}
+	if n := dc.BufferedAmount(); n > bufferedAmountHigh+maxMessageSize {
+		t.Fatalf("%d bytes buffered, writers should block above %d", n, bufferedAmountHigh)
+	}
+
+	close(release)
+	select {
+	case err := <-written:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(30 * time.Second):
+		t.Fatalf("writer still blocked after the peer read %d bytes", atomic.LoadInt64(&received))
+	}
+}
+
+func TestWrapperClosedWakesWriter(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	dc, _ := newChannelPair(t, func(msg webrtc.DataChannelMessage) {
+		<-release
+	})
+	w := NewWrapper(dc)
+	written := make(chan error, 1)
+	go func() {
+		_, err := w.Write(make([]byte, 16*1024*1024))
+		written <- err
+	}()
+	time.Sleep(500 * time.Millisecond)
+	w.Closed()
+	select {
+	case err := <-written:
+		if err == nil {
+			t.Fatal("write after Closed succeeded")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Closed did not wake the blocked writer")
+	}
+}
@@ -7,6 +7,9 @@ import (
 	"net"
 	"net/http"
 	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/pion/webrtc/v3"
@@ -15,22 +18,134 @@ import (
 	"github.com/suutaku/sshx/pkg/types"
 )
 
+const (
+	// ask the signaling server again after this long if it issued no TURN credential
+	turnRetryInterval = 5 * time.Minute
+	// how often the node tells the signaling server it is online
+	announceInterval = 10 * time.Second
+	// the signaling loop is unhealthy without a successful pull for this long
+	pullTimeout = 30 * time.Second
+)
+
 type WebRTCService struct {
+	// unix nanoseconds of the last successful pull, first for 64 bit alignment
+	lastPull int64
 	BaseConnectionService
 	sigPull             chan types.SignalingInfo
 	sigPush             chan types.SignalingInfo
 	conf                webrtc.Configuration
 	signalingServerAddr string
+	turnLock            sync.Mutex
+	turnServer          *webrtc.ICEServer
+	turnRefresh         time.Time
+	// dtls certificate of every pair, callers prove their id with it
+	certificate *webrtc.Certificate
+	group       string
+	groupToken  string
+	// guards signalingServerAddr, group and groupToken which change on reload
+	addrLock sync.Mutex
 }
 
 func NewWebRTCService(id, signalingServerAddr string, conf webrtc.Configuration) *WebRTCService {
-	return &WebRTCService{
+	ret := &WebRTCService{
 		sigPull:               make(chan types.SignalingInfo, 128),
 		sigPush:               make(chan types.SignalingInfo, 128),
 		conf:                  conf,
 		signalingServerAddr:   signalingServerAddr,
 		BaseConnectionService: *NewBaseConnectionService(id),
 	}
+	ret.transport = transportWebRTC
+	return ret
+}
+
+func (wss *WebRTCService) Healthy() error {
+	last := time.Unix(0, atomic.LoadInt64(&wss.lastPull))
+	if time.Since(last) > pullTimeout {
+		return fmt.Errorf("no pull from %s succeeded for %s", wss.signalingServer(), pullTimeout)
+	}
+	return nil
+}
+
+// SetPresence sets the group the node is listed in on the signaling server
+func (wss *WebRTCService) SetPresence(group, token string) {
+	wss.addrLock.Lock()
+	defer wss.addrLock.Unlock()
+	wss.group = group
+	wss.groupToken = token
+}
+
+func (wss *WebRTCService) presence() (string, string) {
+	wss.addrLock.Lock()
+	defer wss.addrLock.Unlock()
+	return wss.group, wss.groupToken
+}
+
+// SetSignalingServer switches to another signaling server, the next pull,
+// push and announce go to addr
+func (wss *WebRTCService) SetSignalingServer(addr string) {
+	wss.addrLock.Lock()
+	wss.signalingServerAddr = addr
+	wss.addrLock.Unlock()
+	// credentials of the old server are useless
+	wss.turnLock.Lock()
+	wss.turnServer = nil
+	wss.turnRefresh = time.Time{}
+	wss.turnLock.Unlock()
+}
+
+func (wss *WebRTCService) signalingServer() string {
+	wss.addrLock.Lock()
+	defer wss.addrLock.Unlock()
+	return wss.signalingServerAddr
+}
+
+// SetRTCConf replaces the ICE servers used by pairs created from now on
+func (wss *WebRTCService) SetRTCConf(conf webrtc.Configuration) {
+	wss.turnLock.Lock()
+	defer wss.turnLock.Unlock()
+	wss.conf = conf
+}
+
+// SetCertificate makes pairs use the identity of the node instead of a
+// certificate of their own
+func (wss *WebRTCService) SetCertificate(cert webrtc.Certificate) {
+	wss.turnLock.Lock()
+	defer wss.turnLock.Unlock()
+	wss.certificate = &cert
+}
+
+func (wss *WebRTCService) announce() error {
+	group, token := wss.presence()
+	if group == "" {
+		// the server only keeps peers of a group
+		return nil
+	}
+	buf := bytes.NewBuffer(nil)
+	err := gob.NewEncoder(buf).Encode(types.PeerInfo{
+		ID:      wss.id,
+		Version: types.Version,
+		Apps:    impl.EnabledApps(wss.Profile()),
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, wss.signalingServer()+
+		path.Join("/", "announce", wss.id), buf)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/binary")
+	req.SetBasicAuth(group, token)
+	client := http.Client{Timeout: 5 * time.Second}
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("signaling server responded %s", res.Status)
+	}
+	return nil
 }
 
 func (wss *WebRTCService) Start() error {
@@ -41,6 +156,61 @@ func (wss *WebRTCService) Start() error {
 	return nil
 }
 
+func (wss *WebRTCService) fetchTurnCredential() (types.TurnCredential, error) {
+	var cred types.TurnCredential
+	req, err := http.NewRequest(http.MethodGet, wss.signalingServer()+
+		path.Join("/", "turn", wss.id), nil)
+	if err != nil {
+		return cred, err
+	}
+	if group, token := wss.presence(); group != "" {
+		req.SetBasicAuth(group, token)
+	}
+	client := http.Client{Timeout: 5 * time.Second}
+	res, err := client.Do(req)
+	if err != nil {
+		return cred, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return cred, fmt.Errorf("signaling server responded %s", res.Status)
+	}
+	err = gob.NewDecoder(res.Body).Decode(&cred)
+	return cred, err
+}
+
+// rtcConf returns the configured ICE servers plus a short lived TURN
+// credential issued by the signaling server, refreshed at half its lifetime
+func (wss *WebRTCService) rtcConf() webrtc.Configuration {
+	wss.turnLock.Lock()
+	defer wss.turnLock.Unlock()
+	if time.Now().After(wss.turnRefresh) {
+		cred, err := wss.fetchTurnCredential()
+		if err != nil {
+			logrus.Debug("no turn credential: ", err)
+			signalingErrors.With("turn").Inc()
+			wss.turnServer = nil
+			wss.turnRefresh = time.Now().Add(turnRetryInterval)
+		} else {
+			wss.turnServer = &webrtc.ICEServer{
+				URLs:           cred.URLs,
+				Username:       cred.Username,
+				Credential:     cred.Password,
+				CredentialType: webrtc.ICECredentialTypePassword,
+			}
+			wss.turnRefresh = time.Now().Add(time.Duration(cred.TTL) * time.Second / 2)
+		}
+	}
+	conf := wss.conf
+	if wss.turnServer != nil {
+		conf.ICEServers = append(append([]webrtc.ICEServer{}, wss.conf.ICEServers...), *wss.turnServer)
+	}
+	if wss.certificate != nil {
+		conf.Certificates = []webrtc.Certificate{*wss.certificate}
+	}
+	return conf
+}
+
 func (wss *WebRTCService) CreateConnection(sender *impl.Sender, sock net.Conn, poolId types.PoolId) error {
 	err := wss.BaseConnectionService.CreateConnection(sender, sock, poolId)
 	if err != nil {
@@ -54,10 +224,11 @@ func (wss *WebRTCService) CreateConnection(sender *impl.Sender, sock net.Conn, p
 		iface.SetConn(sock)
 	}
 
-	pair := NewWebRTC(wss.conf, iface, wss.id, iface.HostId(), poolId, CONNECTION_DRECT_OUT, &wss.CleanChan)
+	pair := NewWebRTC(wss.rtcConf(), iface, wss.id, iface.HostId(), poolId, CONNECTION_DRECT_OUT, &wss.CleanChan)
 	if pair == nil {
 		return fmt.Errorf("cannot create pair")
 	}
+	pair.SetShaper(wss.shaper)
 
 	err = pair.Dial()
 	if err != nil {
@@ -105,7 +276,7 @@ func (wss *WebRTCService) DestroyConnection(tmp *impl.Sender) error {
 		return fmt.Errorf("cannot get pair for %s", string(tmp.PairId))
 	}
 	if pair.GetImpl().Code() == tmp.GetAppCode() {
-		wss.RemovePair(CleanRequest{string(tmp.PairId), (&WebRTC{}).Name()})
+		wss.RemovePair(CleanRequest{string(tmp.PairId), pair.Name(), "down request"})
 	}
 	return nil
 }
@@ -145,11 +316,21 @@ func (wss *WebRTCService) ServeOfferInfo(info types.SignalingInfo) {
 		return
 	}
 	iface.SetHostId(info.Source)
+	iface.SetProfile(wss.profile)
+	// pion drops the pair if the dtls certificate of the caller does not
+	// match the fingerprint of its offer
+	iface.SetPeerKey(sdpFingerprint(info.SDP))
 	// set candidate pool id direction to out for self(server)
-	pair := NewWebRTC(wss.conf, iface, wss.id, info.Source, info.Id, CONNECTION_DRECT_IN, &wss.CleanChan)
+	pair := NewWebRTC(wss.rtcConf(), iface, wss.id, info.Source, info.Id, CONNECTION_DRECT_IN, &wss.CleanChan)
+	if pair == nil {
+		logrus.Error("cannot create pair")
+		return
+	}
+	pair.SetShaper(wss.shaper)
 	// set candidate pool id direction to out for client
 	logrus.Debug("WebRTC response. Set RemotePort: ", info.RemotePort)
 	pair.BaseConnection.impl.SetRemotePort(info.RemotePort)
+	pair.BaseConnection.impl.SetRemoteAddr(info.RemoteAddr)
 	err := pair.Response()
 	if err != nil {
 		logrus.Error(err)
@@ -181,19 +362,22 @@ func (wss *WebRTCService) ServePush(info types.SignalingInfo) {
 		logrus.Error(err)
 		return
 	}
-	resp, err := http.Post(wss.signalingServerAddr+
+	resp, err := http.Post(wss.signalingServer()+
 		path.Join("/", "push", info.Target), "application/binary", buf)
 	logrus.Debug("pushed ", info)
 
 	if err != nil {
 		logrus.Error(err)
+		signalingErrors.With("push").Inc()
 		return
 	}
+	resp.Body.Close()
 	if resp.StatusCode != http.StatusOK {
 		logrus.Errorln("push to ", info.Target, "faild")
+		signalingErrors.With("push").Inc()
 		return
 	}
-	logrus.Debug(wss.signalingServerAddr +
+	logrus.Debug(wss.signalingServer() +
 		path.Join("/", "push", info.Target))
 }
 
@@ -222,15 +406,34 @@ func (wss *WebRTCService) ServeAnwserInfo(info types.SignalingInfo) {
 
 func (wss *WebRTCService) ServeSignaling() {
 
+	// presence loop
+	go func() {
+		for wss.running {
+			if err := wss.announce(); err != nil {
+				logrus.Debug("announce failed: ", err)
+				signalingErrors.With("announce").Inc()
+			}
+			time.Sleep(announceInterval)
+		}
+	}()
+
 	// pull loop
 	go func() {
 		for wss.running {
-			res, err := http.Get(wss.signalingServerAddr +
+			res, err := http.Get(wss.signalingServer() +
 				path.Join("/", "pull", wss.id))
 			if err != nil {
+				signalingErrors.With("pull").Inc()
 				time.Sleep(1 * time.Second)
 				continue
 			}
+			if res.StatusCode != http.StatusOK {
+				signalingErrors.With("pull").Inc()
+				res.Body.Close()
+				time.Sleep(1 * time.Second)
+				continue
+			}
+			atomic.StoreInt64(&wss.lastPull, time.Now().UnixNano())
 			var info types.SignalingInfo
 			if err = gob.NewDecoder(res.Body).Decode(&info); err != nil {
 				if err != nil {
@@ -284,3 +487,19 @@ func (wss *WebRTCService) SignalCandidate(info types.SignalingInfo, target strin
 	}
 	wss.push(cadInfo)
 }
+
+// sdpFingerprint returns the dtls fingerprint of a session description,
+// like sha-256 AB:CD:...
+func sdpFingerprint(sdp string) string {
+	for _, line := range strings.Split(sdp, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "a=fingerprint:") {
+			fp := strings.Fields(strings.TrimPrefix(line, "a=fingerprint:"))
+			if len(fp) != 2 {
+				return ""
+			}
+			return strings.ToLower(fp[0]) + " " + strings.ToUpper(fp[1])
+		}
+	}
+	return ""
+}
@@ -0,0 +1,123 @@
+package metrics
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"math"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files")
+
+// golden compares got with testdata/name.golden
+func golden(t *testing.T, name string, got []byte) {
+	t.Helper()
+	file := filepath.Join("testdata", name+".golden")
+	if *update {
+		if err := ioutil.WriteFile(file, got, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("%s differs from %s:\n--- got\n%s--- want\n%s", name, file, got, want)
+	}
+}
+
+func TestExposition(t *testing.T) {
+	tests := []struct {
+		name  string
+		build func(r *Registry)
+	}{
+		{"counter", func(r *Registry) {
+			c := r.Counter("requests_total", "Requests by handler and code.", "handler", "code")
+			// written sorted by label values, not in creation order
+			c.With("push", "200").Add(3)
+			c.With("pull", "429").Inc()
+			c.With("pull", "200").Add(2)
+			r.Counter("empty_total", "Never incremented.")
+		}},
+		{"gauge", func(r *Registry) {
+			g := r.Gauge("queued", "Queued infos.", "type")
+			g.With("offer").Set(2)
+			g.With("answer").Inc()
+			g.With("answer").Dec()
+			r.Gauge("plain", "Without labels.").With().Set(1.5)
+			r.Gauge("special", "Special values.", "v").With("inf").Set(math.Inf(1))
+		}},
+		{"escaping", func(r *Registry) {
+			c := r.Counter("escaped_total", `Help with a \ backslash, "quotes" and a`+"\nnew line.", "path")
+			c.With(`C:\dir`).Inc()
+			c.With(`say "hi"`).Inc()
+			c.With("two\nlines").Inc()
+		}},
+		{"histogram", func(r *Registry) {
+			h := r.Histogram("duration_seconds", "Latencies.", []float64{.1, 1, 10}, "handler")
+			h.With("pull").Observe(.05)
+			h.With("pull").Observe(.5)
+			h.With("pull").Observe(20)
+			h.With("push").Observe(1)
+		}},
+		{"func", func(r *Registry) {
+			r.GaugeFunc("ids", "Tracked ids.", nil, func(emit func(float64, ...string)) {
+				emit(42)
+			})
+			r.CounterFunc("by_group_total", "By group.", []string{"group"}, func(emit func(float64, ...string)) {
+				emit(1, "home")
+				emit(2, `w"rk`)
+				// wrong label count, skipped
+				emit(3)
+			})
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewRegistry()
+			tt.build(r)
+			var buf bytes.Buffer
+			r.Write(&buf)
+			golden(t, tt.name, buf.Bytes())
+		})
+	}
+}
+
+func TestRegistrationOrder(t *testing.T) {
+	r := NewRegistry()
+	r.Gauge("b", "Second name, registered first.").With().Set(1)
+	r.Gauge("a", "First name, registered second.").With().Set(2)
+	var buf bytes.Buffer
+	r.Write(&buf)
+	want := "# HELP b Second name, registered first.\n# TYPE b gauge\nb 1\n" +
+		"# HELP a First name, registered second.\n# TYPE a gauge\na 2\n"
+	if buf.String() != want {
+		t.Fatalf("got\n%s\nwant\n%s", buf.String(), want)
+	}
+}
+
+func TestWrongLabelCount(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Fatal("With accepted a wrong number of labels")
+		}
+	}()
+	NewRegistry().Counter("c_total", "C.", "a", "b").With("only one")
+}
+
+func TestHandler(t *testing.T) {
+	r := NewRegistry()
+	r.Counter("c_total", "C.").With().Inc()
+	rec := httptest.NewRecorder()
+	r.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := rec.Header().Get("Content-Type"); ct != "text/plain; version=0.0.4" {
+		t.Fatalf("content type %q", ct)
+	}
+	if want := "# HELP c_total C.\n# TYPE c_total counter\nc_total 1\n"; rec.Body.String() != want {
+		t.Fatalf("got %q, want %q", rec.Body.String(), want)
+	}
+}
@@ -0,0 +1,41 @@
+package node
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/sirupsen/logrus"
+	"github.com/suutaku/sshx/internal/conn"
+)
+
+func (node *Node) serveMetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", conn.MetricsHandler())
+	mux.HandleFunc("/healthz", node.healthz)
+	logrus.Info("metrics listening on ", addr)
+	logrus.Error(http.ListenAndServe(addr, mux))
+}
+
+// healthz answers 503 if any connection service is not working
+func (node *Node) healthz(w http.ResponseWriter, r *http.Request) {
+	health := node.connMgr.Health()
+	names := make([]string, 0, len(health))
+	for k := range health {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	status := http.StatusOK
+	body := ""
+	for _, name := range names {
+		if health[name] != nil {
+			status = http.StatusServiceUnavailable
+			body += fmt.Sprintf("%s: %v\n", name, health[name])
+		} else {
+			body += fmt.Sprintf("%s: ok\n", name)
+		}
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.WriteHeader(status)
+	w.Write([]byte(body))
+}
@@ -1,35 +1,173 @@
 package node
 
 import (
+	"fmt"
+	"net"
+	"reflect"
+
+	"github.com/sirupsen/logrus"
 	"github.com/suutaku/sshx/internal/conn"
+	"github.com/suutaku/sshx/internal/qos"
 	"github.com/suutaku/sshx/pkg/conf"
+	"github.com/suutaku/sshx/pkg/impl"
 )
 
 type Node struct {
 	confManager *conf.ConfManager
 	running     bool
 	connMgr     *conn.ConnectionManager
+	// by profile, the default one is ""
+	wss      map[string]*conn.WebRTCService
+	ds       *conn.DirectService
+	listener net.Listener
+	tunnels  *tunnels
+}
+
+func newWebRTCService(c conf.Configure, profile string) *conn.WebRTCService {
+	wss := conn.NewWebRTCService(c.ID, c.SignalingServerAddr, c.RTCConf)
+	wss.SetPresence(c.Presence.Group, c.Presence.Token)
+	wss.SetProfile(profile)
+	return wss
 }
 
-func NewNode(home string) *Node {
-	cm := conf.NewConfManager(home)
+func NewNode(home string) (*Node, error) {
+	cm, err := conf.NewConfManager(home)
+	if err != nil {
+		return nil, err
+	}
+	cur := cm.Current()
+	cert, err := conf.LoadIdentity(home)
+	if err != nil {
+		return nil, fmt.Errorf("cannot load node identity: %v", err)
+	}
+	ds := conn.NewDirectService(cur.ID, cur.DirectPort)
 	enabledService := []conn.ConnectionService{
-		conn.NewDirectService(cm.Conf.ID),
-		conn.NewWebRTCService(cm.Conf.ID, cm.Conf.SignalingServerAddr, cm.Conf.RTCConf),
+		ds,
+	}
+	wss := make(map[string]*conn.WebRTCService)
+	for _, name := range append([]string{""}, cur.ProfileNames()...) {
+		c, err := cur.Profile(name)
+		if err != nil {
+			logrus.Error(err)
+			continue
+		}
+		if name != "" {
+			logrus.Info("join profile ", name, " as ", c.ID, " at ", c.SignalingServerAddr)
+		}
+		wss[name] = newWebRTCService(c, name)
+		wss[name].SetCertificate(cert)
+		enabledService = append(enabledService, wss[name])
 	}
-	return &Node{
+	ret := &Node{
 		confManager: cm,
-		connMgr:     conn.NewConnectionManager(enabledService),
+		connMgr:     conn.NewConnectionManager(enabledService, newShaper(cur.Limit)),
+		wss:         wss,
+		ds:          ds,
+	}
+	ret.tunnels = newTunnels(ret)
+	impl.SetConfManager(cm)
+	cm.OnChange(ret.applyConf)
+	cm.Watch()
+	return ret, nil
+}
+
+// applyConf brings the running node in line with a changed configure
+func (node *Node) applyConf(old, new conf.Configure) {
+	for name, wss := range node.wss {
+		oc, _ := old.Profile(name)
+		nc, err := new.Profile(name)
+		if err != nil {
+			logrus.Warn("profile ", name, " removed, restart the daemon to leave it")
+			continue
+		}
+		applyWebRTC(wss, name, oc, nc)
+	}
+	for _, name := range new.ProfileNames() {
+		if _, ok := node.wss[name]; !ok {
+			logrus.Warn("profile ", name, " added, restart the daemon to join it")
+		}
+	}
+	if new.DirectPort != old.DirectPort {
+		node.ds.SetPort(new.DirectPort)
+	}
+	if !reflect.DeepEqual(new.Tunnels, old.Tunnels) {
+		node.tunnels.apply(new.Tunnels)
+	}
+	// acl and transfer settings are read when a peer calls
+	restart := map[string]bool{
+		"localtcpport":  new.LocalTCPPort != old.LocalTCPPort,
+		"controlsocket": new.ControlSocket != old.ControlSocket,
+		"metricsaddr":   new.MetricsAddr != old.MetricsAddr,
+		"limit":         !reflect.DeepEqual(new.Limit, old.Limit),
+	}
+	for k, v := range restart {
+		if v {
+			logrus.Warn(k, " changed, restart the daemon to apply it")
+		}
 	}
 }
 
+// applyWebRTC moves the service of a profile to its new values
+func applyWebRTC(wss *conn.WebRTCService, profile string, old, new conf.Configure) {
+	prefix := ""
+	if profile != "" {
+		prefix = "profile " + profile + ": "
+	}
+	if new.SignalingServerAddr != old.SignalingServerAddr {
+		logrus.Info(prefix, "switch signaling server to ", new.SignalingServerAddr)
+		wss.SetSignalingServer(new.SignalingServerAddr)
+	}
+	if !reflect.DeepEqual(new.RTCConf, old.RTCConf) {
+		logrus.Info(prefix, "new ice servers apply to new pairs")
+		wss.SetRTCConf(new.RTCConf)
+	}
+	if new.Presence != old.Presence {
+		wss.SetPresence(new.Presence.Group, new.Presence.Token)
+	}
+	if new.ID != old.ID {
+		logrus.Warn(prefix, "id changed, restart the daemon to apply it")
+	}
+}
+
+func newShaper(lc conf.LimitConf) *qos.Shaper {
+	global, err := qos.ParseRate(lc.Global)
+	if err != nil {
+		logrus.Error("ignore global limit: ", err)
+	}
+	apps := make(map[int32]int64)
+	for k, v := range lc.Apps {
+		code, ok := impl.GetImplCode(k)
+		if !ok {
+			logrus.Error("ignore limit for unknown application ", k)
+			continue
+		}
+		rate, err := qos.ParseRate(v)
+		if err != nil {
+			logrus.Error("ignore limit for ", k, ": ", err)
+			continue
+		}
+		apps[code] = rate
+	}
+	return qos.NewShaper(global, apps)
+}
+
 func (node *Node) Start() {
 	node.running = true
 	go node.connMgr.Start()
+	c := node.confManager.Current()
+	node.tunnels.apply(c.Tunnels)
+	if c.MetricsAddr != "" {
+		go node.serveMetrics(c.MetricsAddr)
+	}
 	node.ServeTCP()
 }
 
 func (node *Node) Stop() {
 	node.running = false
+	if node.listener != nil {
+		// removes the socket file too
+		node.listener.Close()
+	}
+	node.tunnels.stop()
 	node.connMgr.Stop()
 }
@@ -4,6 +4,8 @@ import (
 	"encoding/gob"
 	"fmt"
 	"net"
+	"os"
+	"path/filepath"
 	"time"
 
 	"github.com/sirupsen/logrus"
@@ -11,16 +13,90 @@ import (
 	"github.com/suutaku/sshx/pkg/types"
 )
 
+// reload applies the configure file and tells the caller what went wrong,
+// the caller sends an empty message first like for status
+func (node *Node) reload(sender *impl.Sender, sock net.Conn) {
+	defer sock.Close()
+	err := gob.NewEncoder(sock).Encode(sender)
+	if err != nil {
+		logrus.Error(err)
+		return
+	}
+	var msg string
+	err = gob.NewDecoder(sock).Decode(&msg)
+	if err != nil {
+		logrus.Error(err)
+		return
+	}
+	err = node.confManager.Reload()
+	if err != nil {
+		logrus.Error("ignore configuration reload: ", err)
+		msg = err.Error()
+	}
+	err = gob.NewEncoder(sock).Encode(msg)
+	if err != nil {
+		logrus.Error(err)
+	}
+}
+
+// listenSocket listens on the control socket, a socket file left by a
+// daemon that died is replaced, a live one is not
+func (node *Node) listenSocket() (net.Listener, error) {
+	file := node.confManager.SocketPath()
+	if _, err := os.Stat(file); err == nil {
+		c, err := net.Dial("unix", file)
+		if err == nil {
+			c.Close()
+			return nil, fmt.Errorf("another daemon listens on %s", file)
+		}
+		os.Remove(file)
+	}
+	err := os.MkdirAll(filepath.Dir(file), 0700)
+	if err != nil {
+		return nil, err
+	}
+	listener, err := net.Listen("unix", file)
+	if err != nil {
+		return nil, err
+	}
+	// only the owner may command the daemon
+	err = os.Chmod(file, 0600)
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// ServeTCP takes local commands on the control socket and, if a port is
+// set, on the loopback port
 func (node *Node) ServeTCP() {
-	listenner, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", node.confManager.Conf.LocalTCPPort))
+	listener, err := node.listenSocket()
 	if err != nil {
 		logrus.Error(err)
 		panic(err)
 	}
-	defer listenner.Close()
+	node.listener = listener
+	logrus.Info("control socket at ", listener.Addr())
+	if port := node.confManager.Current().LocalTCPPort; port != 0 {
+		listenner, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+		if err != nil {
+			logrus.Error(err)
+			panic(err)
+		}
+		defer listenner.Close()
+		go node.serve(listenner)
+	}
+	node.serve(listener)
+}
+
+func (node *Node) serve(listenner net.Listener) {
 	for node.running {
 		sock, err := listenner.Accept()
 		if err != nil {
+			if !node.running {
+				return
+			}
 			logrus.Error(err)
 			continue
 		}
@@ -50,6 +126,7 @@ func (node *Node) ServeTCP() {
 			logrus.Debug("down option ", string(tmp.PairId))
 			err := node.connMgr.DestroyConnection(&tmp, sock)
 			if err != nil {
+				sock.Close()
 				logrus.Error(err)
 			}
 
@@ -60,6 +137,19 @@ func (node *Node) ServeTCP() {
 				sock.Close()
 				logrus.Error(err)
 			}
+		case types.OPTION_TYPE_SUBSCRIBE:
+			logrus.Debug("subscribe option")
+			err := node.connMgr.Subscribe(tmp, sock)
+			if err != nil {
+				sock.Close()
+				logrus.Error(err)
+			}
+		case types.OPTION_TYPE_RELOAD:
+			logrus.Debug("reload option")
+			node.reload(&tmp, sock)
+		case types.OPTION_TYPE_TUNNELS:
+			logrus.Debug("tunnels option")
+			node.serveTunnels(&tmp, sock)
 		case types.OPTION_TYPE_ATTACH:
 			logrus.Debug("attach option")
 			err := node.connMgr.AttachConnection(&tmp, sock)
@@ -0,0 +1,254 @@
+package node
+
+import (
+	"encoding/gob"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/suutaku/sshx/internal/utils"
+	"github.com/suutaku/sshx/pkg/conf"
+	"github.com/suutaku/sshx/pkg/impl"
+	"github.com/suutaku/sshx/pkg/types"
+)
+
+const (
+	// wait before listening again after a failure, doubled up to the max
+	tunnelMinBackoff = time.Second
+	tunnelMaxBackoff = time.Minute
+)
+
+// tunnel keeps a local listener up and forwards its connections to a peer
+type tunnel struct {
+	name     string
+	conf     conf.TunnelConf
+	node     *Node
+	stop     chan struct{}
+	lock     sync.Mutex
+	listener net.Listener
+	lastErr  string
+	restarts int64
+	active   int64
+	total    int64
+}
+
+func (t *tunnel) setListener(l net.Listener, err error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.listener = l
+	if err != nil {
+		t.lastErr = err.Error()
+	} else if l != nil {
+		t.lastErr = ""
+	}
+}
+
+func (t *tunnel) setError(err error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.lastErr = err.Error()
+}
+
+func (t *tunnel) stopped() bool {
+	select {
+	case <-t.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// run listens until the tunnel is stopped, a broken listener is opened
+// again after a growing pause
+func (t *tunnel) run() {
+	backoff := tunnelMinBackoff
+	for {
+		l, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", t.conf.LocalPort))
+		t.setListener(l, err)
+		if err == nil {
+			logrus.Info("tunnel ", t.name, " listening on 127.0.0.1:", t.conf.LocalPort)
+			started := time.Now()
+			err = t.serve(l)
+			t.setListener(nil, nil)
+			if t.stopped() {
+				return
+			}
+			t.setError(err)
+			// a listener that worked for a while starts over
+			if time.Since(started) > tunnelMaxBackoff {
+				backoff = tunnelMinBackoff
+			}
+		}
+		logrus.Error("tunnel ", t.name, ": ", err, ", retry in ", backoff)
+		select {
+		case <-t.stop:
+			return
+		case <-time.After(backoff):
+		}
+		atomic.AddInt64(&t.restarts, 1)
+		backoff *= 2
+		if backoff > tunnelMaxBackoff {
+			backoff = tunnelMaxBackoff
+		}
+	}
+}
+
+func (t *tunnel) serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go t.forward(conn)
+	}
+}
+
+// forward creates a proxy pair to the peer like sshx proxy start does
+func (t *tunnel) forward(inconn net.Conn) {
+	defer inconn.Close()
+	atomic.AddInt64(&t.active, 1)
+	atomic.AddInt64(&t.total, 1)
+	defer atomic.AddInt64(&t.active, -1)
+	host, _ := t.node.confManager.Current().ResolveHost(t.conf.Host)
+	imp := &impl.ProxyService{
+		BaseImpl: impl.BaseImpl{
+			HId:        host.ID,
+			ConnectNow: true,
+			Transport:  host.Transport,
+		},
+		RemotePort: t.conf.RemotePort,
+	}
+	sender := impl.NewSender(imp, types.OPTION_TYPE_UP)
+	if sender == nil {
+		return
+	}
+	sender.Profile = t.conf.Profile
+	s, err := t.node.connMgr.Dial(sender)
+	if err != nil {
+		t.setError(fmt.Errorf("cannot reach %s: %v", t.conf.Host, err))
+		logrus.Error("tunnel ", t.name, ": ", err)
+		return
+	}
+	utils.Pipe(&inconn, &s)
+}
+
+func (t *tunnel) close() {
+	close(t.stop)
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.listener != nil {
+		t.listener.Close()
+	}
+}
+
+func (t *tunnel) status() types.TunnelStatus {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return types.TunnelStatus{
+		Name:       t.name,
+		LocalPort:  t.conf.LocalPort,
+		Host:       t.conf.Host,
+		RemotePort: t.conf.RemotePort,
+		Profile:    t.conf.Profile,
+		Enabled:    true,
+		Listening:  t.listener != nil,
+		Error:      t.lastErr,
+		Restarts:   atomic.LoadInt64(&t.restarts),
+		Active:     atomic.LoadInt64(&t.active),
+		Total:      atomic.LoadInt64(&t.total),
+	}
+}
+
+// tunnels runs the enabled tunnels of the configure
+type tunnels struct {
+	node    *Node
+	lock    sync.Mutex
+	running map[string]*tunnel
+}
+
+func newTunnels(node *Node) *tunnels {
+	return &tunnels{
+		node:    node,
+		running: make(map[string]*tunnel),
+	}
+}
+
+// apply starts and stops tunnels to match c, changed tunnels start over
+func (ts *tunnels) apply(c map[string]conf.TunnelConf) {
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+	for name, t := range ts.running {
+		if v, ok := c[name]; !ok || v.Disabled || v != t.conf {
+			logrus.Info("stop tunnel ", name)
+			t.close()
+			delete(ts.running, name)
+		}
+	}
+	for name, v := range c {
+		if _, ok := ts.running[name]; ok || v.Disabled {
+			continue
+		}
+		t := &tunnel{
+			name: name,
+			conf: v,
+			node: ts.node,
+			stop: make(chan struct{}),
+		}
+		ts.running[name] = t
+		go t.run()
+	}
+}
+
+func (ts *tunnels) stop() {
+	ts.apply(nil)
+}
+
+// status lists every configured tunnel, disabled ones too
+func (ts *tunnels) status(c map[string]conf.TunnelConf) []types.TunnelStatus {
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+	ret := make([]types.TunnelStatus, 0, len(c))
+	for name, v := range c {
+		if t, ok := ts.running[name]; ok {
+			ret = append(ret, t.status())
+			continue
+		}
+		ret = append(ret, types.TunnelStatus{
+			Name:       name,
+			LocalPort:  v.LocalPort,
+			Host:       v.Host,
+			RemotePort: v.RemotePort,
+			Profile:    v.Profile,
+			Enabled:    !v.Disabled,
+		})
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Name < ret[j].Name
+	})
+	return ret
+}
+
+// serveTunnels answers a tunnels request, the caller sends an empty
+// message first like for status
+func (node *Node) serveTunnels(sender *impl.Sender, sock net.Conn) {
+	defer sock.Close()
+	err := gob.NewEncoder(sock).Encode(sender)
+	if err != nil {
+		logrus.Error(err)
+		return
+	}
+	var msg string
+	err = gob.NewDecoder(sock).Decode(&msg)
+	if err != nil {
+		logrus.Error(err)
+		return
+	}
+	err = gob.NewEncoder(sock).Encode(node.tunnels.status(node.confManager.Current().Tunnels))
+	if err != nil {
+		logrus.Error(err)
+	}
+}
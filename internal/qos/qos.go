@@ -0,0 +1,205 @@
+package qos
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// writes are split into pieces so interactive traffic can interleave
+	pieceSize = 16 * 1024
+	// bulk traffic backs off while interactive traffic to the same peer was
+	// seen within this window
+	interactiveWindow = 200 * time.Millisecond
+	yieldDelay        = 2 * time.Millisecond
+)
+
+// Bucket is a token bucket counting bytes
+type Bucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// NewBucket creates a bucket of rate bytes per second, nil for no limit
+func NewBucket(rate int64) *Bucket {
+	if rate <= 0 {
+		return nil
+	}
+	burst := float64(rate) / 10
+	if burst < pieceSize {
+		burst = pieceSize
+	}
+	return &Bucket{
+		rate:   float64(rate),
+		burst:  burst,
+		tokens: burst,
+		last:   time.Now(),
+	}
+}
+
+// NewBucketWithBurst creates a bucket of rate units per second which allows
+// bursts of up to burst units, nil for no limit
+func NewBucketWithBurst(rate, burst int64) *Bucket {
+	if rate <= 0 {
+		return nil
+	}
+	return &Bucket{
+		rate:   float64(rate),
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+func (b *Bucket) refill(now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+}
+
+// Allow takes n units if they are available, without blocking
+func (b *Bucket) Allow(n int) bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(time.Now())
+	if b.tokens < float64(n) {
+		return false
+	}
+	b.tokens -= float64(n)
+	return true
+}
+
+// Wait blocks until n bytes may pass
+func (b *Bucket) Wait(n int) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	b.refill(time.Now())
+	// tokens may go negative, the caller sleeps off the debt
+	b.tokens -= float64(n)
+	var wait time.Duration
+	if b.tokens < 0 {
+		wait = time.Duration(-b.tokens / b.rate * float64(time.Second))
+	}
+	b.mu.Unlock()
+	time.Sleep(wait)
+}
+
+// Shaper applies node wide and per application rate limits, and gives
+// interactive traffic priority over bulk traffic to the same peer
+type Shaper struct {
+	global *Bucket
+	apps   map[int32]*Bucket
+	lock   sync.Mutex
+	active map[string]time.Time
+}
+
+func NewShaper(global int64, apps map[int32]int64) *Shaper {
+	ret := &Shaper{
+		global: NewBucket(global),
+		apps:   make(map[int32]*Bucket),
+		active: make(map[string]time.Time),
+	}
+	for k, v := range apps {
+		ret.apps[k] = NewBucket(v)
+	}
+	return ret
+}
+
+func (s *Shaper) touch(peer string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.active[peer] = time.Now()
+}
+
+func (s *Shaper) yield(peer string) {
+	s.lock.Lock()
+	last, ok := s.active[peer]
+	s.lock.Unlock()
+	if ok && time.Since(last) < interactiveWindow {
+		time.Sleep(yieldDelay)
+	}
+}
+
+// Writer shapes writes to w for a pair of application app to peer. limit
+// is an extra per pair rate, 0 for none.
+func (s *Shaper) Writer(w io.Writer, peer string, app int32, limit int64, interactive bool) io.Writer {
+	return &shapedWriter{
+		w:           w,
+		shaper:      s,
+		peer:        peer,
+		interactive: interactive,
+		buckets:     []*Bucket{s.global, s.apps[app], NewBucket(limit)},
+	}
+}
+
+type shapedWriter struct {
+	w           io.Writer
+	shaper      *Shaper
+	peer        string
+	interactive bool
+	buckets     []*Bucket
+}
+
+func (sw *shapedWriter) Write(b []byte) (int, error) {
+	written := 0
+	for len(b) > 0 {
+		n := len(b)
+		if n > pieceSize {
+			n = pieceSize
+		}
+		if sw.interactive {
+			sw.shaper.touch(sw.peer)
+		} else {
+			sw.shaper.yield(sw.peer)
+		}
+		for _, v := range sw.buckets {
+			v.Wait(n)
+		}
+		m, err := sw.w.Write(b[:n])
+		written += m
+		if err != nil {
+			return written, err
+		}
+		b = b[n:]
+	}
+	return written, nil
+}
+
+// ParseRate parses a rate in bytes per second like "512K" or "5M"
+func ParseRate(input string) (int64, error) {
+	str := strings.ToUpper(strings.TrimSpace(input))
+	if str == "" {
+		return 0, nil
+	}
+	unit := int64(1)
+	switch str[len(str)-1] {
+	case 'K':
+		unit = 1 << 10
+	case 'M':
+		unit = 1 << 20
+	case 'G':
+		unit = 1 << 30
+	}
+	if unit > 1 {
+		str = str[:len(str)-1]
+	}
+	v, err := strconv.ParseFloat(str, 64)
+	if err != nil || v < 0 {
+		return 0, fmt.Errorf("invalid rate %q", input)
+	}
+	return int64(v * float64(unit)), nil
+}
@@ -0,0 +1,119 @@
+package qos
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestParseRate(t *testing.T) {
+	tests := []struct {
+		input string
+		want  int64
+		err   bool
+	}{
+		{"", 0, false},
+		{"  ", 0, false},
+		{"100", 100, false},
+		{"512K", 512 << 10, false},
+		{"512k", 512 << 10, false},
+		{"1.5M", 3 << 19, false},
+		{"2G", 2 << 30, false},
+		{" 5M ", 5 << 20, false},
+		{"0", 0, false},
+		{"-1", 0, true},
+		{"M", 0, true},
+		{"fast", 0, true},
+		{"5MB", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseRate(tt.input)
+		if (err != nil) != tt.err {
+			t.Errorf("ParseRate(%q): err %v, want error %v", tt.input, err, tt.err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseRate(%q) = %d, want %d", tt.input, got, tt.want)
+		}
+	}
+}
+
+func TestNilBucket(t *testing.T) {
+	for _, b := range []*Bucket{NewBucket(0), NewBucket(-1), NewBucketWithBurst(0, 10)} {
+		if b != nil {
+			t.Fatalf("got a bucket %+v for no limit", b)
+		}
+		// a nil bucket never limits
+		if !b.Allow(1 << 30) {
+			t.Fatal("nil bucket refused")
+		}
+		b.Wait(1 << 30)
+	}
+}
+
+func TestBucketAllow(t *testing.T) {
+	b := NewBucketWithBurst(10, 3)
+	for i := 0; i < 3; i++ {
+		if !b.Allow(1) {
+			t.Fatalf("take %d of the burst refused", i)
+		}
+	}
+	if b.Allow(1) {
+		t.Fatal("take beyond the burst allowed")
+	}
+	time.Sleep(150 * time.Millisecond)
+	if !b.Allow(1) {
+		t.Fatal("take after a refill refused")
+	}
+	// refills never exceed the burst
+	time.Sleep(time.Second)
+	if b.Allow(4) {
+		t.Fatal("take of more than the burst allowed")
+	}
+}
+
+func TestBucketWait(t *testing.T) {
+	const rate = 64 * 1024
+	b := NewBucket(rate)
+	start := time.Now()
+	// the burst passes at once, the rest at rate
+	b.Wait(pieceSize)
+	for i := 0; i < 4; i++ {
+		b.Wait(rate / 8)
+	}
+	elapsed := time.Since(start)
+	if elapsed < 400*time.Millisecond || elapsed > 2*time.Second {
+		t.Fatalf("half a second of traffic took %v", elapsed)
+	}
+}
+
+func TestShaperWriter(t *testing.T) {
+	const rate = 256 * 1024
+	s := NewShaper(0, map[int32]int64{1: rate})
+	tests := []struct {
+		name string
+		app  int32
+		min  time.Duration
+	}{
+		{"unlimited app", 2, 0},
+		{"limited app", 1, 400 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			w := s.Writer(&buf, "peer", tt.app, 0, false)
+			data := bytes.Repeat([]byte{'x'}, rate/2+pieceSize)
+			start := time.Now()
+			n, err := w.Write(data)
+			if err != nil || n != len(data) {
+				t.Fatalf("wrote %d of %d bytes: %v", n, len(data), err)
+			}
+			if !bytes.Equal(buf.Bytes(), data) {
+				t.Fatal("written bytes differ")
+			}
+			if elapsed := time.Since(start); elapsed < tt.min || elapsed > tt.min+time.Second {
+				t.Fatalf("write took %v, want about %v", elapsed, tt.min)
+			}
+		})
+	}
+}
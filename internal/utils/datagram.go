@@ -0,0 +1,65 @@
+package utils
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// MaxDatagramSize is the largest datagram carried, it has to pass the
+// shaper and a data channel in one piece
+const MaxDatagramSize = 16 * 1024
+
+var ErrDatagramTooLarge = errors.New("datagram too large")
+
+// WriteDatagram writes b behind its two byte length in a single write
+func WriteDatagram(w io.Writer, b []byte) error {
+	if len(b) > MaxDatagramSize {
+		return ErrDatagramTooLarge
+	}
+	frame := make([]byte, 2+len(b))
+	binary.BigEndian.PutUint16(frame, uint16(len(b)))
+	copy(frame[2:], b)
+	_, err := w.Write(frame)
+	return err
+}
+
+// ReadDatagram reads a datagram written by WriteDatagram into buf
+func ReadDatagram(r io.Reader, buf []byte) ([]byte, error) {
+	var head [2]byte
+	_, err := io.ReadFull(r, head[:])
+	if err != nil {
+		return nil, err
+	}
+	n := int(binary.BigEndian.Uint16(head[:]))
+	if n > len(buf) {
+		return nil, fmt.Errorf("datagram of %d bytes does not fit %d", n, len(buf))
+	}
+	_, err = io.ReadFull(r, buf[:n])
+	if err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+// CopyDatagrams writes every datagram of src to dst without its length,
+// one write each
+func CopyDatagrams(dst io.Writer, src io.Reader) (int64, error) {
+	buf := make([]byte, MaxDatagramSize)
+	var written int64
+	for {
+		b, err := ReadDatagram(src, buf)
+		if err != nil {
+			if err == io.EOF {
+				err = nil
+			}
+			return written, err
+		}
+		n, err := dst.Write(b)
+		written += int64(n)
+		if err != nil {
+			return written, err
+		}
+	}
+}
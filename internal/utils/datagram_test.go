@@ -0,0 +1,107 @@
+package utils
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestDatagramFraming(t *testing.T) {
+	tests := []struct {
+		name string
+		in   []byte
+		err  error
+	}{
+		{"empty", []byte{}, nil},
+		{"small", []byte("hello"), nil},
+		{"largest", bytes.Repeat([]byte{1}, MaxDatagramSize), nil},
+		{"too large", bytes.Repeat([]byte{1}, MaxDatagramSize+1), ErrDatagramTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			err := WriteDatagram(&buf, tt.in)
+			if err != tt.err {
+				t.Fatalf("write: got %v, want %v", err, tt.err)
+			}
+			if err != nil {
+				if buf.Len() != 0 {
+					t.Fatalf("%d bytes written for a refused datagram", buf.Len())
+				}
+				return
+			}
+			if buf.Len() != 2+len(tt.in) {
+				t.Fatalf("frame of %d bytes, want %d", buf.Len(), 2+len(tt.in))
+			}
+			got, err := ReadDatagram(&buf, make([]byte, MaxDatagramSize))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, tt.in) {
+				t.Fatal("datagram changed on the way")
+			}
+		})
+	}
+}
+
+func TestReadDatagramErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		input []byte
+		size  int
+		want  error
+	}{
+		{"eof", nil, 16, io.EOF},
+		{"short head", []byte{0}, 16, io.ErrUnexpectedEOF},
+		{"short body", []byte{0, 4, 'a'}, 16, io.ErrUnexpectedEOF},
+		{"does not fit", []byte{0, 4, 'a', 'b', 'c', 'd'}, 2, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ReadDatagram(bytes.NewReader(tt.input), make([]byte, tt.size))
+			if err == nil {
+				t.Fatal("no error")
+			}
+			if tt.want != nil && err != tt.want {
+				t.Fatalf("got %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+// oneWrite records the size of every write
+type oneWrite struct {
+	sizes []int
+	bytes.Buffer
+}
+
+func (ow *oneWrite) Write(b []byte) (int, error) {
+	ow.sizes = append(ow.sizes, len(b))
+	return ow.Buffer.Write(b)
+}
+
+func TestCopyDatagrams(t *testing.T) {
+	var src bytes.Buffer
+	datagrams := []string{"a", "", "bcd", "efgh"}
+	for _, v := range datagrams {
+		WriteDatagram(&src, []byte(v))
+	}
+	var dst oneWrite
+	n, err := CopyDatagrams(&dst, &src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 8 || dst.String() != "abcdefgh" {
+		t.Fatalf("copied %d bytes %q", n, dst.String())
+	}
+	// boundaries are kept, one write per datagram
+	want := []int{1, 0, 3, 4}
+	if len(dst.sizes) != len(want) {
+		t.Fatalf("writes %v, want %v", dst.sizes, want)
+	}
+	for i := range want {
+		if dst.sizes[i] != want[i] {
+			t.Fatalf("writes %v, want %v", dst.sizes, want)
+		}
+	}
+}
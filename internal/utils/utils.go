@@ -8,6 +8,7 @@ import (
 	"io"
 	"net"
 	"os"
+	"path/filepath"
 	"strings"
 	"sync"
 
@@ -91,12 +92,41 @@ func DebugOn() bool {
 	return false
 }
 
+// home of the system wide daemon
+const SystemHome = "/etc/sshx"
+
+// UserHome is the home of a per-user daemon, $XDG_CONFIG_HOME/sshx
+func UserHome() string {
+	base := os.Getenv("XDG_CONFIG_HOME")
+	if base == "" {
+		dir, err := os.UserHomeDir()
+		if err != nil {
+			return ""
+		}
+		base = filepath.Join(dir, ".config")
+	}
+	return filepath.Join(base, "sshx")
+}
+
+// GetSSHXHome picks the configure directory: SSHX_HOME if set, the system
+// home for root, otherwise the user home unless the user has none and can
+// read the system configure
 func GetSSHXHome() string {
-	home := os.Getenv("SSHX_HOME")
-	if home == "" {
-		home = "/etc/sshx"
+	if home := os.Getenv("SSHX_HOME"); home != "" {
+		return home
+	}
+	user := UserHome()
+	if os.Geteuid() == 0 || user == "" {
+		return SystemHome
+	}
+	if _, err := os.Stat(filepath.Join(user, ".sshx_config.json")); err == nil {
+		return user
+	}
+	if f, err := os.Open(filepath.Join(SystemHome, ".sshx_config.json")); err == nil {
+		f.Close()
+		return SystemHome
 	}
-	return home
+	return user
 }
 
 func GetLocalIP() string {
@@ -5,9 +5,15 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"os"
 	"path"
+	"reflect"
+	"runtime"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/fsnotify/fsnotify"
@@ -16,9 +22,123 @@ import (
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
 	"github.com/suutaku/sshx/internal/utils"
+	"golang.org/x/term"
 )
 
+// policies for files pushed by peers
+const (
+	TRANSFER_POLICY_ACCEPT = "accept"
+	TRANSFER_POLICY_ASK    = "ask"
+	TRANSFER_POLICY_REJECT = "reject"
+)
+
+type TransferConf struct {
+	// directory received files are written to, empty for $HOME/Downloads
+	InboxDir string
+	// local paths peers are allowed to download, nothing is exported if empty
+	ExportedRoots []string
+	// accept, ask or reject inbound files, empty asks when someone can
+	// answer and rejects otherwise
+	Policy string
+	// maximum bytes the inbox may hold, 0 for no limit
+	Quota int64
+}
+
+type LimitConf struct {
+	// rate for all traffic of the node, like "10M" bytes per second
+	Global string
+	// rates per application type name, like {"transfer": "5M"}
+	Apps map[string]string
+}
+
+type PresenceConf struct {
+	// group listed on the signaling server, nodes of a group see each other
+	Group string
+	// token of the group, given by the signaling server operator
+	Token string
+}
+
+type ACLConf struct {
+	// peer ids allowed to see all pairs of this node with sshx stat --remote,
+	// other peers only see pairs with themselves
+	Admins []string
+	// peer ids allowed to reach any host of our network through this node
+	// with sshx proxy socks
+	Forward []string
+	// peer ids allowed to listen on ports of this node with sshx proxy
+	// reverse
+	Listen []string
+	// destinations peers may ask a proxy for besides our loopback ports,
+	// like 10.0.0.0/24:5432, *.lan:*, unix:/var/run/docker.sock
+	Destinations []string
+	// fingerprints of peer ids, see sshx conf key. Peers of the lists
+	// above must prove their id with the key pinned here
+	Keys map[string]string
+}
+
+// ProfileConf is another signaling network the node takes part in, empty
+// values are taken from the top level configure
+type ProfileConf struct {
+	ID                  string
+	SignalingServerAddr string
+	RTCConf             webrtc.Configuration
+	Presence            PresenceConf
+	ACL                 ACLConf
+}
+
+// TunnelConf is a local port the daemon forwards to a port of a peer
+type TunnelConf struct {
+	// listen on 127.0.0.1 of this port
+	LocalPort int32
+	// node id or name of the address book
+	Host       string
+	RemotePort int32
+	// signaling network to reach the peer, empty for the default one
+	Profile  string
+	Disabled bool
+}
+
+// preferred transports of a host
+const (
+	TRANSPORT_DIRECT = "direct"
+	TRANSPORT_WEBRTC = "webrtc"
+)
+
+// HostConf is an entry of the address book, commands take its name
+// wherever they take a node id
+type HostConf struct {
+	// node id of the peer, its address for the direct transport
+	ID string
+	// ssh user when the address has none
+	User string
+	// private key for ssh, like ~/.ssh/id_ed25519
+	Identity string
+	// direct or webrtc, empty to try both
+	Transport string
+	Tags      []string
+}
+
+// HasTag reports whether the host carries tag
+func (hc HostConf) HasTag(tag string) bool {
+	for _, v := range hc.Tags {
+		if v == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// version of the configure file layout, see migrations
+const CONFIG_VERSION = 1
+
+const configName = ".sshx_config.json"
+
+// DirectPort of nodes without direct connections
+const DIRECT_PORT_DISABLED = -1
+
 type Configure struct {
+	// layout version, older files are migrated when loaded
+	Version             int
 	LocalSSHPort        int32
 	LocalHTTPPort       int32
 	LocalTCPPort        int32
@@ -26,19 +146,39 @@ type Configure struct {
 	SignalingServerAddr string
 	RTCConf             webrtc.Configuration
 	ETHAddr             string
+	Transfer            TransferConf
+	Limit               LimitConf
+	Presence            PresenceConf
+	ACL                 ACLConf
+	// serve /metrics and /healthz on this address, like 127.0.0.1:9100
+	MetricsAddr string
+	// port of direct connections, 0 for 8099, -1 to disable them
+	DirectPort int32
+	// unix socket of the daemon for local commands, empty for sshx.sock
+	// in the sshx home
+	ControlSocket string
+	// address book by name, names are lower case
+	Hosts map[string]HostConf
+	// signaling networks by name besides the top level one, the daemon
+	// joins all of them
+	Profiles map[string]ProfileConf
+	// forwarded ports by name, kept up by the daemon
+	Tunnels map[string]TunnelConf
 }
 
 type ConfManager struct {
-	Conf  *Configure
-	Viper *viper.Viper
-	Path  string
+	Conf      *Configure
+	Viper     *viper.Viper
+	Path      string
+	lock      sync.Mutex
+	listeners []func(old, new Configure)
 }
 
 var defaultConfig = Configure{
+	Version:             CONFIG_VERSION,
 	LocalHTTPPort:       80,
 	LocalSSHPort:        22,
 	LocalTCPPort:        2224,
-	ID:                  uuid.New().String(),
 	SignalingServerAddr: "http://alindev.kaist.ac.kr:5003",
 	RTCConf: webrtc.Configuration{
 		ICEServers: []webrtc.ICEServer{
@@ -55,6 +195,268 @@ var defaultConfig = Configure{
 	},
 }
 
+// NewDefaultConfigure returns the defaults with a new identity
+func NewDefaultConfigure() Configure {
+	ret := defaultConfig
+	// per-user daemons take commands on their socket only, a loopback port
+	// is open to every user and would clash between daemons. The direct
+	// port would clash too, and peers dial the port they listen on
+	// themselves, so direct connections are off until a port is given
+	if os.Geteuid() != 0 {
+		ret.LocalTCPPort = 0
+		ret.DirectPort = DIRECT_PORT_DISABLED
+	}
+	ret.ID = uuid.New().String()
+	ret.RTCConf.PeerIdentity = utils.HashString(fmt.Sprintf("%s%d", ret.ID, time.Now().Unix()))
+	return ret
+}
+
+// ConfigPath is the configure file under homePath
+func ConfigPath(homePath string) string {
+	if homePath == "" {
+		homePath = utils.GetSSHXHome()
+	}
+	return path.Join(homePath, configName)
+}
+
+// SocketPath is the control socket of the daemon
+func (cm *ConfManager) SocketPath() string {
+	if c := cm.Current(); c.ControlSocket != "" {
+		return c.ControlSocket
+	}
+	return path.Join(cm.Path, "sshx.sock")
+}
+
+// WriteConfigure validates c and writes it to the configure file under
+// homePath, readable by the owner only
+func WriteConfigure(homePath string, c Configure) error {
+	err := c.Validate()
+	if err != nil {
+		return err
+	}
+	bs, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	vp := viper.New()
+	vp.SetConfigType("json")
+	vp.SetConfigPermissions(0600)
+	err = vp.ReadConfig(bytes.NewBuffer(bs))
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(path.Dir(ConfigPath(homePath)), 0700)
+	if err != nil {
+		return err
+	}
+	err = vp.WriteConfigAs(ConfigPath(homePath))
+	if err != nil {
+		return err
+	}
+	return os.Chmod(ConfigPath(homePath), 0600)
+}
+
+// securePermissions keeps other users from reading tokens in the file
+func securePermissions(file string) {
+	info, err := os.Stat(file)
+	if err != nil || info.Mode().Perm()&0077 == 0 {
+		return
+	}
+	err = os.Chmod(file, 0600)
+	if err != nil {
+		logrus.Debug("cannot restrict permissions of ", file, ": ", err)
+		return
+	}
+	logrus.Warn("restricted permissions of ", file, " from ", info.Mode().Perm(), " to 0600")
+}
+
+func (tc TransferConf) Inbox() string {
+	if tc.InboxDir == "" {
+		return path.Join(os.Getenv("HOME"), "Downloads")
+	}
+	return tc.InboxDir
+}
+
+func (tc TransferConf) GetPolicy() string {
+	if tc.Policy == "" {
+		if canAsk() {
+			return TRANSFER_POLICY_ASK
+		}
+		return TRANSFER_POLICY_REJECT
+	}
+	return tc.Policy
+}
+
+// canAsk tells if the user may see the question of the ask policy, on a
+// terminal or as a desktop notification
+func canAsk() bool {
+	if term.IsTerminal(int(os.Stdin.Fd())) {
+		return true
+	}
+	switch runtime.GOOS {
+	case "darwin", "windows":
+		return true
+	}
+	return os.Getenv("DISPLAY") != "" || os.Getenv("WAYLAND_DISPLAY") != ""
+}
+
+func (ac ACLConf) IsAdmin(id string) bool {
+	for _, v := range ac.Admins {
+		if v == id {
+			return true
+		}
+	}
+	return false
+}
+
+// CanForward reports whether peer id may open connections to other hosts
+func (ac ACLConf) CanForward(id string) bool {
+	for _, v := range ac.Forward {
+		if v == id {
+			return true
+		}
+	}
+	return false
+}
+
+// CanListen reports whether peer id may listen on our ports
+func (ac ACLConf) CanListen(id string) bool {
+	for _, v := range ac.Listen {
+		if v == id {
+			return true
+		}
+	}
+	return false
+}
+
+// Verify reports whether key is the fingerprint pinned for peer id
+func (ac ACLConf) Verify(id, key string) bool {
+	pin, ok := ac.Keys[strings.ToLower(id)]
+	return ok && key != "" && strings.EqualFold(strings.TrimSpace(pin), key)
+}
+
+func (ac ACLConf) isEmpty() bool {
+	return ac.Admins == nil && ac.Forward == nil && ac.Listen == nil && ac.Destinations == nil && ac.Keys == nil
+}
+
+// ParseDestination splits a proxy destination into the network and
+// address to dial, host:port for tcp or unix:/path. Unix paths are
+// cleaned, /var/run/.. would match /var/run/* otherwise
+func ParseDestination(dest string) (string, string, error) {
+	if strings.HasPrefix(dest, "unix:") {
+		p := strings.TrimPrefix(dest, "unix:")
+		if !path.IsAbs(p) {
+			return "", "", fmt.Errorf("%q is not an absolute unix socket path", dest)
+		}
+		return "unix", path.Clean(p), nil
+	}
+	host, port, err := net.SplitHostPort(dest)
+	if err != nil || host == "" {
+		return "", "", fmt.Errorf("%q is not host:port or unix:/path", dest)
+	}
+	if p, err := strconv.Atoi(port); err != nil || p <= 0 || p > 65535 {
+		return "", "", fmt.Errorf("%q has no valid port", dest)
+	}
+	return "tcp", dest, nil
+}
+
+// AllowsDestination reports whether dest matches an entry of
+// Destinations. Hosts match by name with globs or by ip and cidr, names
+// are not resolved, ports match exactly or with *
+func (ac ACLConf) AllowsDestination(dest string) bool {
+	network, addr, err := ParseDestination(dest)
+	if err != nil {
+		return false
+	}
+	for _, v := range ac.Destinations {
+		if network == "unix" {
+			if p := strings.TrimPrefix(v, "unix:"); p != v {
+				if ok, _ := path.Match(p, addr); ok {
+					return true
+				}
+			}
+			continue
+		}
+		if matchHostPort(v, addr) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchHostPort(pattern, addr string) bool {
+	phost, pport, err := net.SplitHostPort(pattern)
+	if err != nil {
+		return false
+	}
+	host, port, _ := net.SplitHostPort(addr)
+	if pport != "*" && pport != port {
+		return false
+	}
+	if _, cidr, err := net.ParseCIDR(phost); err == nil {
+		ip := net.ParseIP(host)
+		return ip != nil && cidr.Contains(ip)
+	}
+	if pip := net.ParseIP(phost); pip != nil {
+		return pip.Equal(net.ParseIP(host))
+	}
+	ok, _ := path.Match(strings.ToLower(phost), strings.ToLower(host))
+	return ok
+}
+
+// ActiveProfile is the profile commands use, from SSHX_PROFILE, names
+// are lower case like all keys
+func ActiveProfile() string {
+	return strings.ToLower(os.Getenv("SSHX_PROFILE"))
+}
+
+// ProfileNames lists the profiles sorted
+func (c Configure) ProfileNames() []string {
+	ret := make([]string, 0, len(c.Profiles))
+	for k := range c.Profiles {
+		ret = append(ret, k)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// Profile returns the configure with the values of profile name, an
+// empty name is the top level configure
+func (c Configure) Profile(name string) (Configure, error) {
+	if name == "" {
+		return c, nil
+	}
+	p, ok := c.Profiles[strings.ToLower(name)]
+	if !ok {
+		return c, fmt.Errorf("unknown profile %s, known profiles are %s", name, strings.Join(c.ProfileNames(), ", "))
+	}
+	if p.ID != "" {
+		c.ID = p.ID
+	}
+	if p.SignalingServerAddr != "" {
+		c.SignalingServerAddr = p.SignalingServerAddr
+	}
+	if len(p.RTCConf.ICEServers) > 0 || p.RTCConf.PeerIdentity != "" {
+		c.RTCConf = p.RTCConf
+	}
+	if p.Presence.Group != "" {
+		c.Presence = p.Presence
+	}
+	if !p.ACL.isEmpty() {
+		c.ACL = p.ACL
+	}
+	return c, nil
+}
+
+// ResolveHost looks name up in the address book, names which are not
+// there are taken as node ids
+func (c Configure) ResolveHost(name string) (HostConf, bool) {
+	if h, ok := c.Hosts[strings.ToLower(name)]; ok {
+		return h, true
+	}
+	return HostConf{ID: name}, false
+}
+
 func ClearKnownHosts(subStr string) {
 	subStr = strings.Replace(subStr, "127.0.0.1", "[127.0.0.1]", 1)
 	//[127.0.0.1]:2222
@@ -73,7 +475,7 @@ func ClearKnownHosts(subStr string) {
 		}
 	}
 	output := strings.Join(newLines, "\n")
-	err = ioutil.WriteFile(fileName, []byte(output), 0777)
+	err = ioutil.WriteFile(fileName, []byte(output), 0600)
 	if err != nil {
 		logrus.Error(err)
 		return
@@ -81,7 +483,27 @@ func ClearKnownHosts(subStr string) {
 	//ioutil.WriteFile(fileName, []byte(res), 544)
 }
 
-func NewConfManager(homePath string) *ConfManager {
+// NewConfManager reads the configure file under homePath, a default one
+// is created if there is none
+func NewConfManager(homePath string) (*ConfManager, error) {
+	if homePath == "" {
+		homePath = utils.GetSSHXHome()
+	}
+	file := ConfigPath(homePath)
+	if _, err := os.Stat(file); os.IsNotExist(err) {
+		err = WriteConfigure(homePath, NewDefaultConfigure())
+		if err != nil {
+			return nil, fmt.Errorf("cannot create %s: %v", file, err)
+		}
+		logrus.Info("created default configure at ", file, ", change it with sshx conf init or sshx conf set")
+	}
+	return OpenConfManager(homePath)
+}
+
+// OpenConfManager reads the configure under homePath like NewConfManager
+// but never creates it, commands talking to a daemon must not make up an
+// identity of their own
+func OpenConfManager(homePath string) (*ConfManager, error) {
 	if homePath == "" {
 		homePath = utils.GetSSHXHome()
 	}
@@ -89,66 +511,257 @@ func NewConfManager(homePath string) *ConfManager {
 	vp := viper.New()
 	vp.SetConfigName(".sshx_config")
 	vp.SetConfigType("json")
+	vp.SetConfigPermissions(0600)
 	vp.AddConfigPath(homePath)
-	vp.WatchConfig()
-	vp.OnConfigChange(func(e fsnotify.Event) {
-		err := vp.Unmarshal(&tmp)
-		if err != nil {
-			logrus.Error(err)
-			return
-		}
-	})
-	err := vp.ReadInConfig() // Find and read the config file
-	if err != nil {
-		if _, ok := err.(viper.ConfigFileNotFoundError); ok {
-			// Config file not found; ignore error if desired
-			defaultConfig.RTCConf.PeerIdentity = utils.HashString(fmt.Sprintf("%s%d", defaultConfig.ID, time.Now().Unix()))
-			bs, _ := json.MarshalIndent(defaultConfig, "", "  ")
-			vp.ReadConfig(bytes.NewBuffer(bs))
-			err = vp.WriteConfigAs(path.Join(homePath, "./.sshx_config.json"))
-			if err != nil {
-				logrus.Error(err)
-				os.Exit(1)
-			}
-			os.Chmod(path.Join(homePath, "./.sshx_config.json"), 0777)
-			os.Exit(1)
-		} else {
-			logrus.Error(err)
-			os.Exit(1)
-		}
+	ret := &ConfManager{
+		Conf:  &tmp,
+		Viper: vp,
+		Path:  homePath,
+	}
+	file := ConfigPath(homePath)
+	if _, err := os.Stat(file); os.IsNotExist(err) {
+		return nil, noConfigure(homePath)
+	}
+	if f, err := os.Open(file); os.IsPermission(err) {
+		return nil, fmt.Errorf("cannot read %s, run the command as the user of its daemon, with sudo for the system daemon", file)
+	} else if err == nil {
+		f.Close()
+	}
+	err := Migrate(file)
+	if err != nil {
+		return nil, err
+	}
+	securePermissions(file)
+	err = vp.ReadInConfig() // Find and read the config file
+	if err != nil {
+		return nil, fmt.Errorf("cannot read configure: %v", err)
 	}
 
 	err = vp.Unmarshal(&tmp)
 	if err != nil {
-		logrus.Error(err)
-		os.Exit(1)
+		return nil, fmt.Errorf("cannot decode configure: %v", err)
 	}
 
 	ClearKnownHosts(fmt.Sprintf("127.0.0.1:%d", tmp.LocalSSHPort))
-	return &ConfManager{
-		Conf:  &tmp,
-		Viper: vp,
-		Path:  homePath,
+	return ret, nil
+}
+
+// noConfigure tells how to reach a daemon when homePath has no configure
+func noConfigure(homePath string) error {
+	file := ConfigPath(homePath)
+	if homePath != utils.SystemHome {
+		if _, err := os.Stat(ConfigPath(utils.SystemHome)); !os.IsNotExist(err) {
+			return fmt.Errorf("no configure at %s and the one of the system daemon is readable by root only, run the command with sudo or start a per-user daemon with sshx conf init and sshx daemon", file)
+		}
+	}
+	return fmt.Errorf("no configure at %s, start the daemon with sshx daemon or create it with sshx conf init", file)
+}
+
+// Current returns a copy of the configure, safe against reloads
+func (cm *ConfManager) Current() Configure {
+	cm.lock.Lock()
+	defer cm.lock.Unlock()
+	return *cm.Conf
+}
+
+// Watch reloads the configure file whenever it changes
+func (cm *ConfManager) Watch() {
+	cm.Viper.OnConfigChange(func(e fsnotify.Event) {
+		err := cm.Reload()
+		if err != nil {
+			logrus.Error("ignore configuration change of ", e.Name, ": ", err)
+		}
+	})
+	cm.Viper.WatchConfig()
+}
+
+// OnChange registers f to be called with the old and the new configure
+// after a valid change of the configure file
+func (cm *ConfManager) OnChange(f func(old, new Configure)) {
+	cm.lock.Lock()
+	defer cm.lock.Unlock()
+	cm.listeners = append(cm.listeners, f)
+}
+
+// Reload reads the configure file again and applies it if it is valid
+func (cm *ConfManager) Reload() error {
+	old, tmp, err := cm.read()
+	if err != nil || reflect.DeepEqual(old, tmp) {
+		return err
 	}
+	logrus.Info("configure reloaded from ", cm.Viper.ConfigFileUsed())
+	// listeners run unlocked, they may read the configure again
+	cm.lock.Lock()
+	listeners := cm.listeners
+	cm.lock.Unlock()
+	for _, f := range listeners {
+		f(old, tmp)
+	}
+	return nil
 }
 
-func (cm *ConfManager) Set(key, value string) {
-	logrus.Info("key/value", key, value)
-	cm.Viper.Set(key, value)
-	err := cm.Viper.Unmarshal(cm.Conf)
+// read replaces the configure with the file if it is valid
+func (cm *ConfManager) read() (Configure, Configure, error) {
+	cm.lock.Lock()
+	defer cm.lock.Unlock()
+	old := *cm.Conf
+	err := cm.Viper.ReadInConfig()
 	if err != nil {
-		logrus.Error(err)
-		return
+		return old, old, fmt.Errorf("cannot read configure: %v", err)
 	}
+	var tmp Configure
+	err = cm.Viper.Unmarshal(&tmp)
+	if err != nil {
+		return old, old, fmt.Errorf("cannot decode configure: %v", err)
+	}
+	err = tmp.Validate()
+	if err != nil {
+		return old, old, err
+	}
+	*cm.Conf = tmp
+	return old, tmp, nil
+}
+
+// Set checks value against the schema and writes it if the resulting
+// configure is valid
+func (cm *ConfManager) Set(key, value string) error {
+	v, err := ParseValue(key, value)
+	if err != nil {
+		return err
+	}
+	cm.lock.Lock()
+	defer cm.lock.Unlock()
+	// try on a copy first, the file stays untouched on errors
+	tmpvp := viper.New()
+	err = tmpvp.MergeConfigMap(cm.Viper.AllSettings())
+	if err != nil {
+		return err
+	}
+	tmpvp.Set(key, v)
+	var tmp Configure
+	err = tmpvp.Unmarshal(&tmp)
+	if err != nil {
+		return err
+	}
+	err = tmp.Validate()
+	if err != nil {
+		return err
+	}
+	logrus.Info("set ", key, " to ", value)
+	cm.Viper.Set(key, v)
+	*cm.Conf = tmp
 	err = cm.Viper.WriteConfig()
 	if err != nil {
-		logrus.Error(err)
-		return
+		return err
+	}
+	securePermissions(cm.Viper.ConfigFileUsed())
+	return nil
+}
+
+// AddHost writes host to the address book, an entry of the same name is
+// replaced
+func (cm *ConfManager) AddHost(name string, host HostConf) error {
+	cm.lock.Lock()
+	defer cm.lock.Unlock()
+	settings := cm.Viper.AllSettings()
+	hosts, _ := settings["hosts"].(map[string]interface{})
+	if hosts == nil {
+		hosts = make(map[string]interface{})
+	}
+	tags := host.Tags
+	if tags == nil {
+		tags = []string{}
+	}
+	hosts[strings.ToLower(name)] = map[string]interface{}{
+		"id":        host.ID,
+		"user":      host.User,
+		"identity":  host.Identity,
+		"transport": host.Transport,
+		"tags":      tags,
+	}
+	settings["hosts"] = hosts
+	return cm.write(settings)
+}
+
+// RemoveHost deletes name from the address book
+func (cm *ConfManager) RemoveHost(name string) error {
+	cm.lock.Lock()
+	defer cm.lock.Unlock()
+	settings := cm.Viper.AllSettings()
+	hosts, _ := settings["hosts"].(map[string]interface{})
+	if _, ok := hosts[strings.ToLower(name)]; !ok {
+		return fmt.Errorf("no host named %s", name)
+	}
+	delete(hosts, strings.ToLower(name))
+	return cm.write(settings)
+}
+
+// AddTunnel writes tunnel to the configure, a tunnel of the same name is
+// replaced
+func (cm *ConfManager) AddTunnel(name string, tunnel TunnelConf) error {
+	cm.lock.Lock()
+	defer cm.lock.Unlock()
+	settings := cm.Viper.AllSettings()
+	tunnels, _ := settings["tunnels"].(map[string]interface{})
+	if tunnels == nil {
+		tunnels = make(map[string]interface{})
+	}
+	tunnels[strings.ToLower(name)] = map[string]interface{}{
+		"localport":  tunnel.LocalPort,
+		"host":       tunnel.Host,
+		"remoteport": tunnel.RemotePort,
+		"profile":    tunnel.Profile,
+		"disabled":   tunnel.Disabled,
+	}
+	settings["tunnels"] = tunnels
+	return cm.write(settings)
+}
+
+// RemoveTunnel deletes name from the tunnels
+func (cm *ConfManager) RemoveTunnel(name string) error {
+	cm.lock.Lock()
+	defer cm.lock.Unlock()
+	settings := cm.Viper.AllSettings()
+	tunnels, _ := settings["tunnels"].(map[string]interface{})
+	if _, ok := tunnels[strings.ToLower(name)]; !ok {
+		return fmt.Errorf("no tunnel named %s", name)
+	}
+	delete(tunnels, strings.ToLower(name))
+	return cm.write(settings)
+}
+
+// write replaces the configure file with settings if they are valid,
+// viper cannot delete keys so the file is written from a new instance
+func (cm *ConfManager) write(settings map[string]interface{}) error {
+	vp := viper.New()
+	vp.SetConfigType("json")
+	vp.SetConfigPermissions(0600)
+	err := vp.MergeConfigMap(settings)
+	if err != nil {
+		return err
+	}
+	var tmp Configure
+	err = vp.Unmarshal(&tmp)
+	if err != nil {
+		return err
+	}
+	err = tmp.Validate()
+	if err != nil {
+		return err
+	}
+	file := cm.Viper.ConfigFileUsed()
+	err = vp.WriteConfigAs(file)
+	if err != nil {
+		return err
 	}
+	securePermissions(file)
+	*cm.Conf = tmp
+	return cm.Viper.ReadInConfig()
 }
 
 func (cm *ConfManager) Show() {
-	bs, _ := json.MarshalIndent(cm.Conf, "", "  ")
+	c := cm.Current()
+	bs, _ := json.MarshalIndent(c, "", "  ")
 	logrus.Info("read configure file at: ", cm.Path+"/.sshx_config.json")
 	logrus.Info(string(bs))
 }
@@ -0,0 +1,105 @@
+package conf
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestParseDestination(t *testing.T) {
+	tests := []struct {
+		dest    string
+		network string
+		addr    string
+		err     bool
+	}{
+		{"127.0.0.1:22", "tcp", "127.0.0.1:22", false},
+		{"[::1]:22", "tcp", "[::1]:22", false},
+		{"db.lan:5432", "tcp", "db.lan:5432", false},
+		{"unix:/var/run/docker.sock", "unix", "/var/run/docker.sock", false},
+		{"unix:/var/run/../../etc/x.sock", "unix", "/etc/x.sock", false},
+		{"unix:/tmp//a/./b.sock", "unix", "/tmp/a/b.sock", false},
+		{"unix:run/docker.sock", "", "", true},
+		{"127.0.0.1", "", "", true},
+		{":22", "", "", true},
+		{"host:0", "", "", true},
+		{"host:70000", "", "", true},
+		{"host:ssh", "", "", true},
+	}
+	for _, tt := range tests {
+		network, addr, err := ParseDestination(tt.dest)
+		if (err != nil) != tt.err {
+			t.Errorf("ParseDestination(%q): err %v, want error %v", tt.dest, err, tt.err)
+			continue
+		}
+		if network != tt.network || addr != tt.addr {
+			t.Errorf("ParseDestination(%q) = %s %s, want %s %s", tt.dest, network, addr, tt.network, tt.addr)
+		}
+	}
+}
+
+func TestAllowsDestination(t *testing.T) {
+	ac := ACLConf{Destinations: []string{
+		"10.0.0.0/24:5432",
+		"192.168.1.10:*",
+		"*.lan:22",
+		"unix:/var/run/*.sock",
+	}}
+	tests := []struct {
+		dest string
+		want bool
+	}{
+		{"10.0.0.7:5432", true},
+		{"10.0.0.7:5433", false},
+		{"10.0.1.7:5432", false},
+		{"192.168.1.10:80", true},
+		{"192.168.1.11:80", false},
+		{"nas.lan:22", true},
+		{"NAS.LAN:22", true},
+		{"nas.lan:80", false},
+		{"lan:22", false},
+		// names are not resolved, so they never match ip patterns
+		{"localhost:5432", false},
+		{"unix:/var/run/docker.sock", true},
+		{"unix:/var/run/sub/docker.sock", false},
+		// cleaned before matching, the path leaves /var/run
+		{"unix:/var/run/../../etc/evil.sock", false},
+		{"unix:/var/run/./docker.sock", true},
+		{"unix:/tmp/docker.sock", false},
+		{"unix:var/run/docker.sock", false},
+		{"garbage", false},
+	}
+	for _, tt := range tests {
+		if got := ac.AllowsDestination(tt.dest); got != tt.want {
+			t.Errorf("AllowsDestination(%q) = %v, want %v", tt.dest, got, tt.want)
+		}
+	}
+	if (ACLConf{}).AllowsDestination("127.0.0.1:22") {
+		t.Error("an empty acl allows destinations")
+	}
+}
+
+func TestOpenConfManager(t *testing.T) {
+	home, err := ioutil.TempDir("", "sshx-conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(home)
+	if _, err := OpenConfManager(home); err == nil {
+		t.Fatal("opened a home without configure")
+	}
+	if _, err := os.Stat(ConfigPath(home)); !os.IsNotExist(err) {
+		t.Fatalf("configure created by a client: %v", err)
+	}
+	cm, err := NewConfManager(home)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opened, err := OpenConfManager(home)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opened.Current().ID != cm.Current().ID {
+		t.Fatalf("opened id %s, created %s", opened.Current().ID, cm.Current().ID)
+	}
+}
@@ -0,0 +1,100 @@
+package conf
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+	"github.com/sirupsen/logrus"
+	"github.com/suutaku/sshx/internal/utils"
+)
+
+const identityName = "identity.pem"
+
+// IdentityPath is the dtls certificate of the node under homePath
+func IdentityPath(homePath string) string {
+	if homePath == "" {
+		homePath = utils.GetSSHXHome()
+	}
+	return path.Join(homePath, identityName)
+}
+
+// LoadIdentity reads the dtls certificate of the node, a new one is created
+// if there is none. Peers pin its fingerprint in acl.keys, so it stays
+// the same across restarts
+func LoadIdentity(homePath string) (webrtc.Certificate, error) {
+	file := IdentityPath(homePath)
+	bs, err := ioutil.ReadFile(file)
+	if err == nil {
+		cert, err := webrtc.CertificateFromPEM(string(bs))
+		if err != nil {
+			return webrtc.Certificate{}, fmt.Errorf("%s: %v", file, err)
+		}
+		return *cert, nil
+	}
+	if !os.IsNotExist(err) {
+		return webrtc.Certificate{}, err
+	}
+	cert, err := newIdentity()
+	if err != nil {
+		return webrtc.Certificate{}, err
+	}
+	pems, err := cert.PEM()
+	if err != nil {
+		return webrtc.Certificate{}, err
+	}
+	err = ioutil.WriteFile(file, []byte(pems), 0600)
+	if err != nil {
+		return webrtc.Certificate{}, err
+	}
+	logrus.Info("created node identity at ", file)
+	return cert, nil
+}
+
+// newIdentity creates a self signed certificate, pion makes ones valid for
+// a month only
+func newIdentity() (webrtc.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return webrtc.Certificate{}, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return webrtc.Certificate{}, err
+	}
+	cert, err := webrtc.NewCertificate(key, x509.Certificate{
+		Issuer:       pkix.Name{CommonName: "sshx"},
+		Subject:      pkix.Name{CommonName: "sshx"},
+		NotBefore:    time.Now().AddDate(0, 0, -1),
+		NotAfter:     time.Now().AddDate(20, 0, 0),
+		SerialNumber: serial,
+		Version:      2,
+	})
+	if err != nil {
+		return webrtc.Certificate{}, err
+	}
+	return *cert, nil
+}
+
+// Fingerprint is the key of a certificate as written in sdp and acl.keys,
+// like sha-256 AB:CD:...
+func Fingerprint(cert webrtc.Certificate) (string, error) {
+	fps, err := cert.GetFingerprints()
+	if err != nil {
+		return "", err
+	}
+	if len(fps) == 0 {
+		return "", fmt.Errorf("certificate without fingerprint")
+	}
+	return fps[0].Algorithm + " " + strings.ToUpper(fps[0].Value), nil
+}
@@ -0,0 +1,146 @@
+package conf
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// migrations[i] upgrades a configure file of version i to version i+1,
+// files without a version are version 0
+var migrations = []func(raw map[string]interface{}) error{
+	migrateListenAddrs,
+}
+
+// readRaw reads a configure file as a json object and its version
+func readRaw(file string) ([]byte, map[string]interface{}, int, error) {
+	bs, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	raw := make(map[string]interface{})
+	err = json.Unmarshal(bs, &raw)
+	if err != nil {
+		return nil, nil, 0, fmt.Errorf("%s is not valid json: %v", file, err)
+	}
+	version := 0
+	if v, ok := rawGet(raw, "version"); ok {
+		f, ok := v.(float64)
+		if !ok {
+			return nil, nil, 0, fmt.Errorf("%s: version %v is not a number", file, v)
+		}
+		version = int(f)
+	}
+	return bs, raw, version, nil
+}
+
+// upgrade applies the migrations from version on to raw
+func upgrade(raw map[string]interface{}, version int) error {
+	for i := version; i < CONFIG_VERSION; i++ {
+		err := migrations[i](raw)
+		if err != nil {
+			return fmt.Errorf("cannot migrate from version %d: %v", i, err)
+		}
+	}
+	rawDelete(raw, "version")
+	raw["version"] = CONFIG_VERSION
+	return nil
+}
+
+// Migrate upgrades an older configure file in place, the original is kept
+// next to it with a .v<version>.bak suffix
+func Migrate(file string) error {
+	bs, raw, version, err := readRaw(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if version >= CONFIG_VERSION {
+		return nil
+	}
+	err = upgrade(raw, version)
+	if err != nil {
+		return fmt.Errorf("%s: %v", file, err)
+	}
+	out, err := json.MarshalIndent(raw, "", "  ")
+	if err != nil {
+		return err
+	}
+	backup := fmt.Sprintf("%s.v%d.bak", file, version)
+	err = ioutil.WriteFile(backup, bs, 0600)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(file, out, 0600)
+	if err != nil {
+		return err
+	}
+	logrus.Info("migrated ", file, " from version ", version, " to ", CONFIG_VERSION, ", the old file is ", backup)
+	return nil
+}
+
+// keys of json files are matched case insensitive like viper does
+func rawGet(raw map[string]interface{}, key string) (interface{}, bool) {
+	for k, v := range raw {
+		if strings.EqualFold(k, key) {
+			return v, true
+		}
+	}
+	return nil, false
+}
+
+func rawDelete(raw map[string]interface{}, key string) {
+	for k := range raw {
+		if strings.EqualFold(k, key) {
+			delete(raw, k)
+		}
+	}
+}
+
+// migrateListenAddrs turns the listen addresses of old releases into the
+// ports used now and fills in missing ports
+func migrateListenAddrs(raw map[string]interface{}) error {
+	renamed := map[string]string{
+		"locallistenaddr": "localtcpport",
+		"localsshaddr":    "localsshport",
+	}
+	for old, key := range renamed {
+		v, ok := rawGet(raw, old)
+		if !ok {
+			continue
+		}
+		rawDelete(raw, old)
+		if _, ok := rawGet(raw, key); ok {
+			continue
+		}
+		addr, _ := v.(string)
+		_, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return fmt.Errorf("%s: %v", old, err)
+		}
+		p, err := strconv.Atoi(port)
+		if err != nil {
+			return fmt.Errorf("%s: %v", old, err)
+		}
+		raw[key] = p
+	}
+	defaults := map[string]int32{
+		"localtcpport":  defaultConfig.LocalTCPPort,
+		"localsshport":  defaultConfig.LocalSSHPort,
+		"localhttpport": defaultConfig.LocalHTTPPort,
+	}
+	for k, v := range defaults {
+		if _, ok := rawGet(raw, k); !ok {
+			raw[k] = v
+		}
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+package conf
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMigrate(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		// values expected after migration, nil for removed keys
+		want map[string]interface{}
+		err  string
+	}{
+		{
+			name: "listen addresses",
+			in:   `{"LocalListenAddr": "127.0.0.1:2224", "localsshaddr": "127.0.0.1:2222", "id": "a"}`,
+			want: map[string]interface{}{
+				"localtcpport":    float64(2224),
+				"localsshport":    float64(2222),
+				"localhttpport":   float64(defaultConfig.LocalHTTPPort),
+				"LocalListenAddr": nil,
+				"localsshaddr":    nil,
+				"id":              "a",
+				"version":         float64(CONFIG_VERSION),
+			},
+		},
+		{
+			name: "new port wins",
+			in:   `{"locallistenaddr": "127.0.0.1:2224", "localtcpport": 3000}`,
+			want: map[string]interface{}{
+				"localtcpport":    float64(3000),
+				"locallistenaddr": nil,
+			},
+		},
+		{
+			name: "missing ports",
+			in:   `{}`,
+			want: map[string]interface{}{
+				"localtcpport": float64(defaultConfig.LocalTCPPort),
+				"localsshport": float64(defaultConfig.LocalSSHPort),
+			},
+		},
+		{
+			name: "bad address",
+			in:   `{"locallistenaddr": "2224"}`,
+			err:  "locallistenaddr",
+		},
+		{
+			name: "bad version",
+			in:   `{"version": "one"}`,
+			err:  "not a number",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), "sshx.json")
+			ioutil.WriteFile(file, []byte(tt.in), 0600)
+			err := Migrate(file)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("got %v, want an error about %s", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			bs, _ := ioutil.ReadFile(file)
+			raw := make(map[string]interface{})
+			if err = json.Unmarshal(bs, &raw); err != nil {
+				t.Fatal(err)
+			}
+			for k, v := range tt.want {
+				got, ok := raw[k]
+				if v == nil {
+					if ok {
+						t.Errorf("%s still set to %v", k, got)
+					}
+					continue
+				}
+				if got != v {
+					t.Errorf("%s = %v, want %v", k, got, v)
+				}
+			}
+			backup, err := ioutil.ReadFile(file + ".v0.bak")
+			if err != nil || string(backup) != tt.in {
+				t.Fatalf("backup %q, %v", backup, err)
+			}
+		})
+	}
+}
+
+func TestMigrateCurrent(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "sshx.json")
+	in := fmt.Sprintf(`{"version": %d, "locallistenaddr": "127.0.0.1:2224"}`, CONFIG_VERSION)
+	ioutil.WriteFile(file, []byte(in), 0600)
+	if err := Migrate(file); err != nil {
+		t.Fatal(err)
+	}
+	bs, _ := ioutil.ReadFile(file)
+	if string(bs) != in {
+		t.Fatalf("current file rewritten to %s", bs)
+	}
+	if err := Migrate(filepath.Join(dir, "missing.json")); err != nil {
+		t.Fatalf("missing file: %v", err)
+	}
+}
@@ -0,0 +1,487 @@
+package conf
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pion/ice/v2"
+	"github.com/pion/webrtc/v3"
+	"github.com/spf13/viper"
+	"github.com/suutaku/sshx/internal/qos"
+)
+
+// kinds of configure values
+const (
+	KIND_STRING = iota
+	// 1 to 65535
+	KIND_PORT
+	// 0 to 65535, 0 for the default port or disabled
+	KIND_OPTIONAL_PORT
+	// -1 to 65535, 0 for the default port and -1 for disabled
+	KIND_DIRECT_PORT
+	KIND_INT
+	// http or https url
+	KIND_URL
+	// empty or host:port
+	KIND_ADDR
+	// bytes per second like 5M, empty for no limit
+	KIND_RATE
+	// comma separated strings
+	KIND_LIST
+	KIND_ENUM
+	// a json document, like the list of ice servers
+	KIND_JSON
+	// a certificate fingerprint like sha-256 AB:CD:...
+	KIND_KEY
+)
+
+type Field struct {
+	Kind   int
+	Values []string
+	Help   string
+}
+
+// Schema lists the keys `sshx conf set` accepts
+var Schema = map[string]Field{
+	"id":                     {Kind: KIND_STRING, Help: "id of this node on the signaling server"},
+	"localsshport":           {Kind: KIND_PORT, Help: "port of the local sshd"},
+	"localhttpport":          {Kind: KIND_PORT, Help: "port of the local http server"},
+	"localtcpport":           {Kind: KIND_OPTIONAL_PORT, Help: "loopback port for local commands, 0 for the control socket only"},
+	"controlsocket":          {Kind: KIND_STRING, Help: "unix socket for local commands, empty for sshx.sock in the sshx home"},
+	"directport":             {Kind: KIND_DIRECT_PORT, Help: "port of direct connections, 0 for 8099, -1 to disable them"},
+	"signalingserveraddr":    {Kind: KIND_URL, Help: "signaling server, like http://example.com:5003"},
+	"ethaddr":                {Kind: KIND_STRING},
+	"metricsaddr":            {Kind: KIND_ADDR, Help: "metrics listen address, empty to disable"},
+	"rtcconf.iceservers":     {Kind: KIND_JSON, Help: `like [{"urls": ["stun:stun.l.google.com:19302"]}]`},
+	"rtcconf.peeridentity":   {Kind: KIND_STRING},
+	"transfer.inboxdir":      {Kind: KIND_STRING, Help: "directory of received files"},
+	"transfer.exportedroots": {Kind: KIND_LIST, Help: "paths peers may download from"},
+	"transfer.policy":        {Kind: KIND_ENUM, Values: []string{TRANSFER_POLICY_ACCEPT, TRANSFER_POLICY_ASK, TRANSFER_POLICY_REJECT}},
+	"transfer.quota":         {Kind: KIND_INT, Help: "maximum bytes of the inbox, 0 for no limit"},
+	"limit.global":           {Kind: KIND_RATE, Help: "rate of all traffic"},
+	"limit.apps":             {Kind: KIND_JSON, Help: `rates by application, like {"transfer": "5M"}`},
+	"presence":               {Kind: KIND_JSON, Help: `group and token at once, like {"group": "home", "token": "secret"}`},
+	"presence.group":         {Kind: KIND_STRING},
+	"presence.token":         {Kind: KIND_STRING},
+	"acl.admins":             {Kind: KIND_LIST, Help: "peer ids which see all pairs with stat --remote"},
+	"acl.forward":            {Kind: KIND_LIST, Help: "peer ids which reach other hosts through this node with proxy socks"},
+	"acl.listen":             {Kind: KIND_LIST, Help: "peer ids which listen on ports of this node with proxy reverse"},
+	"acl.destinations":       {Kind: KIND_LIST, Help: "hosts proxies of peers may reach, like 10.0.0.0/24:5432,*.lan:*,unix:/var/run/docker.sock"},
+	"acl.keys":               {Kind: KIND_JSON, Help: "keys peers of the acl prove their id with, set one with acl.keys.<id> to the output of sshx conf key on the peer"},
+	"hosts":                  {Kind: KIND_JSON, Help: "address book, edit it with sshx hosts"},
+	"profiles":               {Kind: KIND_JSON, Help: "other signaling networks by name, like profiles.staging.signalingserveraddr"},
+	"tunnels":                {Kind: KIND_JSON, Help: "forwarded ports, edit them with sshx tunnels"},
+}
+
+// SchemaKeys lists the keys of the schema sorted
+func SchemaKeys() []string {
+	ret := make([]string, 0, len(Schema))
+	for k := range Schema {
+		ret = append(ret, k)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// keys a profile may set
+var profileKeys = map[string]bool{
+	"id":                   true,
+	"signalingserveraddr":  true,
+	"rtcconf.iceservers":   true,
+	"rtcconf.peeridentity": true,
+	"presence":             true,
+	"presence.group":       true,
+	"presence.token":       true,
+	"acl.admins":           true,
+	"acl.forward":          true,
+	"acl.listen":           true,
+	"acl.destinations":     true,
+	"acl.keys":             true,
+}
+
+func lookupField(key string) (Field, bool) {
+	key = strings.ToLower(key)
+	if f, ok := Schema[key]; ok {
+		return f, true
+	}
+	// single application rates, like limit.apps.transfer
+	if strings.HasPrefix(key, "limit.apps.") {
+		return Field{Kind: KIND_RATE}, true
+	}
+	// single peer keys, like acl.keys.node-a
+	if strings.HasPrefix(key, "acl.keys.") {
+		return Field{Kind: KIND_KEY}, true
+	}
+	// values of a profile, like profiles.staging.signalingserveraddr
+	if sps := strings.SplitN(key, ".", 3); len(sps) == 3 && sps[0] == "profiles" {
+		if profileKeys[sps[2]] {
+			return Schema[sps[2]], true
+		}
+		if strings.HasPrefix(sps[2], "acl.keys.") {
+			return Field{Kind: KIND_KEY}, true
+		}
+	}
+	return Field{}, false
+}
+
+// ParseValue converts the string value of key to its typed value
+func ParseValue(key, value string) (interface{}, error) {
+	f, ok := lookupField(key)
+	if !ok {
+		return nil, fmt.Errorf("unknown key %s, known keys are %s", key, strings.Join(SchemaKeys(), ", "))
+	}
+	switch f.Kind {
+	case KIND_PORT, KIND_OPTIONAL_PORT, KIND_DIRECT_PORT:
+		port, err := strconv.ParseInt(value, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %q is not a number", key, value)
+		}
+		if f.Kind == KIND_DIRECT_PORT && port == DIRECT_PORT_DISABLED {
+			return int32(port), nil
+		}
+		if err := checkPort(key, int32(port), f.Kind != KIND_PORT); err != nil {
+			return nil, err
+		}
+		return int32(port), nil
+	case KIND_INT:
+		v, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %q is not a number", key, value)
+		}
+		return v, nil
+	case KIND_URL:
+		return value, checkURL(key, value)
+	case KIND_ADDR:
+		return value, checkAddr(key, value)
+	case KIND_KEY:
+		return value, checkKey(key, value)
+	case KIND_RATE:
+		_, err := qos.ParseRate(value)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", key, err)
+		}
+		return value, nil
+	case KIND_LIST:
+		ret := make([]string, 0)
+		for _, v := range strings.Split(value, ",") {
+			if v = strings.TrimSpace(v); v != "" {
+				ret = append(ret, v)
+			}
+		}
+		return ret, nil
+	case KIND_ENUM:
+		for _, v := range f.Values {
+			if v == value {
+				return value, nil
+			}
+		}
+		return nil, fmt.Errorf("%s: %q is not one of %s", key, value, strings.Join(f.Values, ", "))
+	case KIND_JSON:
+		var ret interface{}
+		err := json.Unmarshal([]byte(value), &ret)
+		if err != nil {
+			return nil, fmt.Errorf("%s: invalid json: %v", key, err)
+		}
+		return ret, nil
+	}
+	return value, nil
+}
+
+func checkPort(key string, port int32, optional bool) error {
+	if optional && port == 0 {
+		return nil
+	}
+	if port <= 0 || port > 65535 {
+		return fmt.Errorf("%s: %d is not a valid port", key, port)
+	}
+	return nil
+}
+
+func checkURL(key, value string) error {
+	u, err := url.Parse(value)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("%s: %q is not a http(s) url", key, value)
+	}
+	return nil
+}
+
+func checkAddr(key, value string) error {
+	if value == "" {
+		return nil
+	}
+	_, port, err := net.SplitHostPort(value)
+	if err != nil {
+		return fmt.Errorf("%s: %q is not host:port", key, value)
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		return fmt.Errorf("%s: %q is not host:port", key, value)
+	}
+	return checkPort(key, int32(p), false)
+}
+
+func checkICEServers(key string, servers []webrtc.ICEServer) []error {
+	var errs []error
+	for i, s := range servers {
+		if len(s.URLs) == 0 {
+			errs = append(errs, fmt.Errorf("%s[%d]: no urls", key, i))
+		}
+		for _, v := range s.URLs {
+			u, err := ice.ParseURL(v)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s[%d]: %q: %v", key, i, v, err))
+				continue
+			}
+			if (u.Scheme == ice.SchemeTypeTURN || u.Scheme == ice.SchemeTypeTURNS) && (s.Username == "" || s.Credential == nil) {
+				errs = append(errs, fmt.Errorf("%s[%d]: %q needs username and credential", key, i, v))
+			}
+		}
+	}
+	return errs
+}
+
+func sortedTunnels(tunnels map[string]TunnelConf) []string {
+	ret := make([]string, 0, len(tunnels))
+	for k := range tunnels {
+		ret = append(ret, k)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+func sortedKeys(keys map[string]string) []string {
+	ret := make([]string, 0, len(keys))
+	for k := range keys {
+		ret = append(ret, k)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+func (c Configure) checkTunnel(name string, t TunnelConf) error {
+	key := "tunnels." + name
+	if name == "" || strings.ContainsAny(name, " \t/.") {
+		return fmt.Errorf("tunnels: %q is not a valid name", name)
+	}
+	if err := checkPort(key+".localport", t.LocalPort, false); err != nil {
+		return err
+	}
+	if err := checkPort(key+".remoteport", t.RemotePort, false); err != nil {
+		return err
+	}
+	if t.Host == "" {
+		return fmt.Errorf("%s.host: empty", key)
+	}
+	if _, err := c.Profile(t.Profile); err != nil {
+		return fmt.Errorf("%s.profile: %v", key, err)
+	}
+	return nil
+}
+
+// checkDestinations checks the patterns of acl.destinations
+func checkDestinations(key string, patterns []string) []error {
+	var errs []error
+	for _, v := range patterns {
+		if p := strings.TrimPrefix(v, "unix:"); p != v {
+			if _, err := path.Match(p, ""); err != nil || !path.IsAbs(p) {
+				errs = append(errs, fmt.Errorf("%s: %q is not an absolute path pattern", key, v))
+			}
+			continue
+		}
+		host, port, err := net.SplitHostPort(v)
+		if err != nil || host == "" {
+			errs = append(errs, fmt.Errorf("%s: %q is not host:port or unix:/path", key, v))
+			continue
+		}
+		if _, err := path.Match(host, ""); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %q: %v", key, v, err))
+		}
+		if p, err := strconv.Atoi(port); port != "*" && (err != nil || checkPort(key, int32(p), false) != nil) {
+			errs = append(errs, fmt.Errorf("%s: %q has no valid port or *", key, v))
+		}
+	}
+	return errs
+}
+
+// checkKey checks a fingerprint of acl.keys, only sha-256 is written by
+// pion
+func checkKey(key, value string) error {
+	sps := strings.Fields(value)
+	if len(sps) != 2 || !strings.EqualFold(sps[0], "sha-256") {
+		return fmt.Errorf("%s: %q is not like sha-256 AB:CD:..., see sshx conf key", key, value)
+	}
+	hexes := strings.Split(sps[1], ":")
+	for _, v := range hexes {
+		if _, err := strconv.ParseUint(v, 16, 8); err != nil || len(v) != 2 {
+			return fmt.Errorf("%s: %q is not like sha-256 AB:CD:..., see sshx conf key", key, value)
+		}
+	}
+	if len(hexes) != 32 {
+		return fmt.Errorf("%s: %q is not a sha-256 fingerprint", key, value)
+	}
+	return nil
+}
+
+// checkHost keeps names usable in user@name:path addresses
+func checkHost(name string, h HostConf) error {
+	if name == "" || strings.ContainsAny(name, "@: \t/") {
+		return fmt.Errorf("hosts: %q is not a valid name, it may not contain @, :, / or spaces", name)
+	}
+	if h.ID == "" {
+		return fmt.Errorf("hosts.%s.id: empty", name)
+	}
+	switch h.Transport {
+	case "", TRANSPORT_DIRECT, TRANSPORT_WEBRTC:
+	default:
+		return fmt.Errorf("hosts.%s.transport: %q is not direct or webrtc", name, h.Transport)
+	}
+	return nil
+}
+
+// Validate checks values a running node cannot work with, it reports
+// every problem it finds
+func (c Configure) Validate() error {
+	var errs []string
+	add := func(err error) {
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if c.ID == "" {
+		add(fmt.Errorf("id: empty"))
+	}
+	if c.Version > CONFIG_VERSION {
+		add(fmt.Errorf("version: %d is newer than %d, upgrade sshx", c.Version, CONFIG_VERSION))
+	}
+	add(checkURL("signalingserveraddr", c.SignalingServerAddr))
+	add(checkPort("localtcpport", c.LocalTCPPort, true))
+	add(checkPort("localsshport", c.LocalSSHPort, false))
+	add(checkPort("localhttpport", c.LocalHTTPPort, false))
+	if c.DirectPort != DIRECT_PORT_DISABLED {
+		add(checkPort("directport", c.DirectPort, true))
+	}
+	add(checkAddr("metricsaddr", c.MetricsAddr))
+	for _, err := range checkICEServers("rtcconf.iceservers", c.RTCConf.ICEServers) {
+		add(err)
+	}
+	switch c.Transfer.GetPolicy() {
+	case TRANSFER_POLICY_ACCEPT, TRANSFER_POLICY_ASK, TRANSFER_POLICY_REJECT:
+	default:
+		add(fmt.Errorf("transfer.policy: %q is not accept, ask or reject", c.Transfer.Policy))
+	}
+	if c.Transfer.Quota < 0 {
+		add(fmt.Errorf("transfer.quota: negative"))
+	}
+	if _, err := qos.ParseRate(c.Limit.Global); err != nil {
+		add(fmt.Errorf("limit.global: %v", err))
+	}
+	for k, v := range c.Limit.Apps {
+		if _, err := qos.ParseRate(v); err != nil {
+			add(fmt.Errorf("limit.apps.%s: %v", k, err))
+		}
+	}
+	for name, h := range c.Hosts {
+		add(checkHost(name, h))
+	}
+	for _, err := range checkDestinations("acl.destinations", c.ACL.Destinations) {
+		add(err)
+	}
+	for _, id := range sortedKeys(c.ACL.Keys) {
+		add(checkKey("acl.keys."+id, c.ACL.Keys[id]))
+	}
+	if (c.Presence.Group == "") != (c.Presence.Token == "") {
+		add(fmt.Errorf(`presence: group and token go together, set both with presence '{"group": ..., "token": ...}'`))
+	}
+	for name, p := range c.Profiles {
+		key := "profiles." + name
+		if name == "" || strings.ContainsAny(name, " \t/.") {
+			add(fmt.Errorf("profiles: %q is not a valid name", name))
+		}
+		if p.SignalingServerAddr != "" {
+			add(checkURL(key+".signalingserveraddr", p.SignalingServerAddr))
+		}
+		for _, err := range checkICEServers(key+".rtcconf.iceservers", p.RTCConf.ICEServers) {
+			add(err)
+		}
+		for _, err := range checkDestinations(key+".acl.destinations", p.ACL.Destinations) {
+			add(err)
+		}
+		for _, id := range sortedKeys(p.ACL.Keys) {
+			add(checkKey(key+".acl.keys."+id, p.ACL.Keys[id]))
+		}
+		if (p.Presence.Group == "") != (p.Presence.Token == "") {
+			add(fmt.Errorf(`%s.presence: group and token go together, set both with %s.presence '{"group": ..., "token": ...}'`, key, key))
+		}
+	}
+	ports := make(map[int32]string)
+	for _, name := range sortedTunnels(c.Tunnels) {
+		add(c.checkTunnel(name, c.Tunnels[name]))
+		if other, ok := ports[c.Tunnels[name].LocalPort]; ok {
+			add(fmt.Errorf("tunnels.%s.localport: %d is used by %s", name, c.Tunnels[name].LocalPort, other))
+		}
+		ports[c.Tunnels[name].LocalPort] = name
+	}
+	// one node may not be on a signaling server twice
+	seen := map[string]string{c.ID + " at " + c.SignalingServerAddr: "the top level"}
+	for _, name := range c.ProfileNames() {
+		p, _ := c.Profile(name)
+		k := p.ID + " at " + p.SignalingServerAddr
+		if other, ok := seen[k]; ok {
+			add(fmt.Errorf("profiles.%s: same id and signaling server as %s", name, other))
+		}
+		seen[k] = "profile " + name
+	}
+	if len(errs) > 0 {
+		sort.Strings(errs)
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// ValidateFile checks a configure file without loading it, older versions
+// are checked as they would be migrated
+func ValidateFile(file string) error {
+	_, raw, version, err := readRaw(file)
+	if err != nil {
+		return err
+	}
+	if version < CONFIG_VERSION {
+		err = upgrade(raw, version)
+		if err != nil {
+			return err
+		}
+	}
+	known := map[string]bool{"version": true}
+	for k := range Schema {
+		known[strings.Split(k, ".")[0]] = true
+	}
+	var errs []string
+	for k := range raw {
+		if !known[strings.ToLower(k)] {
+			errs = append(errs, fmt.Sprintf("%s: unknown key", k))
+		}
+	}
+	vp := viper.New()
+	err = vp.MergeConfigMap(raw)
+	if err != nil {
+		return err
+	}
+	var c Configure
+	err = vp.Unmarshal(&c)
+	if err != nil {
+		errs = append(errs, err.Error())
+	} else if err = c.Validate(); err != nil {
+		errs = append(errs, err.Error())
+	}
+	if len(errs) > 0 {
+		sort.Strings(errs)
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package conf
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var testKey = "sha-256 " + strings.TrimSuffix(strings.Repeat("AB:", 32), ":")
+
+func TestParseValue(t *testing.T) {
+	tests := []struct {
+		key   string
+		value string
+		want  interface{}
+		err   bool
+	}{
+		{"localsshport", "22", int32(22), false},
+		{"LocalSSHPort", "22", int32(22), false},
+		{"localsshport", "0", nil, true},
+		{"localsshport", "70000", nil, true},
+		{"localsshport", "ssh", nil, true},
+		{"localtcpport", "0", int32(0), false},
+		{"localtcpport", "-1", nil, true},
+		{"directport", "0", int32(0), false},
+		{"directport", "-1", int32(DIRECT_PORT_DISABLED), false},
+		{"directport", "-2", nil, true},
+		{"transfer.quota", "1024", int64(1024), false},
+		{"transfer.quota", "1K", nil, true},
+		{"signalingserveraddr", "http://example.com:5003", "http://example.com:5003", false},
+		{"signalingserveraddr", "example.com", nil, true},
+		{"metricsaddr", "", "", false},
+		{"metricsaddr", "127.0.0.1:9100", "127.0.0.1:9100", false},
+		{"metricsaddr", "9100", nil, true},
+		{"limit.global", "5M", "5M", false},
+		{"limit.apps.transfer", "512K", "512K", false},
+		{"limit.apps.transfer", "fast", nil, true},
+		{"transfer.exportedroots", " /a, ,/b ", []string{"/a", "/b"}, false},
+		{"transfer.policy", "ask", "ask", false},
+		{"transfer.policy", "maybe", nil, true},
+		{"limit.apps", `{"scp": "2M"}`, map[string]interface{}{"scp": "2M"}, false},
+		{"limit.apps", `{"scp": `, nil, true},
+		{"acl.keys.node-a", testKey, testKey, false},
+		{"acl.keys.node-a", "sha-256 AB:CD", nil, true},
+		{"acl.keys.node-a", "md5 " + testKey[8:], nil, true},
+		{"profiles.staging.signalingserveraddr", "https://example.com", "https://example.com", false},
+		{"profiles.staging.acl.keys.node-a", testKey, testKey, false},
+		{"presence", `{"group": "home", "token": "t"}`, map[string]interface{}{"group": "home", "token": "t"}, false},
+		{"profiles.staging.presence", `{"group": "work", "token": "t"}`, map[string]interface{}{"group": "work", "token": "t"}, false},
+		{"profiles.staging.localsshport", "22", nil, true},
+		{"nosuchkey", "1", nil, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseValue(tt.key, tt.value)
+		if (err != nil) != tt.err {
+			t.Errorf("ParseValue(%q, %q): err %v, want error %v", tt.key, tt.value, err, tt.err)
+			continue
+		}
+		if !tt.err && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseValue(%q, %q) = %#v, want %#v", tt.key, tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(c *Configure)
+		want   string
+	}{
+		{"defaults", func(c *Configure) {}, ""},
+		{"bad port", func(c *Configure) { c.LocalSSHPort = 0 }, "localsshport"},
+		{"direct disabled", func(c *Configure) { c.DirectPort = DIRECT_PORT_DISABLED }, ""},
+		{"bad direct port", func(c *Configure) { c.DirectPort = -2 }, "directport"},
+		{"bad policy", func(c *Configure) { c.Transfer.Policy = "maybe" }, "transfer.policy"},
+		{"negative quota", func(c *Configure) { c.Transfer.Quota = -1 }, "transfer.quota"},
+		{"bad rate", func(c *Configure) { c.Limit.Global = "fast" }, "limit.global"},
+		{"relative socket pattern", func(c *Configure) { c.ACL.Destinations = []string{"unix:run/*.sock"} }, "acl.destinations"},
+		{"destination without port", func(c *Configure) { c.ACL.Destinations = []string{"10.0.0.1"} }, "acl.destinations"},
+		{"bad key", func(c *Configure) { c.ACL.Keys = map[string]string{"node-a": "AB:CD"} }, "acl.keys"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewDefaultConfigure()
+			tt.change(&c)
+			err := c.Validate()
+			if tt.want == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("got %v, want an error about %s", err, tt.want)
+			}
+		})
+	}
+}
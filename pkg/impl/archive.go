@@ -0,0 +1,305 @@
+package impl
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// isArchive reports whether paths must be sent as an archive rather than a
+// single regular file
+func isArchive(paths []string) (bool, error) {
+	if len(paths) == 0 {
+		return false, fmt.Errorf("no file to transfer")
+	}
+	if len(paths) > 1 {
+		return true, checkNames(paths)
+	}
+	fInfo, err := os.Stat(paths[0])
+	if err != nil {
+		return false, err
+	}
+	return fInfo.IsDir(), nil
+}
+
+// archiveSize sums up regular file sizes under paths, used for progress
+func archiveSize(paths []string) (int64, error) {
+	var size int64
+	for _, p := range paths {
+		err := filepath.Walk(p, func(file string, fInfo os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if fInfo.Mode().IsRegular() {
+				size += fInfo.Size()
+			}
+			return nil
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+	return size, nil
+}
+
+// checkNames refuses paths sharing a base name, like a/x and b/x, their
+// entries would overwrite each other in the archive
+func checkNames(paths []string) error {
+	seen := make(map[string]string)
+	for _, p := range paths {
+		abs, err := filepath.Abs(p)
+		if err != nil {
+			return err
+		}
+		name := filepath.Base(abs)
+		if other, ok := seen[name]; ok {
+			return fmt.Errorf("%s and %s would both be stored as %s", other, p, name)
+		}
+		seen[name] = p
+	}
+	return nil
+}
+
+// writeArchive writes paths as a tar stream. Every path is stored under its
+// base name, symlinks are stored as links and not followed.
+func writeArchive(w io.Writer, paths []string, progress io.Writer) error {
+	err := checkNames(paths)
+	if err != nil {
+		return err
+	}
+	tw := tar.NewWriter(w)
+	for _, p := range paths {
+		p, err := filepath.Abs(p)
+		if err != nil {
+			return err
+		}
+		base := filepath.Dir(p)
+		err = filepath.Walk(p, func(file string, fInfo os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			link := ""
+			if fInfo.Mode()&os.ModeSymlink != 0 {
+				link, err = os.Readlink(file)
+				if err != nil {
+					return err
+				}
+			}
+			hdr, err := tar.FileInfoHeader(fInfo, link)
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(base, file)
+			if err != nil {
+				return err
+			}
+			hdr.Name = filepath.ToSlash(rel)
+			if fInfo.IsDir() {
+				hdr.Name += "/"
+			}
+			err = tw.WriteHeader(hdr)
+			if err != nil {
+				return err
+			}
+			if !fInfo.Mode().IsRegular() {
+				return nil
+			}
+			f, err := os.Open(file)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			_, err = io.Copy(io.MultiWriter(tw, progress), f)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+func within(root, target string) bool {
+	rel, err := filepath.Rel(root, target)
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// safeJoin joins an archive entry name to root and refuses names escaping it
+func safeJoin(root, name string) (string, error) {
+	target := filepath.Join(root, filepath.FromSlash(name))
+	if !within(root, target) {
+		return "", fmt.Errorf("illegal path %s in archive", name)
+	}
+	return target, nil
+}
+
+// makeParent creates the missing parent directories of target below root.
+// Existing components must be real directories, writing through a symlink
+// could leave root.
+func makeParent(root, target string) error {
+	rel, err := filepath.Rel(root, filepath.Dir(target))
+	if err != nil {
+		return err
+	}
+	if rel == "." {
+		return nil
+	}
+	dir := root
+	for _, name := range strings.Split(rel, string(filepath.Separator)) {
+		dir = filepath.Join(dir, name)
+		fInfo, err := os.Lstat(dir)
+		if os.IsNotExist(err) {
+			err = os.Mkdir(dir, 0755)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if !fInfo.IsDir() {
+			return fmt.Errorf("%s in archive: %s is not a directory", target, dir)
+		}
+	}
+	return nil
+}
+
+// notSymlink refuses to write to target if it is an existing symlink
+func notSymlink(target string) error {
+	fInfo, err := os.Lstat(target)
+	if err == nil && fInfo.Mode()&os.ModeSymlink != 0 {
+		return fmt.Errorf("%s in archive: refuse to write through symlink", target)
+	}
+	return nil
+}
+
+// extractArchive unpacks a tar stream into root, keeping mode, mtime and
+// symlinks. Entries and link targets must stay inside root.
+func extractArchive(r io.Reader, root string, progress io.Writer) error {
+	type dirAttr struct {
+		path  string
+		mode  os.FileMode
+		mtime time.Time
+	}
+	dirs := make([]dirAttr, 0)
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		target, err := safeJoin(root, hdr.Name)
+		if err != nil {
+			return err
+		}
+		mode := os.FileMode(hdr.Mode).Perm()
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = makeParent(root, target)
+			if err != nil {
+				return err
+			}
+			err = notSymlink(target)
+			if err != nil {
+				return err
+			}
+			err = os.MkdirAll(target, 0755)
+			if err != nil {
+				return err
+			}
+			dirs = append(dirs, dirAttr{target, mode, hdr.ModTime})
+		case tar.TypeReg:
+			err = makeParent(root, target)
+			if err != nil {
+				return err
+			}
+			err = notSymlink(target)
+			if err != nil {
+				return err
+			}
+			f, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(io.MultiWriter(f, progress), tr)
+			f.Close()
+			if err != nil {
+				return err
+			}
+			os.Chmod(target, mode)
+			os.Chtimes(target, hdr.ModTime, hdr.ModTime)
+		case tar.TypeSymlink:
+			if filepath.IsAbs(hdr.Linkname) || !within(root, filepath.Join(filepath.Dir(target), hdr.Linkname)) {
+				return fmt.Errorf("illegal link %s -> %s in archive", hdr.Name, hdr.Linkname)
+			}
+			err = makeParent(root, target)
+			if err != nil {
+				return err
+			}
+			os.Remove(target)
+			err = os.Symlink(hdr.Linkname, target)
+			if err != nil {
+				return err
+			}
+		default:
+			logrus.Warn("skip unsupported archive entry ", hdr.Name)
+		}
+	}
+	// directory attributes last, writing files into them changes mtime
+	for i := len(dirs) - 1; i >= 0; i-- {
+		os.Chmod(dirs[i].path, dirs[i].mode)
+		os.Chtimes(dirs[i].path, dirs[i].mtime, dirs[i].mtime)
+	}
+	return nil
+}
+
+// tarToZip converts a tar stream to a zip archive, for browsers
+func tarToZip(r io.Reader, w io.Writer, progress io.Writer) error {
+	zw := zip.NewWriter(w)
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		fh, err := zip.FileInfoHeader(hdr.FileInfo())
+		if err != nil {
+			return err
+		}
+		fh.Name = hdr.Name
+		if hdr.Typeflag == tar.TypeReg {
+			fh.Method = zip.Deflate
+		}
+		fw, err := zw.CreateHeader(fh)
+		if err != nil {
+			return err
+		}
+		switch hdr.Typeflag {
+		case tar.TypeReg:
+			_, err = io.Copy(io.MultiWriter(fw, progress), tr)
+		case tar.TypeSymlink:
+			_, err = fw.Write([]byte(hdr.Linkname))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
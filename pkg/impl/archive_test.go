@@ -0,0 +1,158 @@
+package impl
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// tarOf builds a tar stream of entries, a name ending in / is a directory
+// and a content starting with -> a symlink
+func tarOf(t *testing.T, entries [][2]string) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range entries {
+		hdr := &tar.Header{Name: e[0], Mode: 0644}
+		switch {
+		case strings.HasSuffix(e[0], "/"):
+			hdr.Typeflag = tar.TypeDir
+			hdr.Mode = 0755
+		case strings.HasPrefix(e[1], "->"):
+			hdr.Typeflag = tar.TypeSymlink
+			hdr.Linkname = e[1][2:]
+		default:
+			hdr.Typeflag = tar.TypeReg
+			hdr.Size = int64(len(e[1]))
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			tw.Write([]byte(e[1]))
+		}
+	}
+	tw.Close()
+	return &buf
+}
+
+func TestWriteArchiveCollision(t *testing.T) {
+	dir := t.TempDir()
+	for _, p := range []string{"a/x", "b/x"} {
+		os.MkdirAll(filepath.Join(dir, filepath.Dir(p)), 0755)
+		ioutil.WriteFile(filepath.Join(dir, p), []byte(p), 0644)
+	}
+	paths := []string{filepath.Join(dir, "a/x"), filepath.Join(dir, "b/x")}
+	if _, err := isArchive(paths); err == nil {
+		t.Fatal("isArchive accepted two paths named x")
+	}
+	var buf bytes.Buffer
+	if err := writeArchive(&buf, paths, ioutil.Discard); err == nil {
+		t.Fatal("writeArchive accepted two paths named x")
+	}
+	if buf.Len() != 0 {
+		t.Fatalf("%d bytes written before the collision was found", buf.Len())
+	}
+}
+
+func TestExtractArchiveRefuses(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries [][2]string
+	}{
+		{"parent escape", [][2]string{{"../evil", "x"}}},
+		{"absolute link", [][2]string{{"l", "->/etc/passwd"}}},
+		{"link escape", [][2]string{{"l", "->../../etc"}}},
+		{"write through archive link", [][2]string{{"sub/", ""}, {"l", "->sub"}, {"l/f", "x"}}},
+		{"write through inbox link to file", [][2]string{{"outside-file", "x"}}},
+		{"write through inbox link to dir", [][2]string{{"outside-dir/f", "x"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			outside := t.TempDir()
+			root := t.TempDir()
+			ioutil.WriteFile(filepath.Join(outside, "file"), []byte("keep"), 0644)
+			os.Symlink(filepath.Join(outside, "file"), filepath.Join(root, "outside-file"))
+			os.Symlink(outside, filepath.Join(root, "outside-dir"))
+
+			if err := extractArchive(tarOf(t, tt.entries), root, ioutil.Discard); err == nil {
+				t.Fatal("archive extracted")
+			}
+			bs, _ := ioutil.ReadFile(filepath.Join(outside, "file"))
+			if string(bs) != "keep" {
+				t.Fatalf("file outside root overwritten with %q", bs)
+			}
+			if _, err := os.Stat(filepath.Join(outside, "f")); err == nil {
+				t.Fatal("file written outside root")
+			}
+		})
+	}
+}
+
+func TestArchiveRoundTrip(t *testing.T) {
+	src := t.TempDir()
+	files := map[string]string{
+		"dir/a.txt":         "a",
+		"dir/sub/b.txt":     "bb",
+		"dir/sub/deep/c.sh": "#!/bin/sh",
+		"single.txt":        "single",
+	}
+	for name, content := range files {
+		p := filepath.Join(src, name)
+		os.MkdirAll(filepath.Dir(p), 0755)
+		ioutil.WriteFile(p, []byte(content), 0644)
+	}
+	os.Chmod(filepath.Join(src, "dir/sub/deep/c.sh"), 0700)
+	os.MkdirAll(filepath.Join(src, "dir/empty"), 0750)
+	os.Symlink("sub/b.txt", filepath.Join(src, "dir/link"))
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	os.Chtimes(filepath.Join(src, "dir/a.txt"), mtime, mtime)
+	os.Chtimes(filepath.Join(src, "dir/sub"), mtime, mtime)
+
+	paths := []string{filepath.Join(src, "dir"), filepath.Join(src, "single.txt")}
+	size, err := archiveSize(paths)
+	if err != nil || size != int64(len("a")+len("bb")+len("#!/bin/sh")+len("single")) {
+		t.Fatalf("archive size %d, %v", size, err)
+	}
+	var buf bytes.Buffer
+	if err := writeArchive(&buf, paths, ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+	dst := t.TempDir()
+	if err := extractArchive(&buf, dst, ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, content := range files {
+		bs, err := ioutil.ReadFile(filepath.Join(dst, name))
+		if err != nil || string(bs) != content {
+			t.Errorf("%s: %q, %v", name, bs, err)
+		}
+	}
+	modes := map[string]os.FileMode{
+		"dir/sub/deep/c.sh": 0700,
+		"dir/a.txt":         0644,
+		"dir/empty":         os.ModeDir | 0750,
+	}
+	for name, mode := range modes {
+		fInfo, err := os.Stat(filepath.Join(dst, name))
+		if err != nil || fInfo.Mode() != mode {
+			t.Errorf("%s: mode %v, want %v, %v", name, fInfo.Mode(), mode, err)
+		}
+	}
+	for _, name := range []string{"dir/a.txt", "dir/sub"} {
+		fInfo, err := os.Stat(filepath.Join(dst, name))
+		if err != nil || !fInfo.ModTime().Equal(mtime) {
+			t.Errorf("%s: mtime %v, want %v", name, fInfo.ModTime(), mtime)
+		}
+	}
+	link, err := os.Readlink(filepath.Join(dst, "dir/link"))
+	if err != nil || link != "sub/b.txt" {
+		t.Errorf("link to %q, %v", link, err)
+	}
+}
@@ -4,7 +4,11 @@ import (
 	"io"
 	"net"
 	"reflect"
+	"strings"
 	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/suutaku/sshx/pkg/conf"
 )
 
 const flagLen = 8
@@ -42,6 +46,29 @@ type Impl interface {
 	IsNeedConnect() bool
 	SetRemotePort(int32) error
 	GetRemotePort() int32
+	// destination on the side of the peer, host:port or unix:/path
+	SetRemoteAddr(string) error
+	GetRemoteAddr() string
+	// rate limit in bytes per second requested for this impl, 0 for none
+	SetLimit(int64)
+	GetLimit() int64
+	// transport the daemon should use for this impl, empty for any
+	SetPreferredTransport(string)
+	PreferredTransport() string
+	// profile of the connection service answering a call
+	SetProfile(string)
+	GetProfile() string
+	// fingerprint the caller proved its id with, empty on transports
+	// without one
+	SetPeerKey(string)
+	GetPeerKey() string
+}
+
+// Datagram is implemented by impls whose connection carries length framed
+// datagrams, see utils.WriteDatagram. Pairs of them send one datagram per
+// message on an unordered and unreliable channel
+type Datagram interface {
+	IsDatagram() bool
 }
 
 var registeddApp = []Impl{
@@ -54,6 +81,10 @@ var registeddApp = []Impl{
 	&Messager{},
 	&Transfer{},
 	&TransferService{},
+	&RemoteStat{},
+	&UDPProxyService{},
+	&SocksService{},
+	&ReverseService{},
 }
 
 func GetRemotePort() int32 {
@@ -75,6 +106,52 @@ func GetImpl(code int32) Impl {
 	return nil
 }
 
+// GetImplCode finds an impl code by its type name, like "transfer"
+func GetImplCode(name string) (int32, bool) {
+	for _, v := range registeddApp {
+		if strings.EqualFold(reflect.TypeOf(v).Elem().Name(), name) {
+			return v.Code(), true
+		}
+	}
+	return 0, false
+}
+
+// Service is implemented by impls answering peers, Enabled tells whether
+// this node serves them with configure c
+type Service interface {
+	Enabled(c conf.Configure) bool
+}
+
+// EnabledApps lists the type names of the services this node answers
+// peers of profile with, for presence
+func EnabledApps(profile string) []string {
+	c, err := profileConf(profile)
+	if err != nil {
+		logrus.Error(err)
+		return nil
+	}
+	return enabledApps(c)
+}
+
+func enabledApps(c conf.Configure) []string {
+	ret := make([]string, 0, len(registeddApp))
+	for _, v := range registeddApp {
+		if s, ok := v.(Service); ok && s.Enabled(c) {
+			ret = append(ret, strings.ToLower(reflect.TypeOf(v).Elem().Name()))
+		}
+	}
+	return ret
+}
+
+// RegisteredApps lists the type names of all supported impls
+func RegisteredApps() []string {
+	ret := make([]string, 0, len(registeddApp))
+	for _, v := range registeddApp {
+		ret = append(ret, strings.ToLower(reflect.TypeOf(v).Elem().Name()))
+	}
+	return ret
+}
+
 func GetImplName(code int32) string {
 	if t := reflect.TypeOf(GetImpl(code)); t.Kind() == reflect.Ptr {
 		return "*" + t.Elem().Name()
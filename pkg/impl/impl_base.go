@@ -1,11 +1,16 @@
 package impl
 
 import (
+	"fmt"
 	"io"
 	"net"
+	"os"
+	"path"
+	"strings"
 	"sync"
 
 	"github.com/sirupsen/logrus"
+	"github.com/suutaku/sshx/pkg/conf"
 )
 
 type BaseImpl struct {
@@ -15,6 +20,13 @@ type BaseImpl struct {
 	PId        string
 	lock       sync.Mutex
 	ConnectNow bool
+	Limit      int64
+	// direct or webrtc, empty for any
+	Transport string
+	// profile of the service which answered a call, set by the responder
+	ProfileName string
+	// set by the responder only, never taken from the caller
+	peerKey string
 }
 
 func NewBaseImpl(hid string) *BaseImpl {
@@ -124,4 +136,109 @@ func (base *BaseImpl) GetRemotePort() int32 {
 
 func (base *BaseImpl) SetRemotePort(port int32) error {
 	return nil
-}
\ No newline at end of file
+}
+
+func (base *BaseImpl) GetRemoteAddr() string {
+	return ""
+}
+
+func (base *BaseImpl) SetRemoteAddr(addr string) error {
+	return nil
+}
+
+func (base *BaseImpl) SetLimit(limit int64) {
+	base.Limit = limit
+}
+
+func (base *BaseImpl) GetLimit() int64 {
+	return base.Limit
+}
+
+func (base *BaseImpl) SetPreferredTransport(transport string) {
+	base.Transport = transport
+}
+
+func (base *BaseImpl) PreferredTransport() string {
+	return base.Transport
+}
+
+func (base *BaseImpl) SetProfile(name string) {
+	base.ProfileName = name
+}
+
+func (base *BaseImpl) GetProfile() string {
+	return base.ProfileName
+}
+
+func (base *BaseImpl) SetPeerKey(key string) {
+	base.peerKey = key
+}
+
+func (base *BaseImpl) GetPeerKey() string {
+	return base.peerKey
+}
+
+// authenticate checks the caller holds the key pinned for its id in
+// acl.keys, ids alone are claimed by the caller
+func (base *BaseImpl) authenticate(acl conf.ACLConf) error {
+	caller := base.HostId()
+	if base.peerKey == "" {
+		return fmt.Errorf("peer %s did not prove its id, acl services need webrtc", caller)
+	}
+	if !acl.Verify(caller, base.peerKey) {
+		return fmt.Errorf("peer %s proved key %s, pin it with sshx conf set acl.keys.%s to trust it", caller, base.peerKey, strings.ToLower(caller))
+	}
+	return nil
+}
+
+// liveConf is the configure of the daemon, set by the daemon
+var liveConf *conf.ConfManager
+
+func SetConfManager(cm *conf.ConfManager) {
+	liveConf = cm
+}
+
+// confManager returns the configure of the daemon, commands outside of it
+// read the file and fail if there is none
+func confManager() (*conf.ConfManager, error) {
+	if liveConf != nil {
+		return liveConf, nil
+	}
+	return conf.OpenConfManager("")
+}
+
+// currentConf returns a copy of the configure in use
+func currentConf() (conf.Configure, error) {
+	cm, err := confManager()
+	if err != nil {
+		return conf.Configure{}, err
+	}
+	return cm.Current(), nil
+}
+
+// profileConf returns the configure of a signaling network, see
+// conf.Configure.Profile
+func profileConf(name string) (conf.Configure, error) {
+	c, err := currentConf()
+	if err != nil {
+		return c, err
+	}
+	return c.Profile(name)
+}
+
+// resolveHost takes name from the address book if it is there
+func resolveHost(name string) conf.HostConf {
+	c, err := currentConf()
+	if err != nil {
+		logrus.Error(err)
+		return conf.HostConf{ID: name}
+	}
+	host, ok := c.ResolveHost(name)
+	if ok {
+		logrus.Debug("host ", name, " is ", host.ID)
+		if strings.HasPrefix(host.Identity, "~/") {
+			host.Identity = path.Join(os.Getenv("HOME"), host.Identity[2:])
+		}
+	}
+	return host
+}
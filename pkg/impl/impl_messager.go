@@ -9,6 +9,7 @@ import (
 
 	"github.com/martinlindhe/notify"
 	"github.com/sirupsen/logrus"
+	"github.com/suutaku/sshx/pkg/conf"
 	"github.com/suutaku/sshx/pkg/types"
 	"golang.org/x/term"
 )
@@ -28,17 +29,27 @@ type Messager struct {
 }
 
 func NewMessager(hostId string) *Messager {
-	return &Messager{
+	ret := &Messager{
 		BaseImpl: *NewBaseImpl(hostId),
 		sendChan: make(chan Message, 1024),
 		recvChan: make(chan Message, 1024),
 	}
+	if hostId != "" {
+		host := resolveHost(hostId)
+		ret.HId = host.ID
+		ret.Transport = host.Transport
+	}
+	return ret
 }
 
 func (m *Messager) Code() int32 {
 	return types.APP_TYPE_MESSAGER
 }
 
+func (m *Messager) Enabled(c conf.Configure) bool {
+	return true
+}
+
 func (m *Messager) OpenUI() error {
 	m.UIOpened = true
 	return nil
@@ -3,6 +3,8 @@ package impl
 import (
 	"fmt"
 	"net"
+	"os"
+	"time"
 
 	"github.com/sirupsen/logrus"
 	"github.com/suutaku/sshx/internal/utils"
@@ -16,6 +18,18 @@ type Proxy struct {
 	RemotePort int32
 	Running     bool
 	ProxyHostId string
+	// forward udp instead of tcp
+	UDP bool
+	// close udp flows without datagrams for this long
+	Idle time.Duration
+	// serve socks5 and http CONNECT, the peer dials the requested hosts
+	Socks bool
+	// the peer listens on RemotePort and forwards to our ProxyPort
+	Reverse bool
+	// host:port or unix:/path the peer dials instead of its RemotePort
+	RemoteAddr string
+	// unix socket to listen on instead of ProxyPort
+	ListenSocket string
 }
 
 func NewProxy(port int32, remoteport int32, host string) *Proxy {
@@ -28,6 +42,9 @@ func NewProxy(port int32, remoteport int32, host string) *Proxy {
 
 func (base *Proxy) Preper() error {
 	logrus.Debug("Preper impl proxy")
+	host := resolveHost(base.ProxyHostId)
+	base.ProxyHostId = host.ID
+	base.Transport = host.Transport
 	return nil
 }
 
@@ -36,13 +53,21 @@ func (p *Proxy) Code() int32 {
 }
 
 func (p *Proxy) Start() error {
-	conf.ClearKnownHosts(fmt.Sprintf("127.0.0.1:%d", p.ProxyPort))
+	if p.UDP {
+		return p.startUDP()
+	}
+	if p.Socks {
+		return p.startSocks()
+	}
+	if p.Reverse {
+		return p.startReverse()
+	}
 	p.Running = true
-	listenner, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", p.ProxyPort))
+	listenner, err := p.listen()
 	if err != nil {
 		return err
 	}
-	fmt.Println("Proxy for", p.ProxyHostId, ":", p.RemotePort, " at :", p.ProxyPort)
+	fmt.Println("Proxy for", p.ProxyHostId, ":", p.target(), " at", listenner.Addr())
 
 	for p.Running {
 		conn, err := listenner.Accept()
@@ -58,6 +83,35 @@ func (p *Proxy) Start() error {
 	return nil
 }
 
+// listen opens the local side of the proxy
+func (p *Proxy) listen() (net.Listener, error) {
+	if p.ListenSocket == "" {
+		conf.ClearKnownHosts(fmt.Sprintf("127.0.0.1:%d", p.ProxyPort))
+		return net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", p.ProxyPort))
+	}
+	// a socket left by a proxy which died, nobody answers on it
+	if fi, err := os.Lstat(p.ListenSocket); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if c, err := net.Dial("unix", p.ListenSocket); err == nil {
+			c.Close()
+			return nil, fmt.Errorf("%s is in use", p.ListenSocket)
+		}
+		os.Remove(p.ListenSocket)
+	}
+	l, err := net.Listen("unix", p.ListenSocket)
+	if err != nil {
+		return nil, err
+	}
+	return l, os.Chmod(p.ListenSocket, 0600)
+}
+
+// target is what the peer dials, for messages
+func (p *Proxy) target() string {
+	if p.RemoteAddr != "" {
+		return p.RemoteAddr
+	}
+	return fmt.Sprint(p.RemotePort)
+}
+
 func (p *Proxy) Response() error {
 	logrus.Debug("Response impl proxy")
 	return nil
@@ -85,8 +139,11 @@ func (p *Proxy) doDial(inconn net.Conn) {
 			ConnectNow: true,
 		},
 		RemotePort: p.RemotePort,
+		RemoteAddr: p.RemoteAddr,
 	}
-	logrus.Debug("Dial to ", p.ProxyHostId, ":", p.RemotePort)
+	imp.SetLimit(p.GetLimit())
+	imp.SetPreferredTransport(p.PreferredTransport())
+	logrus.Debug("Dial to ", p.ProxyHostId, ":", p.target())
 
 	imp.SetParentId(p.PairId())
 	sender := NewSender(imp, types.OPTION_TYPE_UP)
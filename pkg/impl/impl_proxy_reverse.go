@@ -0,0 +1,50 @@
+package impl
+
+import (
+	"encoding/gob"
+	"fmt"
+	"io"
+
+	"github.com/sirupsen/logrus"
+	"github.com/suutaku/sshx/pkg/types"
+)
+
+// startReverse asks the peer to listen on RemotePort and to send every
+// connection back to ProxyPort, it returns when the pair to the peer is
+// closed, by sshx proxy stop too
+func (p *Proxy) startReverse() error {
+	imp := &ReverseService{
+		BaseImpl: BaseImpl{
+			HId:        p.ProxyHostId,
+			ConnectNow: true,
+		},
+	}
+	imp.SetPreferredTransport(p.PreferredTransport())
+	imp.SetParentId(p.PairId())
+	sender := NewSender(imp, types.OPTION_TYPE_UP)
+	conn, err := sender.Send()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	err = gob.NewEncoder(conn).Encode(ReverseRequest{
+		ListenPort: p.RemotePort,
+		TargetPort: p.ProxyPort,
+	})
+	if err != nil {
+		return err
+	}
+	var reply ReverseReply
+	err = gob.NewDecoder(conn).Decode(&reply)
+	if err != nil {
+		return err
+	}
+	if reply.Error != "" {
+		return fmt.Errorf("%s refused: %s", p.ProxyHostId, reply.Error)
+	}
+	p.Running = true
+	fmt.Println("Reverse proxy from", p.ProxyHostId, ":", p.RemotePort, " to :", p.ProxyPort)
+	io.Copy(io.Discard, conn)
+	logrus.Debug("Close reverse proxy from ", p.ProxyHostId)
+	return nil
+}
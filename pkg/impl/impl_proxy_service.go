@@ -5,18 +5,26 @@ import (
 	"net"
 
 	"github.com/sirupsen/logrus"
+	"github.com/suutaku/sshx/pkg/conf"
 	"github.com/suutaku/sshx/pkg/types"
 )
 
 type ProxyService struct {
 	BaseImpl
 	RemotePort int32
+	// host:port or unix:/path to dial instead of our loopback port, it
+	// has to be in acl.destinations
+	RemoteAddr string
 }
 
 func (s *ProxyService) Code() int32 {
 	return types.APP_TYPE_PROXY_SERVICE
 }
 
+func (s *ProxyService) Enabled(c conf.Configure) bool {
+	return true
+}
+
 func (s *ProxyService) Preper() error {
 	return nil
 }
@@ -35,14 +43,50 @@ func (s *ProxyService) SetRemotePort(port int32) error {
 	return nil
 }
 
+func (s *ProxyService) GetRemoteAddr() string {
+	return s.RemoteAddr
+}
+
+func (s *ProxyService) SetRemoteAddr(addr string) error {
+	s.RemoteAddr = addr
+	return nil
+}
+
+// destination is the network and address to dial for the caller
+func (s *ProxyService) destination() (string, string, error) {
+	if s.RemoteAddr == "" {
+		return "tcp", fmt.Sprintf("127.0.0.1:%d", s.RemotePort), nil
+	}
+	caller := s.HostId()
+	cfg, err := profileConf(s.GetProfile())
+	if err != nil {
+		return "", "", err
+	}
+	// other hosts than ours are forwarding, like the socks service
+	if !cfg.ACL.CanForward(caller) {
+		return "", "", fmt.Errorf("peer %s is not in acl.forward, refuse %s", caller, s.RemoteAddr)
+	}
+	if err := s.authenticate(cfg.ACL); err != nil {
+		return "", "", fmt.Errorf("%v, refuse %s", err, s.RemoteAddr)
+	}
+	if !cfg.ACL.AllowsDestination(s.RemoteAddr) {
+		return "", "", fmt.Errorf("%s asked for %s which is not in acl.destinations", caller, s.RemoteAddr)
+	}
+	return conf.ParseDestination(s.RemoteAddr)
+}
+
 func (s *ProxyService) Response() error {
 	s.lock.Lock()
 	defer s.lock.Unlock()
 
 	logrus.Debug("Response impl proxy service")
 
-	logrus.Debug("Dial local addr ", s.RemotePort)
-	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", s.RemotePort))
+	network, addr, err := s.destination()
+	if err != nil {
+		return err
+	}
+	logrus.Debug("Dial ", network, " addr ", addr)
+	conn, err := net.DialTimeout(network, addr, timeout)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,249 @@
+package impl
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/suutaku/sshx/internal/utils"
+	"github.com/suutaku/sshx/pkg/types"
+)
+
+// socks5 reply codes, rfc 1928
+const (
+	SOCKS_REP_SUCCEEDED = iota
+	SOCKS_REP_FAILURE
+	SOCKS_REP_NOT_ALLOWED
+	SOCKS_REP_NET_UNREACHABLE
+	SOCKS_REP_HOST_UNREACHABLE
+	SOCKS_REP_REFUSED
+	SOCKS_REP_TTL_EXPIRED
+	SOCKS_REP_CMD_UNSUPPORTED
+	SOCKS_REP_ATYP_UNSUPPORTED
+)
+
+const (
+	socksVersion    = 5
+	socksCmdConnect = 1
+	socksAtypIPv4   = 1
+	socksAtypDomain = 3
+	socksAtypIPv6   = 4
+	// time a client has to send its request
+	socksHandshakeTimeout = 10 * time.Second
+)
+
+// bufferedConn reads what a bufio.Reader took from the connection first
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (bc *bufferedConn) Read(b []byte) (int, error) {
+	return bc.r.Read(b)
+}
+
+// WriteTo keeps io.Copy from bypassing the buffer through the connection
+func (bc *bufferedConn) WriteTo(w io.Writer) (int64, error) {
+	return bc.r.WriteTo(w)
+}
+
+// startSocks serves socks5 and http CONNECT clients, the peer dials the
+// host of each request from its own network
+func (p *Proxy) startSocks() error {
+	p.Running = true
+	listenner, err := p.listen()
+	if err != nil {
+		return err
+	}
+	defer listenner.Close()
+	fmt.Println("SOCKS5/HTTP proxy through", p.ProxyHostId, "at", listenner.Addr())
+	for p.Running {
+		conn, err := listenner.Accept()
+		if err != nil {
+			continue
+		}
+		go p.serveSocks(conn)
+	}
+	logrus.Debug("Close socks proxy through ", p.ProxyHostId)
+	return nil
+}
+
+// serveSocks tells socks5 from http by the first byte
+func (p *Proxy) serveSocks(inconn net.Conn) {
+	defer inconn.Close()
+	inconn.SetDeadline(time.Now().Add(socksHandshakeTimeout))
+	r := bufio.NewReader(inconn)
+	first, err := r.Peek(1)
+	if err != nil {
+		return
+	}
+	var conn net.Conn
+	if first[0] == socksVersion {
+		conn, err = p.socks5(inconn, r)
+	} else {
+		conn, err = p.httpConnect(inconn, r)
+	}
+	if err != nil {
+		logrus.Debug(err)
+		return
+	}
+	defer conn.Close()
+	inconn.SetDeadline(time.Time{})
+	var client net.Conn = &bufferedConn{Conn: inconn, r: r}
+	utils.Pipe(&client, &conn)
+}
+
+func (p *Proxy) socks5(inconn net.Conn, r *bufio.Reader) (net.Conn, error) {
+	// greeting, only no authentication is offered, the listener is on
+	// loopback
+	head := make([]byte, 2)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return nil, err
+	}
+	methods := make([]byte, head[1])
+	if _, err := io.ReadFull(r, methods); err != nil {
+		return nil, err
+	}
+	noAuth := false
+	for _, v := range methods {
+		noAuth = noAuth || v == 0
+	}
+	if !noAuth {
+		inconn.Write([]byte{socksVersion, 0xff})
+		return nil, fmt.Errorf("socks client without the no authentication method")
+	}
+	if _, err := inconn.Write([]byte{socksVersion, 0}); err != nil {
+		return nil, err
+	}
+
+	req := make([]byte, 4)
+	if _, err := io.ReadFull(r, req); err != nil {
+		return nil, err
+	}
+	if req[1] != socksCmdConnect {
+		socksReply(inconn, SOCKS_REP_CMD_UNSUPPORTED)
+		return nil, fmt.Errorf("unsupported socks command %d", req[1])
+	}
+	var host string
+	switch req[3] {
+	case socksAtypIPv4, socksAtypIPv6:
+		ip := make([]byte, net.IPv4len)
+		if req[3] == socksAtypIPv6 {
+			ip = make([]byte, net.IPv6len)
+		}
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return nil, err
+		}
+		host = net.IP(ip).String()
+	case socksAtypDomain:
+		n, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		name := make([]byte, n)
+		if _, err := io.ReadFull(r, name); err != nil {
+			return nil, err
+		}
+		host = string(name)
+	default:
+		socksReply(inconn, SOCKS_REP_ATYP_UNSUPPORTED)
+		return nil, fmt.Errorf("unsupported socks address type %d", req[3])
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(r, port); err != nil {
+		return nil, err
+	}
+	addr := net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port))))
+
+	conn, reply := p.dialSocks(addr)
+	socksReply(inconn, reply.Code)
+	if conn == nil {
+		return nil, fmt.Errorf("%s: %s", addr, reply.Error)
+	}
+	return conn, nil
+}
+
+// socksReply answers a socks5 request, the bound address is not known
+func socksReply(w io.Writer, code byte) error {
+	_, err := w.Write([]byte{socksVersion, code, 0, socksAtypIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
+
+func (p *Proxy) httpConnect(inconn net.Conn, r *bufio.Reader) (net.Conn, error) {
+	req, err := http.ReadRequest(r)
+	if err != nil {
+		return nil, err
+	}
+	if req.Method != http.MethodConnect {
+		fmt.Fprintf(inconn, "HTTP/1.1 405 Method Not Allowed\r\nAllow: CONNECT\r\nConnection: close\r\n\r\n")
+		return nil, fmt.Errorf("http method %s is not supported", req.Method)
+	}
+	addr := req.Host
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "443")
+	}
+	conn, reply := p.dialSocks(addr)
+	if conn == nil {
+		status := http.StatusBadGateway
+		if reply.Code == SOCKS_REP_NOT_ALLOWED {
+			status = http.StatusForbidden
+		} else if reply.Code == SOCKS_REP_TTL_EXPIRED {
+			status = http.StatusGatewayTimeout
+		}
+		fmt.Fprintf(inconn, "HTTP/1.1 %d %s\r\nConnection: close\r\nContent-Length: %d\r\n\r\n%s",
+			status, http.StatusText(status), len(reply.Error), reply.Error)
+		return nil, fmt.Errorf("%s: %s", addr, reply.Error)
+	}
+	_, err = fmt.Fprintf(inconn, "HTTP/1.1 200 Connection established\r\n\r\n")
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// dialSocks creates a pair to the socks service of the peer and asks it
+// for addr
+func (p *Proxy) dialSocks(addr string) (net.Conn, SocksReply) {
+	imp := &SocksService{
+		BaseImpl: BaseImpl{
+			HId:        p.ProxyHostId,
+			ConnectNow: true,
+		},
+	}
+	imp.SetLimit(p.GetLimit())
+	imp.SetPreferredTransport(p.PreferredTransport())
+	imp.SetParentId(p.PairId())
+	logrus.Debug("socks to ", addr, " through ", p.ProxyHostId)
+	sender := NewSender(imp, types.OPTION_TYPE_UP)
+	conn, err := sender.Send()
+	if err != nil {
+		return nil, SocksReply{Code: SOCKS_REP_FAILURE, Error: err.Error()}
+	}
+	err = gob.NewEncoder(conn).Encode(SocksRequest{Addr: addr})
+	if err != nil {
+		conn.Close()
+		return nil, SocksReply{Code: SOCKS_REP_FAILURE, Error: err.Error()}
+	}
+	// the peer may write right after the reply, keep what the decoder
+	// reads ahead
+	r := bufio.NewReader(conn)
+	var reply SocksReply
+	err = gob.NewDecoder(r).Decode(&reply)
+	if err != nil {
+		conn.Close()
+		return nil, SocksReply{Code: SOCKS_REP_FAILURE, Error: err.Error()}
+	}
+	if reply.Code != SOCKS_REP_SUCCEEDED {
+		conn.Close()
+		return nil, reply
+	}
+	return &bufferedConn{Conn: conn, r: r}, reply
+}
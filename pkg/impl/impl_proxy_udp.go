@@ -0,0 +1,197 @@
+package impl
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/suutaku/sshx/internal/utils"
+	"github.com/suutaku/sshx/pkg/types"
+)
+
+const defaultUDPIdle = time.Minute
+
+// datagrams of a flow queued while its pair is dialed or busy, more are
+// dropped like a full socket buffer would
+const udpQueue = 64
+
+// udpFlow is the pair of one client address of a udp proxy
+type udpFlow struct {
+	conn  net.Conn
+	addr  net.Addr
+	queue chan []byte
+	done  chan struct{}
+	once  sync.Once
+	// unix nanoseconds of the last datagram either way
+	last int64
+}
+
+func newUDPFlow(addr net.Addr) *udpFlow {
+	ret := &udpFlow{
+		addr:  addr,
+		queue: make(chan []byte, udpQueue),
+		done:  make(chan struct{}),
+	}
+	ret.touch()
+	return ret
+}
+
+func (f *udpFlow) touch() {
+	atomic.StoreInt64(&f.last, time.Now().UnixNano())
+}
+
+func (f *udpFlow) idle() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&f.last)))
+}
+
+// push queues a datagram without blocking the listener
+func (f *udpFlow) push(b []byte) {
+	select {
+	case f.queue <- append([]byte(nil), b...):
+	default:
+		logrus.Debug("udp flow of ", f.addr, " busy, drop datagram")
+	}
+}
+
+func (f *udpFlow) close() {
+	f.once.Do(func() {
+		close(f.done)
+	})
+}
+
+// startUDP forwards datagrams of every client address over a pair of its
+// own, flows without traffic are closed after p.Idle
+func (p *Proxy) startUDP() error {
+	p.Running = true
+	pc, err := net.ListenPacket("udp", fmt.Sprintf("127.0.0.1:%d", p.ProxyPort))
+	if err != nil {
+		return err
+	}
+	defer pc.Close()
+	idle := p.Idle
+	if idle <= 0 {
+		idle = defaultUDPIdle
+	}
+	fmt.Println("UDP proxy for", p.ProxyHostId, ":", p.RemotePort, " at :", p.ProxyPort)
+
+	var lock sync.Mutex
+	flows := make(map[string]*udpFlow)
+	defer func() {
+		lock.Lock()
+		for _, f := range flows {
+			f.close()
+		}
+		lock.Unlock()
+	}()
+	go func() {
+		for p.Running {
+			time.Sleep(idle / 4)
+			lock.Lock()
+			for k, f := range flows {
+				if f.idle() > idle {
+					logrus.Debug("close idle udp flow of ", k)
+					f.close()
+					delete(flows, k)
+				}
+			}
+			lock.Unlock()
+		}
+	}()
+	buf := make([]byte, 64*1024)
+	for p.Running {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			return err
+		}
+		if n > utils.MaxDatagramSize {
+			logrus.Debug("drop datagram of ", n, " bytes from ", addr)
+			continue
+		}
+		lock.Lock()
+		f := flows[addr.String()]
+		if f == nil {
+			f = newUDPFlow(addr)
+			flows[addr.String()] = f
+			go func() {
+				p.runFlow(pc, f)
+				lock.Lock()
+				if flows[f.addr.String()] == f {
+					delete(flows, f.addr.String())
+				}
+				lock.Unlock()
+			}()
+		}
+		lock.Unlock()
+		f.touch()
+		f.push(buf[:n])
+	}
+	logrus.Debug("Close udp proxy for ", p.ProxyHostId)
+	return nil
+}
+
+// runFlow dials the pair of a flow off the listener, then writes queued
+// datagrams to it until the flow is closed or the pair breaks
+func (p *Proxy) runFlow(pc net.PacketConn, f *udpFlow) {
+	defer f.close()
+	conn, err := p.dialFlow(f.addr)
+	if err != nil {
+		logrus.Error(err)
+		return
+	}
+	f.conn = conn
+	defer conn.Close()
+	go func() {
+		p.readFlow(pc, f)
+		f.close()
+	}()
+	for {
+		select {
+		case <-f.done:
+			return
+		case b := <-f.queue:
+			err = utils.WriteDatagram(conn, b)
+			if err != nil {
+				logrus.Error(err)
+				return
+			}
+		}
+	}
+}
+
+func (p *Proxy) dialFlow(addr net.Addr) (net.Conn, error) {
+	imp := &UDPProxyService{
+		BaseImpl: BaseImpl{
+			HId:        p.ProxyHostId,
+			ConnectNow: true,
+		},
+		RemotePort: p.RemotePort,
+	}
+	imp.SetLimit(p.GetLimit())
+	imp.SetPreferredTransport(p.PreferredTransport())
+	imp.SetParentId(p.PairId())
+	logrus.Debug("udp flow of ", addr, " to ", p.ProxyHostId, ":", p.RemotePort)
+	sender := NewSender(imp, types.OPTION_TYPE_UP)
+	return sender.Send()
+}
+
+// readFlow writes the answers of the peer back to the client
+func (p *Proxy) readFlow(pc net.PacketConn, f *udpFlow) {
+	buf := make([]byte, utils.MaxDatagramSize)
+	for {
+		b, err := utils.ReadDatagram(f.conn, buf)
+		if err != nil {
+			return
+		}
+		f.touch()
+		_, err = pc.WriteTo(b, f.addr)
+		if err != nil {
+			logrus.Debug(err)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package impl
+
+import (
+	"encoding/gob"
+	"net"
+
+	"github.com/sirupsen/logrus"
+	"github.com/suutaku/sshx/pkg/conf"
+	"github.com/suutaku/sshx/pkg/types"
+)
+
+// statusSource returns the pairs of the local node, set by the daemon
+var statusSource func() []types.Status
+
+func SetStatusSource(f func() []types.Status) {
+	statusSource = f
+}
+
+// RemoteStat reads the pairs a peer node is serving
+type RemoteStat struct {
+	BaseImpl
+}
+
+func NewRemoteStat(hostId string) *RemoteStat {
+	ret := &RemoteStat{
+		BaseImpl: *NewBaseImpl(hostId),
+	}
+	if hostId != "" {
+		host := resolveHost(hostId)
+		ret.HId = host.ID
+		ret.Transport = host.Transport
+	}
+	return ret
+}
+
+func (rs *RemoteStat) Code() int32 {
+	return types.APP_TYPE_REMOTE_STAT
+}
+
+func (rs *RemoteStat) Enabled(c conf.Configure) bool {
+	return true
+}
+
+// Response writes our pairs to the caller, only pairs with the caller
+// unless it is an admin in our ACL. Callers without a pinned key get none,
+// their id is not proven
+func (rs *RemoteStat) Response() error {
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+	c, s := net.Pipe()
+	rs.BaseImpl.conn = &s
+	caller := rs.HostId()
+	go func() {
+		defer c.Close()
+		var all []types.Status
+		// the acl of the profile the caller came through
+		cfg, err := profileConf(rs.GetProfile())
+		if err != nil {
+			logrus.Error(err)
+		} else if err = rs.authenticate(cfg.ACL); err != nil {
+			logrus.Warn(err)
+		}
+		if err == nil && statusSource != nil {
+			all = statusSource()
+		}
+		admin := err == nil && cfg.ACL.IsAdmin(caller)
+		res := make([]types.Status, 0, len(all))
+		for _, v := range all {
+			if v.ImplType == types.APP_TYPE_REMOTE_STAT {
+				continue
+			}
+			if !admin && v.TargetId != caller {
+				continue
+			}
+			res = append(res, v)
+		}
+		logrus.Debug("remote stat for ", caller, " admin ", admin, " pairs ", len(res))
+		err = gob.NewEncoder(c).Encode(res)
+		if err != nil {
+			logrus.Error(err)
+		}
+	}()
+	return nil
+}
+
+// GetStatus reads the status of the peer pairs
+func (rs *RemoteStat) GetStatus() ([]types.Status, error) {
+	var res []types.Status
+	err := gob.NewDecoder(rs.Conn()).Decode(&res)
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
@@ -0,0 +1,151 @@
+package impl
+
+import (
+	"encoding/gob"
+	"fmt"
+	"io"
+	"net"
+
+	"github.com/sirupsen/logrus"
+	"github.com/suutaku/sshx/internal/utils"
+	"github.com/suutaku/sshx/pkg/conf"
+	"github.com/suutaku/sshx/pkg/types"
+)
+
+// localDialer creates pairs from inside the daemon, set by the daemon
+var localDialer func(*Sender) (net.Conn, error)
+
+func SetLocalDialer(f func(*Sender) (net.Conn, error)) {
+	localDialer = f
+}
+
+// ReverseRequest is the first message of a reverse pair, the caller asks
+// us to listen on ListenPort and to send connections back to its
+// TargetPort
+type ReverseRequest struct {
+	ListenPort int32
+	TargetPort int32
+}
+
+type ReverseReply struct {
+	Error string
+}
+
+// ReverseService listens on a port for a peer while the pair is up, every
+// connection goes back to the peer as a proxy pair, a child of this one
+type ReverseService struct {
+	BaseImpl
+	listener net.Listener
+}
+
+func (s *ReverseService) Code() int32 {
+	return types.APP_TYPE_REVERSE_SERVICE
+}
+
+func (s *ReverseService) Enabled(c conf.Configure) bool {
+	return len(c.ACL.Listen) > 0
+}
+
+func (s *ReverseService) Response() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	c, p := net.Pipe()
+	s.BaseImpl.conn = &p
+	go s.serve(c)
+	return nil
+}
+
+func (s *ReverseService) serve(stream net.Conn) {
+	defer stream.Close()
+	var req ReverseRequest
+	err := gob.NewDecoder(stream).Decode(&req)
+	if err != nil {
+		logrus.Error(err)
+		return
+	}
+	l, err := s.listen(req.ListenPort)
+	reply := ReverseReply{}
+	if err != nil {
+		logrus.Warn(err)
+		reply.Error = err.Error()
+	}
+	err = gob.NewEncoder(stream).Encode(reply)
+	if err != nil || l == nil {
+		return
+	}
+	defer l.Close()
+	logrus.Info("listen on ", l.Addr(), " for ", s.HostId(), ":", req.TargetPort)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.forward(conn, req.TargetPort)
+		}
+	}()
+	// the port stays open as long as the caller keeps the pair
+	io.Copy(io.Discard, stream)
+	logrus.Info("stop listening on ", l.Addr(), " for ", s.HostId())
+}
+
+// listen opens port on loopback, subject to the acl of the profile the
+// caller came through
+func (s *ReverseService) listen(port int32) (net.Listener, error) {
+	caller := s.HostId()
+	cfg, err := profileConf(s.GetProfile())
+	if err != nil {
+		return nil, err
+	}
+	if !cfg.ACL.CanListen(caller) {
+		return nil, fmt.Errorf("peer %s is not in acl.listen", caller)
+	}
+	if err := s.authenticate(cfg.ACL); err != nil {
+		return nil, err
+	}
+	l, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	if err != nil {
+		return nil, err
+	}
+	s.lock.Lock()
+	s.listener = l
+	s.lock.Unlock()
+	return l, nil
+}
+
+// forward sends conn back to port of the caller
+func (s *ReverseService) forward(conn net.Conn, port int32) {
+	defer conn.Close()
+	if localDialer == nil {
+		logrus.Error("no local dialer")
+		return
+	}
+	imp := &ProxyService{
+		BaseImpl: BaseImpl{
+			HId:        s.HostId(),
+			ConnectNow: true,
+		},
+		RemotePort: port,
+	}
+	imp.SetParentId(s.PairId())
+	sender := NewSender(imp, types.OPTION_TYPE_UP)
+	if sender == nil {
+		return
+	}
+	sender.Profile = s.GetProfile()
+	back, err := localDialer(sender)
+	if err != nil {
+		logrus.Error("cannot reach ", s.HostId(), ": ", err)
+		return
+	}
+	utils.Pipe(&conn, &back)
+}
+
+func (s *ReverseService) Close() {
+	s.lock.Lock()
+	if s.listener != nil {
+		s.listener.Close()
+	}
+	s.lock.Unlock()
+	s.BaseImpl.Close()
+}
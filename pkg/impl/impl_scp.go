@@ -7,6 +7,7 @@ import (
 
 	"github.com/povsister/scp"
 	"github.com/sirupsen/logrus"
+	"github.com/suutaku/sshx/pkg/conf"
 	"github.com/suutaku/sshx/pkg/types"
 	"golang.org/x/crypto/ssh"
 )
@@ -40,6 +41,10 @@ func (s *SCP) Code() int32 {
 	return types.APP_TYPE_SCP
 }
 
+func (s *SCP) Enabled(c conf.Configure) bool {
+	return c.LocalSSHPort > 0
+}
+
 func (s *SCP) Dial() error {
 	ssht := NewSSH(s.TargetAddress, false, s.Identiry, false)
 	err := ssht.Preper()
@@ -47,6 +52,9 @@ func (s *SCP) Dial() error {
 		logrus.Error(err)
 		return err
 	}
+	// a child ssh session is bulk traffic, not interactive
+	ssht.SetParentId(s.PairId())
+	ssht.SetLimit(s.GetLimit())
 
 	sender := NewSender(ssht, types.OPTION_TYPE_UP)
 	conn, err := sender.Send()
@@ -127,6 +135,8 @@ func (s *SCP) ParsePaths(src, dest string) error {
 	return nil
 }
 
+// splitAddr splits [user@]host:path, the key of an address book entry
+// is used when none is given
 func (s *SCP) splitAddr(addr string) (host, path string) {
 	sps := strings.Split(addr, ":")
 	if len(sps) < 2 {
@@ -135,5 +145,9 @@ func (s *SCP) splitAddr(addr string) (host, path string) {
 		host = sps[0]
 		path = sps[1]
 	}
+	if host != "" && s.Identiry == "" {
+		name := host[strings.LastIndex(host, "@")+1:]
+		s.Identiry = resolveHost(name).Identity
+	}
 	return
 }
@@ -0,0 +1,114 @@
+package impl
+
+import (
+	"bufio"
+	"encoding/gob"
+	"errors"
+	"net"
+	"syscall"
+
+	"github.com/sirupsen/logrus"
+	"github.com/suutaku/sshx/internal/utils"
+	"github.com/suutaku/sshx/pkg/conf"
+	"github.com/suutaku/sshx/pkg/types"
+)
+
+// SocksRequest is the first message of a socks pair, the host the peer
+// should dial for the client
+type SocksRequest struct {
+	Addr string
+}
+
+// SocksReply answers a SocksRequest, Code is a socks5 reply code
+type SocksReply struct {
+	Code  byte
+	Error string
+}
+
+// SocksService dials the hosts a socks proxy of a peer asks for, if the
+// peer is in acl.forward and the host in acl.destinations
+type SocksService struct {
+	BaseImpl
+}
+
+func (s *SocksService) Code() int32 {
+	return types.APP_TYPE_SOCKS_SERVICE
+}
+
+func (s *SocksService) Enabled(c conf.Configure) bool {
+	return len(c.ACL.Forward) > 0
+}
+
+func (s *SocksService) Response() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	c, p := net.Pipe()
+	s.BaseImpl.conn = &p
+	go s.serve(c)
+	return nil
+}
+
+func (s *SocksService) serve(stream net.Conn) {
+	defer stream.Close()
+	r := bufio.NewReader(stream)
+	var req SocksRequest
+	err := gob.NewDecoder(r).Decode(&req)
+	if err != nil {
+		logrus.Error(err)
+		return
+	}
+	conn, reply := s.dial(req.Addr)
+	err = gob.NewEncoder(stream).Encode(reply)
+	if err != nil || conn == nil {
+		return
+	}
+	var client net.Conn = &bufferedConn{Conn: stream, r: r}
+	utils.Pipe(&client, &conn)
+}
+
+// dial opens the connection to addr for the caller, subject to the acl
+// of the profile the caller came through
+func (s *SocksService) dial(addr string) (net.Conn, SocksReply) {
+	caller := s.HostId()
+	cfg, err := profileConf(s.GetProfile())
+	if err != nil {
+		logrus.Error(err)
+		return nil, SocksReply{Code: SOCKS_REP_NOT_ALLOWED, Error: err.Error()}
+	}
+	if !cfg.ACL.CanForward(caller) {
+		logrus.Warn("peer ", caller, " is not in acl.forward, refuse ", addr)
+		return nil, SocksReply{Code: SOCKS_REP_NOT_ALLOWED, Error: "not allowed by the acl of the peer"}
+	}
+	if err := s.authenticate(cfg.ACL); err != nil {
+		logrus.Warn(err, ", refuse ", addr)
+		return nil, SocksReply{Code: SOCKS_REP_NOT_ALLOWED, Error: "not allowed by the acl of the peer"}
+	}
+	if !cfg.ACL.AllowsDestination(addr) {
+		logrus.Warn("peer ", caller, " asked for ", addr, " which is not in acl.destinations")
+		return nil, SocksReply{Code: SOCKS_REP_NOT_ALLOWED, Error: "not allowed by the acl of the peer"}
+	}
+	logrus.Debug("dial ", addr, " for ", caller)
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		logrus.Debug(err)
+		return nil, SocksReply{Code: socksReplyCode(err), Error: err.Error()}
+	}
+	return conn, SocksReply{Code: SOCKS_REP_SUCCEEDED}
+}
+
+// socksReplyCode maps a dial error to its socks5 reply
+func socksReplyCode(err error) byte {
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return SOCKS_REP_REFUSED
+	case errors.Is(err, syscall.ENETUNREACH):
+		return SOCKS_REP_NET_UNREACHABLE
+	case errors.As(err, &dnsErr), errors.Is(err, syscall.EHOSTUNREACH):
+		return SOCKS_REP_HOST_UNREACHABLE
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return SOCKS_REP_TTL_EXPIRED
+	}
+	return SOCKS_REP_FAILURE
+}
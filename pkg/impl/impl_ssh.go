@@ -52,14 +52,22 @@ func (s *SSH) Code() int32 {
 	return types.APP_TYPE_SSH
 }
 
+func (s *SSH) Enabled(c conf.Configure) bool {
+	return c.LocalSSHPort > 0
+}
+
 func (s *SSH) Preper() error {
 	s.config = ssh.ClientConfig{
 		HostKeyCallback: ssh.HostKeyCallback(hostKeyCallback),
 		Timeout:         timeout,
 	}
-	s.privateKeyOption()
+	// the address book may name the key
 	err := s.decodeAddress()
-	return err
+	if err != nil {
+		return err
+	}
+	s.privateKeyOption()
+	return nil
 }
 
 func (s *SSH) Dial() error {
@@ -69,10 +77,13 @@ func (s *SSH) Dial() error {
 func (s *SSH) Response() error {
 	s.lock.Lock()
 	defer s.lock.Unlock()
-	cm := conf.NewConfManager("")
+	c, err := currentConf()
+	if err != nil {
+		return err
+	}
 
-	logrus.Debug("Dail local addr ", cm.Conf.LocalSSHPort)
-	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", cm.Conf.LocalSSHPort))
+	logrus.Debug("Dail local addr ", c.LocalSSHPort)
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", c.LocalSSHPort))
 	if err != nil {
 		return err
 	}
@@ -112,8 +123,16 @@ func (s *SSH) decodeAddress() error {
 		userName = sps[0]
 		addr = sps[1]
 	}
+	host := resolveHost(addr)
+	if len(sps) < 2 && host.User != "" {
+		userName = host.User
+	}
+	if s.Identify == "" {
+		s.Identify = host.Identity
+	}
 	s.config.User = userName
-	s.HId = addr
+	s.HId = host.ID
+	s.Transport = host.Transport
 	return nil
 }
 
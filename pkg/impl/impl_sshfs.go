@@ -8,6 +8,7 @@ import (
 	"github.com/sirupsen/logrus"
 	"github.com/suutaku/go-sshfs/pkg/sshfs"
 	"github.com/suutaku/sshx/internal/utils"
+	"github.com/suutaku/sshx/pkg/conf"
 	"github.com/suutaku/sshx/pkg/types"
 	"golang.org/x/crypto/ssh"
 )
@@ -45,6 +46,10 @@ func (fs *SSHFS) Code() int32 {
 	return types.APP_TYPE_SFS
 }
 
+func (fs *SSHFS) Enabled(c conf.Configure) bool {
+	return c.LocalSSHPort > 0
+}
+
 func (fs *SSHFS) Dial() error {
 	ssht := NewSSH(fs.Address, false, fs.Identify, false)
 	err := ssht.Preper()
@@ -52,6 +57,7 @@ func (fs *SSHFS) Dial() error {
 		return err
 	}
 	ssht.SetParentId(fs.PairId())
+	ssht.SetLimit(fs.GetLimit())
 	fs.HId = ssht.HId
 	sender := NewSender(ssht, types.OPTION_TYPE_UP)
 	conn, err := sender.Send()
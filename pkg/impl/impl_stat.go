@@ -4,6 +4,8 @@ import (
 	"encoding/gob"
 	"fmt"
 	"os"
+	"sort"
+	"time"
 
 	"github.com/jedib0t/go-pretty/v6/list"
 	"github.com/jedib0t/go-pretty/v6/table"
@@ -18,6 +20,7 @@ const (
 
 type STAT struct {
 	BaseImpl
+	health map[string]string
 }
 
 func NewSTAT() *STAT {
@@ -36,24 +39,51 @@ func (stat *STAT) Response() error {
 	return nil
 }
 
-func (stat *STAT) ShowStatus(displayType int) {
+// GetStatus reads the status of all pairs from the node
+func (stat *STAT) GetStatus() ([]types.Status, error) {
 	logrus.Debug("read from conn")
 	var pld []types.Status
 	err := gob.NewEncoder(stat.Conn()).Encode(&pld)
 	if err != nil {
-		logrus.Error(err)
-		return
+		return nil, err
+	}
+	dec := gob.NewDecoder(stat.Conn())
+	err = dec.Decode(&pld)
+	if err != nil {
+		return nil, err
 	}
-	err = gob.NewDecoder(stat.Conn()).Decode(&pld)
+	// problems of connection services follow, older daemons send none
+	stat.Conn().SetReadDeadline(time.Now().Add(2 * time.Second))
+	err = dec.Decode(&stat.health)
+	if err != nil {
+		logrus.Debug("no health from daemon: ", err)
+	}
+	stat.Conn().SetReadDeadline(time.Time{})
+	return pld, nil
+}
+
+// Health is what GetStatus read about connection services which are not
+// working, like a direct listener without its port, by service name
+func (stat *STAT) Health() map[string]string {
+	return stat.health
+}
+
+func (stat *STAT) ShowStatus(displayType int) {
+	pld, err := stat.GetStatus()
 	if err != nil {
 		logrus.Error(err)
 		return
 	}
+	stat.Display(pld, displayType)
+}
+
+// Display renders status as a table or a tree
+func (stat *STAT) Display(status []types.Status, displayType int) {
 	switch displayType {
 	case DISPLAY_TABLE:
-		stat.showTable(pld)
+		stat.showTable(status)
 	case DISPLAY_TREE:
-		stat.showList(pld)
+		stat.showList(status)
 	}
 }
 
@@ -108,3 +138,55 @@ func (stat *STAT) showList(status []types.Status) {
 func (stat *STAT) Close() {
 	stat.BaseImpl.Close()
 }
+
+// HumanBytes formats a byte count like 1.5M
+func HumanBytes(n float64) string {
+	units := []string{"B", "K", "M", "G", "T"}
+	i := 0
+	for n >= 1024 && i < len(units)-1 {
+		n /= 1024
+		i++
+	}
+	if i == 0 {
+		return fmt.Sprintf("%.0f%s", n, units[i])
+	}
+	return fmt.Sprintf("%.1f%s", n, units[i])
+}
+
+// ShowRates renders a top like table of status with the throughput since
+// the previous snapshot prev, taken elapsed ago
+func ShowRates(status, prev []types.Status, elapsed time.Duration) {
+	last := make(map[string]types.Status, len(prev))
+	for _, v := range prev {
+		last[v.PairId] = v
+	}
+	sort.Slice(status, func(i, j int) bool {
+		return status[i].StartTime.Before(status[j].StartTime)
+	})
+	t := table.NewWriter()
+	t.SetOutputMirror(os.Stdout)
+	t.AppendHeader(table.Row{"#", "Pair ID", "Target ID", "Application", "Transport", "ICE", "RTT", "In", "Out", "In/s", "Out/s", "Msgs", "Errors", "Age"})
+	t.AppendSeparator()
+	for k, v := range status {
+		var inRate, outRate float64
+		if p, ok := last[v.PairId]; ok && elapsed > 0 {
+			inRate = float64(v.BytesIn-p.BytesIn) / elapsed.Seconds()
+			outRate = float64(v.BytesOut-p.BytesOut) / elapsed.Seconds()
+		}
+		ice, rtt := "-", "-"
+		if v.LocalCandidate != "" {
+			ice = v.LocalCandidate + "/" + v.RemoteCandidate
+		}
+		if v.RTT > 0 {
+			rtt = v.RTT.Round(time.Millisecond).String()
+		}
+		t.AppendRows([]table.Row{
+			{k + 1, v.PairId, v.TargetId, GetImplName(v.ImplType), v.Transport, ice, rtt,
+				HumanBytes(float64(v.BytesIn)), HumanBytes(float64(v.BytesOut)),
+				HumanBytes(inRate), HumanBytes(outRate),
+				v.MessagesIn + v.MessagesOut, v.Errors, time.Since(v.StartTime).Round(time.Second)},
+		})
+	}
+	t.AppendSeparator()
+	t.Render()
+}
@@ -0,0 +1,159 @@
+package impl
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/suutaku/sshx/pkg/conf"
+	"github.com/suutaku/sshx/pkg/types"
+)
+
+func TestEnabledApps(t *testing.T) {
+	always := []string{"ssh", "proxyservice", "udpproxyservice", "sshfs", "scp", "messager", "remotestat"}
+	tests := []struct {
+		name   string
+		change func(c *conf.Configure)
+		want   []string
+	}{
+		{"closed", func(c *conf.Configure) {}, nil},
+		{"inbox open", func(c *conf.Configure) {
+			c.Transfer.Policy = conf.TRANSFER_POLICY_ACCEPT
+		}, []string{"transfer"}},
+		{"exported roots", func(c *conf.Configure) {
+			c.Transfer.ExportedRoots = []string{"/srv"}
+		}, []string{"transfer"}},
+		{"forward and listen", func(c *conf.Configure) {
+			c.ACL.Forward = []string{"a"}
+			c.ACL.Listen = []string{"a"}
+		}, []string{"socksservice", "reverseservice"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := conf.NewDefaultConfigure()
+			c.Transfer.Policy = conf.TRANSFER_POLICY_REJECT
+			tt.change(&c)
+			got := make(map[string]bool)
+			for _, v := range enabledApps(c) {
+				got[v] = true
+			}
+			want := make(map[string]bool)
+			for _, v := range append(always, tt.want...) {
+				want[v] = true
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Fatalf("got %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+// useConf makes c the configure of the daemon for the test
+func useConf(t *testing.T, c conf.Configure) {
+	SetConfManager(&conf.ConfManager{Conf: &c})
+	t.Cleanup(func() {
+		SetConfManager(nil)
+	})
+}
+
+func TestProxyServiceDestination(t *testing.T) {
+	c := conf.NewDefaultConfigure()
+	c.ACL.Forward = []string{"a"}
+	c.ACL.Destinations = []string{"10.0.0.1:5432"}
+	c.ACL.Keys = map[string]string{"a": "key-a", "b": "key-b"}
+	useConf(t, c)
+
+	tests := []struct {
+		name    string
+		caller  string
+		key     string
+		addr    string
+		want    string
+		refused string
+	}{
+		{"loopback", "b", "", "", "127.0.0.1:22", ""},
+		{"forwarder", "a", "key-a", "10.0.0.1:5432", "10.0.0.1:5432", ""},
+		{"unlisted caller", "b", "key-b", "10.0.0.1:5432", "", "acl.forward"},
+		{"unauthenticated caller", "a", "", "10.0.0.1:5432", "", "did not prove"},
+		{"spoofed id", "a", "key-b", "10.0.0.1:5432", "", "pin it"},
+		{"other destination", "a", "key-a", "10.0.0.2:5432", "", "acl.destinations"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &ProxyService{BaseImpl: *NewBaseImpl(tt.caller), RemotePort: 22, RemoteAddr: tt.addr}
+			s.SetPeerKey(tt.key)
+			_, addr, err := s.destination()
+			if tt.refused != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.refused) {
+					t.Fatalf("got %s, %v, want an error about %s", addr, err, tt.refused)
+				}
+				return
+			}
+			if err != nil || addr != tt.want {
+				t.Fatalf("got %s, %v, want %s", addr, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestRemoteStatResponse(t *testing.T) {
+	c := conf.NewDefaultConfigure()
+	c.ACL.Admins = []string{"admin"}
+	c.ACL.Keys = map[string]string{"admin": "key-admin", "a": "key-a", "b": "key-b"}
+	useConf(t, c)
+	SetStatusSource(func() []types.Status {
+		return []types.Status{
+			{PairId: "1", TargetId: "a", ImplType: types.APP_TYPE_SSH},
+			{PairId: "2", TargetId: "b", ImplType: types.APP_TYPE_SSH},
+		}
+	})
+	t.Cleanup(func() {
+		SetStatusSource(nil)
+	})
+
+	tests := []struct {
+		name   string
+		caller string
+		key    string
+		want   []string
+	}{
+		{"admin", "admin", "key-admin", []string{"1", "2"}},
+		{"own pairs", "a", "key-a", []string{"1"}},
+		{"spoofed id", "a", "key-b", nil},
+		{"unauthenticated caller", "a", "", nil},
+		{"spoofed admin", "admin", "key-a", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rs := NewRemoteStat(tt.caller)
+			rs.SetPeerKey(tt.key)
+			if err := rs.Response(); err != nil {
+				t.Fatal(err)
+			}
+			res, err := rs.GetStatus()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, v := range res {
+				got = append(got, v.PairId)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("got pairs %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewRemoteStatResolvesHost(t *testing.T) {
+	c := conf.NewDefaultConfigure()
+	c.Hosts = map[string]conf.HostConf{"nas": {ID: "node-nas", Transport: "direct"}}
+	useConf(t, c)
+	rs := NewRemoteStat("nas")
+	if rs.HostId() != "node-nas" || rs.Transport != "direct" {
+		t.Fatalf("got host %s over %q, want node-nas over direct", rs.HostId(), rs.Transport)
+	}
+	if rs := NewRemoteStat("node-b"); rs.HostId() != "node-b" {
+		t.Fatalf("got host %s for an id outside the address book", rs.HostId())
+	}
+}
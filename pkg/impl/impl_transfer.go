@@ -1,16 +1,28 @@
 package impl
 
 import (
+	"bytes"
+	"crypto/sha256"
 	"encoding/gob"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"hash"
 	"io"
+	"io/ioutil"
 	"mime/multipart"
 	"net"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/martinlindhe/notify"
 	"github.com/schollz/progressbar/v3"
 	"github.com/sirupsen/logrus"
+	"github.com/suutaku/sshx/internal/utils"
+	"github.com/suutaku/sshx/pkg/conf"
 	"github.com/suutaku/sshx/pkg/types"
 )
 
@@ -19,63 +31,180 @@ const (
 	TYPE_DOWNLOAD
 )
 
+const (
+	TRANSFER_STATUS_OK = iota
+	TRANSFER_STATUS_FAILED
+)
+
+// files are sent as checksummed chunks of this size
+const chunkSize = 1 << 20
+
+const (
+	partSuffix  = ".sshx-part"
+	stateSuffix = ".sshx-state"
+)
+
+// how long an inbound transfer waits for the user under the ask policy
+const askTimeout = 2 * time.Minute
+
+var errDigestMismatch = errors.New("file digest mismatch")
+
 type FileInfo struct {
 	Name       string
 	Size       int64
 	OptionType int32
 	Ready      bool
+	// identify a file version, partial files only resume with same identity
+	Identity string
+	Resume   bool
+	// requested remote paths for download
+	Paths []string
+	// directories and multiple files are sent as a tar stream
+	Archive bool
+	// why the responder refused the transfer
+	Reason string
+}
+
+// TransferDecision accepts or rejects a pending inbound transfer
+type TransferDecision struct {
+	Accept bool
 }
 
 type TransferStatus struct {
 	Status int32
+	// index of the first chunk the receiver is missing
+	Offset int64
+}
+
+type Chunk struct {
+	Index  int64
+	Data   []byte
+	Digest []byte
+	// the last chunk carries no data but the digest of the whole file
+	Last bool
+}
+
+// transferState saved next to a partial file
+type transferState struct {
+	Identity  string
+	ChunkSize int64
+	Chunks    int64
 }
 
 type Transfer struct {
 	BaseImpl
-	FilePath string
-	Upload   bool
-	Size     int64
-	FileName string
+	FilePaths []string
+	Upload    bool
+	Size      int64
+	FileName  string
+	Resume    bool
+	onHeader  func(FileInfo)
+	decision  chan bool
+	// digest of the first chunk of an http upload, which has no mtime
+	head string
 }
 
-func NewTransfer(hostId string, filePath string, upload bool, header *multipart.FileHeader) *Transfer {
-	if filePath == "" && header == nil {
+func NewTransfer(hostId string, filePaths []string, upload bool, header *multipart.FileHeader) *Transfer {
+	if len(filePaths) == 0 && header == nil {
 		return nil
 	}
 	ret := &Transfer{
-		BaseImpl: *NewBaseImpl(hostId),
-		FilePath: filePath,
-		Upload:   upload,
+		BaseImpl:  *NewBaseImpl(hostId),
+		FilePaths: filePaths,
+		Upload:    upload,
 	}
 	if header != nil {
 		ret.Size = header.Size
 		ret.FileName = header.Filename
+		ret.head = headDigest(header)
 	}
 	return ret
 }
 
+// headDigest hashes the first chunk of an uploaded file, empty if it
+// cannot be read
+func headDigest(header *multipart.FileHeader) string {
+	f, err := header.Open()
+	if err != nil {
+		logrus.Warn(err)
+		return ""
+	}
+	defer f.Close()
+	hs := sha256.New()
+	_, err = io.CopyN(hs, f, chunkSize)
+	if err != nil && err != io.EOF {
+		logrus.Warn(err)
+		return ""
+	}
+	return fmt.Sprintf("%x", hs.Sum(nil))
+}
+
 func (tr *Transfer) Code() int32 {
 	return types.APP_TYPE_TRANSFER
 }
 
+func (tr *Transfer) Enabled(c conf.Configure) bool {
+	return c.Transfer.GetPolicy() != conf.TRANSFER_POLICY_REJECT || len(c.Transfer.ExportedRoots) > 0
+}
+
+// OnHeader sets a callback called once the file header was exchanged
+func (tr *Transfer) OnHeader(f func(FileInfo)) {
+	tr.onHeader = f
+}
+
+func fileIdentity(name string, size int64, modTime int64) string {
+	return utils.HashString(fmt.Sprintf("%s:%d:%d", name, size, modTime))
+}
+
+// uploadIdentity identifies an http upload by the digest of its first chunk,
+// uploads with the same name and size resume only if their heads match
+func uploadIdentity(name string, size int64, head string) string {
+	return utils.HashString(fmt.Sprintf("%s:%d:%s", name, size, head))
+}
+
 func (tr *Transfer) sendHeader() (FileInfo, error) {
 	info := FileInfo{
-		Name:       tr.FilePath,
 		OptionType: TYPE_DOWNLOAD,
+		Paths:      tr.FilePaths,
+	}
+	if len(tr.FilePaths) > 0 {
+		info.Name = tr.FilePaths[0]
 	}
 	if tr.Upload {
 		info.OptionType = TYPE_UPLOAD
+		info.Paths = nil
+		info.Resume = tr.Resume
 		if tr.Size > 0 && tr.FileName != "" {
 			info.Size = tr.Size
 			info.Name = filepath.Base(tr.FileName)
+			if tr.head == "" {
+				info.Resume = false
+			} else {
+				info.Identity = uploadIdentity(info.Name, info.Size, tr.head)
+			}
 		} else {
-			fInfo, err := os.Stat(tr.FilePath)
+			archive, err := isArchive(tr.FilePaths)
 			if err != nil {
 				logrus.Error(err)
 				return info, err
 			}
-			info.Size = fInfo.Size()
-			info.Name = filepath.Base(tr.FilePath)
+			info.Name = filepath.Base(tr.FilePaths[0])
+			if archive {
+				info.Archive = true
+				info.Resume = false
+				info.Size, err = archiveSize(tr.FilePaths)
+				if err != nil {
+					return info, err
+				}
+			} else {
+				fInfo, err := os.Stat(tr.FilePaths[0])
+				if err != nil {
+					logrus.Error(err)
+					return info, err
+				}
+				info.Size = fInfo.Size()
+				info.Identity = fileIdentity(info.Name, info.Size, fInfo.ModTime().UnixNano())
+			}
 		}
 		info.Ready = true
 	}
@@ -87,6 +216,12 @@ func (tr *Transfer) sendHeader() (FileInfo, error) {
 	if err != nil {
 		return info, err
 	}
+	if !info.Ready {
+		return info, fmt.Errorf("remote refused transfer: %s", info.Reason)
+	}
+	if tr.onHeader != nil {
+		tr.onHeader(info)
+	}
 	return info, nil
 }
 
@@ -98,15 +233,20 @@ func (tr *Transfer) recvHeader(conn net.Conn) (FileInfo, error) {
 		return info, err
 	}
 
-	if info.OptionType == TYPE_DOWNLOAD {
-		tr.FilePath = info.Name
-		fInfo, err := os.Stat(tr.FilePath)
-		if err != nil {
-			logrus.Error(err, tr.FilePath)
-			return info, err
-		}
-		info.Size = fInfo.Size()
-		info.Ready = true
+	c, err := currentConf()
+	switch {
+	case err != nil:
+	case info.OptionType == TYPE_DOWNLOAD:
+		err = tr.prepareDownload(&info, c.Transfer)
+	case info.OptionType == TYPE_UPLOAD:
+		err = tr.acceptUpload(&info, c.Transfer)
+	default:
+		err = fmt.Errorf("invalid file option type %d", info.OptionType)
+	}
+	if err != nil {
+		logrus.Warn("refuse transfer from ", tr.HostId(), ": ", err)
+		info.Ready = false
+		info.Reason = err.Error()
 	}
 	err = gob.NewEncoder(conn).Encode(&info)
 	if err != nil {
@@ -115,6 +255,450 @@ func (tr *Transfer) recvHeader(conn net.Conn) (FileInfo, error) {
 	}
 	return info, nil
 }
+
+// prepareDownload checks requested paths against exported roots and fills
+// size and identity
+func (tr *Transfer) prepareDownload(info *FileInfo, tc conf.TransferConf) error {
+	tr.FilePaths = info.Paths
+	if len(tr.FilePaths) == 0 {
+		tr.FilePaths = []string{info.Name}
+	}
+	err := checkExported(tr.FilePaths, tc.ExportedRoots)
+	if err != nil {
+		return err
+	}
+	info.Archive, err = isArchive(tr.FilePaths)
+	if err != nil {
+		return err
+	}
+	if info.Archive {
+		info.Size, err = archiveSize(tr.FilePaths)
+		if err != nil {
+			return err
+		}
+	} else {
+		fInfo, err := os.Stat(tr.FilePaths[0])
+		if err != nil {
+			return err
+		}
+		info.Size = fInfo.Size()
+		info.Identity = fileIdentity(filepath.Base(tr.FilePaths[0]), info.Size, fInfo.ModTime().UnixNano())
+	}
+	info.Ready = true
+	return nil
+}
+
+// acceptUpload applies the inbound policy and quota to an upload
+func (tr *Transfer) acceptUpload(info *FileInfo, tc conf.TransferConf) error {
+	info.Name = filepath.Base(info.Name)
+	if info.Name == "." || info.Name == ".." || info.Name == string(filepath.Separator) {
+		return fmt.Errorf("invalid file name")
+	}
+	inbox := tc.Inbox()
+	err := os.MkdirAll(inbox, 0755)
+	if err != nil {
+		return err
+	}
+	if tc.Quota > 0 {
+		err = usage.reserve(inbox, info.Size, tc.Quota)
+		if err != nil {
+			return err
+		}
+	}
+	err = tr.askPolicy(info, tc)
+	if err != nil && tc.Quota > 0 {
+		usage.release(inbox, info.Size)
+	}
+	return err
+}
+
+func (tr *Transfer) askPolicy(info *FileInfo, tc conf.TransferConf) error {
+	switch tc.GetPolicy() {
+	case conf.TRANSFER_POLICY_ACCEPT:
+	case conf.TRANSFER_POLICY_REJECT:
+		return fmt.Errorf("inbound transfers are not allowed")
+	case conf.TRANSFER_POLICY_ASK:
+		msg := fmt.Sprintf("%s wants to send %s (%d bytes)\nsshx trans accept|reject %s", tr.HostId(), info.Name, info.Size, tr.PairId())
+		logrus.Info(msg)
+		notify.Notify("sshx", "incoming file", msg, "")
+		select {
+		case accept := <-tr.decision:
+			if !accept {
+				return fmt.Errorf("rejected by user")
+			}
+		case <-time.After(askTimeout):
+			return fmt.Errorf("no answer from user")
+		}
+	default:
+		return fmt.Errorf("unknown transfer policy %s", tc.Policy)
+	}
+	return nil
+}
+
+// inboxUsage tracks the bytes an inbox holds. The inbox is walked at most
+// once per usageTTL, accepted uploads are added in between, so files the
+// user removed are noticed on the next walk
+type inboxUsage struct {
+	lock   sync.Mutex
+	dir    string
+	used   int64
+	walked time.Time
+}
+
+const usageTTL = time.Minute
+
+var usage inboxUsage
+
+// reserve counts size bytes against the quota of dir
+func (iu *inboxUsage) reserve(dir string, size, quota int64) error {
+	iu.lock.Lock()
+	defer iu.lock.Unlock()
+	if iu.dir != dir || time.Since(iu.walked) > usageTTL {
+		used, err := archiveSize([]string{dir})
+		if err != nil {
+			return err
+		}
+		iu.dir, iu.used, iu.walked = dir, used, time.Now()
+	}
+	if iu.used+size > quota {
+		return fmt.Errorf("inbox quota exceeded")
+	}
+	iu.used += size
+	return nil
+}
+
+// release gives back bytes of an upload which was refused after reserve
+func (iu *inboxUsage) release(dir string, size int64) {
+	iu.lock.Lock()
+	defer iu.lock.Unlock()
+	if iu.dir == dir {
+		iu.used -= size
+	}
+}
+
+// checkExported makes sure every path resolves under one of roots
+func checkExported(paths []string, roots []string) error {
+	for _, p := range paths {
+		real, err := filepath.EvalSymlinks(p)
+		if err != nil {
+			return err
+		}
+		real, err = filepath.Abs(real)
+		if err != nil {
+			return err
+		}
+		exported := false
+		for _, root := range roots {
+			realRoot, err := filepath.EvalSymlinks(root)
+			if err != nil {
+				continue
+			}
+			realRoot, err = filepath.Abs(realRoot)
+			if err != nil {
+				continue
+			}
+			if within(realRoot, real) {
+				exported = true
+				break
+			}
+		}
+		if !exported {
+			return fmt.Errorf("%s is not exported", p)
+		}
+	}
+	return nil
+}
+
+// uniquePath returns a path for name in dir which does not exist yet
+func uniquePath(dir, name string) string {
+	target := filepath.Join(dir, name)
+	ext := filepath.Ext(name)
+	stem := strings.TrimSuffix(name, ext)
+	for i := 1; ; i++ {
+		if _, err := os.Lstat(target); os.IsNotExist(err) {
+			return target
+		}
+		target = filepath.Join(dir, fmt.Sprintf("%s (%d)%s", stem, i, ext))
+	}
+}
+
+// limitWriter fails once more than n bytes were written
+type limitWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (lw *limitWriter) Write(b []byte) (int, error) {
+	if int64(len(b)) > lw.n {
+		return 0, fmt.Errorf("received more data than announced")
+	}
+	lw.n -= int64(len(b))
+	return lw.w.Write(b)
+}
+
+// sendChunks waits for the receiver to tell where to start, then streams
+// reader as checksummed chunks followed by the whole file digest
+func sendChunks(conn net.Conn, reader io.Reader, progress io.Writer) error {
+	var status TransferStatus
+	err := gob.NewDecoder(conn).Decode(&status)
+	if err != nil {
+		return err
+	}
+	hs := sha256.New()
+	if status.Offset > 0 {
+		logrus.Debug("resume from chunk ", status.Offset)
+		// skipped bytes still count for the whole file digest
+		_, err = io.CopyN(io.MultiWriter(hs, progress), reader, status.Offset*chunkSize)
+		if err != nil {
+			return err
+		}
+	}
+	enc := gob.NewEncoder(conn)
+	buf := make([]byte, chunkSize)
+	for index := status.Offset; ; index++ {
+		n, rerr := io.ReadFull(reader, buf)
+		if rerr != nil && rerr != io.EOF && rerr != io.ErrUnexpectedEOF {
+			return rerr
+		}
+		if n > 0 {
+			sum := sha256.Sum256(buf[:n])
+			hs.Write(buf[:n])
+			err = enc.Encode(Chunk{Index: index, Data: buf[:n], Digest: sum[:]})
+			if err != nil {
+				return err
+			}
+			progress.Write(buf[:n])
+		}
+		if rerr != nil {
+			break
+		}
+	}
+	err = enc.Encode(Chunk{Last: true, Digest: hs.Sum(nil)})
+	if err != nil {
+		return err
+	}
+	err = gob.NewDecoder(conn).Decode(&status)
+	if err != nil {
+		return err
+	}
+	if status.Status != TRANSFER_STATUS_OK {
+		return errDigestMismatch
+	}
+	return nil
+}
+
+// recvChunks tells the sender to start at offset, then verifies and writes
+// chunks to writer. hs must already contain the bytes before offset.
+func recvChunks(conn net.Conn, offset int64, writer io.Writer, hs hash.Hash, done func(int64, int) error) error {
+	err := gob.NewEncoder(conn).Encode(TransferStatus{Offset: offset})
+	if err != nil {
+		return err
+	}
+	dec := gob.NewDecoder(conn)
+	for index := offset; ; index++ {
+		var chunk Chunk
+		err = dec.Decode(&chunk)
+		if err != nil {
+			return err
+		}
+		if chunk.Last {
+			status := TransferStatus{Status: TRANSFER_STATUS_OK}
+			if !bytes.Equal(chunk.Digest, hs.Sum(nil)) {
+				status.Status = TRANSFER_STATUS_FAILED
+			}
+			err = gob.NewEncoder(conn).Encode(status)
+			if err != nil {
+				return err
+			}
+			if status.Status != TRANSFER_STATUS_OK {
+				return errDigestMismatch
+			}
+			return nil
+		}
+		if chunk.Index != index {
+			return fmt.Errorf("unexpected chunk %d, want %d", chunk.Index, index)
+		}
+		sum := sha256.Sum256(chunk.Data)
+		if !bytes.Equal(sum[:], chunk.Digest) {
+			return fmt.Errorf("chunk %d digest mismatch", index)
+		}
+		_, err = writer.Write(chunk.Data)
+		if err != nil {
+			return err
+		}
+		hs.Write(chunk.Data)
+		if done != nil {
+			err = done(index, len(chunk.Data))
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func loadState(statePath, identity string) transferState {
+	state := transferState{
+		Identity:  identity,
+		ChunkSize: chunkSize,
+	}
+	bs, err := ioutil.ReadFile(statePath)
+	if err != nil {
+		return state
+	}
+	var saved transferState
+	err = json.Unmarshal(bs, &saved)
+	if err != nil {
+		logrus.Warn("ignore broken transfer state ", statePath)
+		return state
+	}
+	if saved.Identity != identity || saved.ChunkSize != chunkSize {
+		logrus.Debug("transfer state not match, start over")
+		return state
+	}
+	return saved
+}
+
+func saveState(statePath string, state transferState) error {
+	bs, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(statePath, bs, 0644)
+}
+
+// sendArchive streams paths as a tar archive through sendChunks
+func sendArchive(conn net.Conn, paths []string, progress io.Writer) error {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(writeArchive(pw, paths, progress))
+	}()
+	err := sendChunks(conn, pr, ioutil.Discard)
+	pr.Close()
+	return err
+}
+
+// recvArchive receives a tar archive through recvChunks and hands it to
+// unpack while it arrives
+func recvArchive(conn net.Conn, unpack func(io.Reader) error) error {
+	pr, pw := io.Pipe()
+	errCh := make(chan error, 1)
+	go func() {
+		err := unpack(pr)
+		if err == nil {
+			// drain the tar padding
+			_, err = io.Copy(ioutil.Discard, pr)
+		}
+		pr.CloseWithError(err)
+		errCh <- err
+	}()
+	err := recvChunks(conn, 0, pw, sha256.New(), nil)
+	pw.CloseWithError(err)
+	uerr := <-errCh
+	if uerr != nil {
+		return uerr
+	}
+	return err
+}
+
+// recvArchiveInto unpacks a received archive into dir, top level entries
+// which already exist in dir are renamed
+func recvArchiveInto(conn net.Conn, info FileInfo, dir string, bar *progressbar.ProgressBar) error {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempDir(dir, ".sshx-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	err = recvArchive(conn, func(r io.Reader) error {
+		return extractArchive(r, tmp, &limitWriter{bar, info.Size})
+	})
+	if err != nil {
+		return err
+	}
+	entries, err := ioutil.ReadDir(tmp)
+	if err != nil {
+		return err
+	}
+	for _, v := range entries {
+		err = os.Rename(filepath.Join(tmp, v.Name()), uniquePath(dir, v.Name()))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// recvFile receives into a partial file beside dest, recording progress in a
+// state file, and moves it to dest once the whole file digest matches
+func recvFile(conn net.Conn, info FileInfo, dest string, bar *progressbar.ProgressBar) error {
+	partPath := dest + partSuffix
+	statePath := dest + stateSuffix
+	state := transferState{
+		Identity:  info.Identity,
+		ChunkSize: chunkSize,
+	}
+	if info.Resume {
+		state = loadState(statePath, info.Identity)
+	}
+	file, err := os.OpenFile(partPath, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	hs := sha256.New()
+	offset := state.Chunks * chunkSize
+	if offset > 0 {
+		_, err = io.CopyN(hs, file, offset)
+		if err != nil {
+			logrus.Warn("partial file shorter than its state, start over")
+			hs.Reset()
+			state.Chunks = 0
+			offset = 0
+		}
+	}
+	err = file.Truncate(offset)
+	if err != nil {
+		return err
+	}
+	_, err = file.Seek(offset, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	err = saveState(statePath, state)
+	if err != nil {
+		return err
+	}
+	bar.Add64(offset)
+
+	writer := &limitWriter{io.MultiWriter(file, bar), info.Size - offset}
+	err = recvChunks(conn, state.Chunks, writer, hs, func(index int64, n int) error {
+		// only full chunks are a valid place to resume from
+		if n != chunkSize {
+			return nil
+		}
+		state.Chunks = index + 1
+		return saveState(statePath, state)
+	})
+	if err != nil {
+		if errors.Is(err, errDigestMismatch) {
+			os.Remove(partPath)
+			os.Remove(statePath)
+		}
+		return err
+	}
+	file.Close()
+	err = os.Rename(partPath, dest)
+	if err != nil {
+		return err
+	}
+	os.Remove(statePath)
+	return nil
+}
+
 func (tr *Transfer) doResponse(s net.Conn) error {
 	// get file header
 	info, err := tr.recvHeader(s)
@@ -122,39 +706,42 @@ func (tr *Transfer) doResponse(s net.Conn) error {
 		return err
 	}
 	if !info.Ready {
-		return fmt.Errorf("remote not ready")
+		return fmt.Errorf("transfer refused: %s", info.Reason)
 	}
 	switch info.OptionType {
 	case TYPE_DOWNLOAD:
 		logrus.Debug("response download")
-		file, err := os.Open(tr.FilePath)
-		if err != nil {
-			logrus.Error(err)
-			return err
-		}
-		defer file.Close()
 		bar := progressbar.DefaultBytes(
 			info.Size,
 			"update",
 		)
-		_, err = io.Copy(io.MultiWriter(s, bar), file)
-		s.Close()
-		return err
-	case TYPE_UPLOAD:
-		logrus.Debug("response upload")
-		file, err := os.Create(filepath.Join(os.Getenv("HOME"), "Downloads", info.Name))
+		defer s.Close()
+		if info.Archive {
+			return sendArchive(s, tr.FilePaths, bar)
+		}
+		file, err := os.Open(tr.FilePaths[0])
 		if err != nil {
 			logrus.Error(err)
 			return err
 		}
-		logrus.Debug("file created")
 		defer file.Close()
+		return sendChunks(s, file, bar)
+	case TYPE_UPLOAD:
+		logrus.Debug("response upload")
 		bar := progressbar.DefaultBytes(
 			info.Size,
 			"download",
 		)
-		_, err = io.Copy(io.MultiWriter(file, bar), s)
-		return err
+		c, err := currentConf()
+		if err != nil {
+			logrus.Error(err)
+			return err
+		}
+		inbox := c.Transfer.Inbox()
+		if info.Archive {
+			return recvArchiveInto(s, info, inbox, bar)
+		}
+		return recvFile(s, info, uniquePath(inbox, info.Name), bar)
 	default:
 		logrus.Error("invalid file option type for ", info.OptionType)
 	}
@@ -167,6 +754,7 @@ func (tr *Transfer) Response() error {
 	s, c := net.Pipe()
 	tr.lock.Lock()
 	tr.BaseImpl.conn = &c
+	tr.decision = make(chan bool, 1)
 	tr.lock.Unlock()
 	go func() {
 		err := tr.doResponse(s)
@@ -177,6 +765,28 @@ func (tr *Transfer) Response() error {
 	return nil
 }
 
+// Attach reads a TransferDecision for a transfer waiting under the ask policy
+func (tr *Transfer) Attach(conn net.Conn) error {
+	if tr.decision == nil {
+		return fmt.Errorf("transfer %s is not an inbound transfer", tr.PairId())
+	}
+	go func() {
+		defer conn.Close()
+		var decision TransferDecision
+		err := gob.NewDecoder(conn).Decode(&decision)
+		if err != nil {
+			logrus.Error(err)
+			return
+		}
+		select {
+		case tr.decision <- decision.Accept:
+		default:
+			logrus.Warn("transfer ", tr.PairId(), " already decided")
+		}
+	}()
+	return nil
+}
+
 func (tr *Transfer) DoUpload(reader io.Reader) error {
 	info, err := tr.sendHeader()
 	if err != nil {
@@ -188,20 +798,19 @@ func (tr *Transfer) DoUpload(reader io.Reader) error {
 	)
 
 	if reader == nil {
-		file, err := os.Open(tr.FilePath)
+		if info.Archive {
+			return sendArchive(tr.Conn(), tr.FilePaths, bar)
+		}
+		file, err := os.Open(tr.FilePaths[0])
 		if err != nil {
 			return err
 		}
 		defer file.Close()
-		n, err := io.Copy(io.MultiWriter(tr.Conn(), bar), file)
-		logrus.Debug("stop process upload ", err, n)
-		// time.Sleep(5 * time.Second)
-		return err
-	} else {
-		n, err := io.Copy(io.MultiWriter(tr.Conn(), bar), reader)
-		logrus.Warn("use file discriber and do noting", n, err)
+		reader = file
 	}
-	return nil
+	err = sendChunks(tr.Conn(), reader, bar)
+	logrus.Debug("stop process upload ", err)
+	return err
 }
 
 func (tr *Transfer) DoDownload(writer io.Writer) error {
@@ -213,18 +822,20 @@ func (tr *Transfer) DoDownload(writer io.Writer) error {
 		info.Size,
 		"download",
 	)
-	if writer == nil {
-		file, err := os.Create(filepath.Join(os.Getenv("HOME"), "Downloads", filepath.Base(info.Name)))
-		if err != nil {
-			logrus.Error(err)
-			return err
+	downloads := filepath.Join(os.Getenv("HOME"), "Downloads")
+	if info.Archive {
+		if writer == nil {
+			return recvArchiveInto(tr.Conn(), info, downloads, bar)
 		}
-		defer file.Close()
-		io.Copy(io.MultiWriter(file, bar), tr.Conn())
-	} else {
-		io.Copy(io.MultiWriter(writer, bar), tr.Conn())
+		return recvArchive(tr.Conn(), func(r io.Reader) error {
+			return tarToZip(r, writer, bar)
+		})
 	}
-	return nil
+	if writer == nil {
+		info.Resume = tr.Resume
+		return recvFile(tr.Conn(), info, uniquePath(downloads, filepath.Base(info.Name)), bar)
+	}
+	return recvChunks(tr.Conn(), 0, io.MultiWriter(writer, bar), sha256.New(), nil)
 }
 
 func (tr *Transfer) Close() {
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"mime/multipart"
 	"net/http"
 	"os"
 	"os/signal"
@@ -27,29 +28,43 @@ type TransferService struct {
 	ServerPort int32
 	server     *http.Server
 	Upload     bool
-	FilePath   string
+	FilePaths  []string
 	ShowQR     bool
 	TmpPath    string
+	Resume     bool
+	archive    bool
 }
 
-func NewTransferService(hostId string, filePath string, upload, qr bool) *TransferService {
+func NewTransferService(hostId string, filePaths []string, upload, qr bool) *TransferService {
+	host := resolveHost(hostId)
 	ret := &TransferService{
-		BaseImpl: *NewBaseImpl(hostId),
-		FilePath: filePath,
-		Upload:   upload,
+		BaseImpl:  *NewBaseImpl(host.ID),
+		FilePaths: filePaths,
+		Upload:    upload,
 	}
-	if (upload && filePath == "") || qr {
+	if (upload && len(filePaths) == 0) || qr {
 		ret.ShowQR = true
 	}
-	if !upload && filePath == "" {
+	if !upload && len(filePaths) == 0 {
 		return nil
 	}
+	ret.Transport = host.Transport
 	ret.ServerPort = 14567
 	f, _ := os.MkdirTemp("", "sshx")
 	ret.TmpPath = f
 	return ret
 }
 
+func (trs *TransferService) newTransfer(filePaths []string, upload bool, header *multipart.FileHeader) *Transfer {
+	transfer := NewTransfer(trs.HostId(), filePaths, upload, header)
+	if transfer != nil {
+		transfer.Resume = trs.Resume
+		transfer.SetLimit(trs.GetLimit())
+		transfer.SetPreferredTransport(trs.PreferredTransport())
+	}
+	return transfer
+}
+
 func (trs *TransferService) Start() error {
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt)
@@ -65,7 +80,7 @@ func (trs *TransferService) Start() error {
 	if !trs.ShowQR {
 		logrus.Debug("not shown qr code")
 		if trs.Upload { // upload case
-			transfer := NewTransfer(trs.HostId(), trs.FilePath, true, nil)
+			transfer := trs.newTransfer(trs.FilePaths, true, nil)
 			if transfer == nil {
 				return fmt.Errorf("cannot create transfer")
 			}
@@ -87,7 +102,7 @@ func (trs *TransferService) Start() error {
 			return nil
 
 		} else {
-			transfer := NewTransfer(trs.HostId(), trs.FilePath, false, nil)
+			transfer := trs.newTransfer(trs.FilePaths, false, nil)
 			if transfer == nil {
 				return fmt.Errorf("cannot create transfer")
 			}
@@ -141,7 +156,11 @@ func (trs *TransferService) Start() error {
 	})
 	r.HandleFunc("/"+downUrl, func(w http.ResponseWriter, r *http.Request) {
 
-		tmpFilePath := path.Join(trs.TmpPath, path.Base(trs.FilePath))
+		// a directory is served as zip archive
+		tmpFilePath := path.Join(trs.TmpPath, path.Base(trs.FilePaths[0]))
+		if trs.archive {
+			tmpFilePath += ".zip"
+		}
 
 		finfo, err := os.Stat(tmpFilePath)
 		if os.IsNotExist(err) {
@@ -153,7 +172,7 @@ func (trs *TransferService) Start() error {
 			}
 			defer tf.Close()
 
-			transfer := NewTransfer(trs.HostId(), trs.FilePath, false, nil)
+			transfer := trs.newTransfer(trs.FilePaths, false, nil)
 			if transfer == nil {
 				w.Write([]byte("cannot create transfer"))
 				return
@@ -170,13 +189,25 @@ func (trs *TransferService) Start() error {
 				logrus.Error(err)
 				return
 			}
+			transfer.OnHeader(func(info FileInfo) {
+				name := path.Base(tmpFilePath)
+				if info.Archive {
+					trs.archive = true
+					name += ".zip"
+				}
+				w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+			})
 			mw := io.MultiWriter(w, tf)
 			transfer.SetConn(conn)
 			err = transfer.DoDownload(mw)
 			if err != nil {
+				os.Remove(tmpFilePath)
 				w.Write([]byte(err.Error()))
 				return
 			}
+			if trs.archive {
+				os.Rename(tmpFilePath, tmpFilePath+".zip")
+			}
 
 		} else {
 			logrus.Debug("tmp file ", tmpFilePath, " already exist")
@@ -186,6 +217,7 @@ func (trs *TransferService) Start() error {
 				return
 			}
 			defer tf.Close()
+			w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", path.Base(tmpFilePath)))
 			bar := progressbar.DefaultBytes(
 				finfo.Size(),
 				"download",
@@ -202,7 +234,7 @@ func (trs *TransferService) Start() error {
 			w.Write([]byte(err.Error()))
 			return
 		}
-		transfer := NewTransfer(trs.HostId(), "", true, header)
+		transfer := trs.newTransfer(nil, true, header)
 		if transfer == nil {
 			w.Write([]byte("cannot create transfer at /upload "))
 			return
@@ -0,0 +1,139 @@
+package impl
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"math/rand"
+	"mime/multipart"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/schollz/progressbar/v3"
+)
+
+func silentBar(size int64) *progressbar.ProgressBar {
+	return progressbar.NewOptions64(size, progressbar.OptionSetWriter(ioutil.Discard))
+}
+
+// transferFile sends data with sendChunks and receives it with recvFile
+func transferFile(t *testing.T, data []byte, info FileInfo, dest string) error {
+	t.Helper()
+	s, r := net.Pipe()
+	defer s.Close()
+	defer r.Close()
+	sent := make(chan error, 1)
+	go func() {
+		sent <- sendChunks(s, bytes.NewReader(data), ioutil.Discard)
+	}()
+	err := recvFile(r, info, dest, silentBar(info.Size))
+	r.Close()
+	if serr := <-sent; err == nil {
+		err = serr
+	}
+	return err
+}
+
+func TestChunkResume(t *testing.T) {
+	data := make([]byte, 2*chunkSize+chunkSize/2)
+	rand.New(rand.NewSource(1)).Read(data)
+	corrupt := append([]byte{}, data[:chunkSize]...)
+	corrupt[0] ^= 0xff
+
+	tests := []struct {
+		name string
+		// partial file and the identity of its state, no partial if nil
+		part     []byte
+		identity string
+		resume   bool
+		err      error
+	}{
+		{"fresh", nil, "", true, nil},
+		{"resume", data[:chunkSize], "id", true, nil},
+		{"resume without state chunk", data[:chunkSize/2], "id", true, nil},
+		// the first chunk is not sent again, so the whole digest differs
+		{"resume corrupt part", corrupt, "id", true, errDigestMismatch},
+		{"other identity starts over", corrupt, "other", true, nil},
+		{"resume disabled starts over", corrupt, "id", false, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dest := filepath.Join(t.TempDir(), "file")
+			if tt.part != nil {
+				ioutil.WriteFile(dest+partSuffix, tt.part, 0644)
+				saveState(dest+stateSuffix, transferState{
+					Identity:  tt.identity,
+					ChunkSize: chunkSize,
+					Chunks:    int64(len(tt.part) / chunkSize),
+				})
+			}
+			info := FileInfo{Name: "file", Size: int64(len(data)), Identity: "id", Resume: tt.resume}
+			err := transferFile(t, data, info, dest)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("got %v, want %v", err, tt.err)
+			}
+			if err != nil {
+				// a corrupt partial file is not resumed again
+				if _, err := os.Stat(dest + partSuffix); !os.IsNotExist(err) {
+					t.Fatal("corrupt partial file kept")
+				}
+				return
+			}
+			got, err := ioutil.ReadFile(dest)
+			if err != nil || !bytes.Equal(got, data) {
+				t.Fatalf("received file differs, %v", err)
+			}
+			for _, v := range []string{partSuffix, stateSuffix} {
+				if _, err := os.Stat(dest + v); !os.IsNotExist(err) {
+					t.Fatalf("%s left behind", v)
+				}
+			}
+		})
+	}
+}
+
+func TestChunkTooMuchData(t *testing.T) {
+	dest := filepath.Join(t.TempDir(), "file")
+	data := make([]byte, 100)
+	err := transferFile(t, data, FileInfo{Name: "file", Size: 10}, dest)
+	if err == nil {
+		t.Fatal("file larger than announced accepted")
+	}
+}
+
+// fileHeader makes a multipart file header like an http upload has
+func fileHeader(t *testing.T, name string, data []byte) *multipart.FileHeader {
+	t.Helper()
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	fw, _ := mw.CreateFormFile("file", name)
+	fw.Write(data)
+	mw.Close()
+	form, err := multipart.NewReader(&buf, mw.Boundary()).ReadForm(1 << 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { form.RemoveAll() })
+	return form.File["file"][0]
+}
+
+func TestUploadIdentity(t *testing.T) {
+	a := bytes.Repeat([]byte{'a'}, 1000)
+	b := bytes.Repeat([]byte{'b'}, 1000)
+	identity := func(name string, data []byte) string {
+		tr := NewTransfer("peer", nil, true, fileHeader(t, name, data))
+		return uploadIdentity(filepath.Base(tr.FileName), tr.Size, tr.head)
+	}
+	if identity("f", a) != identity("f", a) {
+		t.Fatal("same upload has different identities")
+	}
+	// same name and size must not resume another file
+	if identity("f", a) == identity("f", b) {
+		t.Fatal("different contents share an identity")
+	}
+	if identity("f", a) == identity("g", a) {
+		t.Fatal("different names share an identity")
+	}
+}
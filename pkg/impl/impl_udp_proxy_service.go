@@ -0,0 +1,96 @@
+package impl
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+
+	"github.com/sirupsen/logrus"
+	"github.com/suutaku/sshx/internal/utils"
+	"github.com/suutaku/sshx/pkg/conf"
+	"github.com/suutaku/sshx/pkg/types"
+)
+
+// UDPProxyService forwards the datagrams of one client of a udp proxy to
+// a local port, like ProxyService does for tcp
+type UDPProxyService struct {
+	BaseImpl
+	RemotePort int32
+}
+
+func (s *UDPProxyService) Code() int32 {
+	return types.APP_TYPE_UDP_PROXY_SERVICE
+}
+
+func (s *UDPProxyService) Enabled(c conf.Configure) bool {
+	return true
+}
+
+func (s *UDPProxyService) IsDatagram() bool {
+	return true
+}
+
+func (s *UDPProxyService) GetRemotePort() int32 {
+	return s.RemotePort
+}
+
+func (s *UDPProxyService) SetRemotePort(port int32) error {
+	s.RemotePort = port
+	return nil
+}
+
+func (s *UDPProxyService) Response() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	logrus.Debug("Dial local udp addr ", s.RemotePort)
+	udp, err := net.Dial("udp", fmt.Sprintf("127.0.0.1:%d", s.RemotePort))
+	if err != nil {
+		return err
+	}
+	c, p := net.Pipe()
+	s.BaseImpl.conn = &p
+	go relayDatagrams(c, udp)
+	return nil
+}
+
+// relayDatagrams moves datagrams between a framed stream and a connected
+// udp socket until the stream closes
+func relayDatagrams(stream, udp net.Conn) {
+	defer stream.Close()
+	defer udp.Close()
+	go func() {
+		buf := make([]byte, 64*1024)
+		for {
+			n, err := udp.Read(buf)
+			if errors.Is(err, syscall.ECONNREFUSED) {
+				// nothing listens yet, the client may try again
+				continue
+			}
+			if err != nil {
+				stream.Close()
+				return
+			}
+			err = utils.WriteDatagram(stream, buf[:n])
+			if err == utils.ErrDatagramTooLarge {
+				logrus.Debug("drop datagram of ", n, " bytes")
+				continue
+			}
+			if err != nil {
+				udp.Close()
+				return
+			}
+		}
+	}()
+	buf := make([]byte, utils.MaxDatagramSize)
+	for {
+		b, err := utils.ReadDatagram(stream, buf)
+		if err != nil {
+			return
+		}
+		_, err = udp.Write(b)
+		if err != nil {
+			logrus.Debug(err)
+		}
+	}
+}
@@ -5,8 +5,12 @@ import (
 	"encoding/gob"
 	"fmt"
 	"net"
+	"os"
+	"path"
+	"strings"
 
 	"github.com/sirupsen/logrus"
+	"github.com/suutaku/sshx/internal/utils"
 	"github.com/suutaku/sshx/pkg/conf"
 )
 
@@ -18,6 +22,7 @@ type Sender struct {
 	LocalEntry string
 	Payload    []byte // Application specify payload
 	Status     int32
+	Profile    string // signaling network to use, empty for the default one
 }
 
 func NewSender(imp Impl, optCode int32) *Sender {
@@ -34,12 +39,28 @@ func NewSender(imp Impl, optCode int32) *Sender {
 		return nil
 	}
 	ret.Payload = buf.Bytes()
-	cm := conf.NewConfManager("")
-	ret.LocalEntry = fmt.Sprintf("127.0.0.1:%d", cm.Conf.LocalTCPPort)
+	ret.LocalEntry = controlEntry()
+	ret.Profile = conf.ActiveProfile()
 	ret.PairId = []byte(imp.PairId())
 	return ret
 }
 
+// controlEntry prefers the control socket of the daemon and falls back to
+// its loopback port, older daemons only listen there
+func controlEntry() string {
+	cm, err := confManager()
+	if err != nil {
+		logrus.Error(err)
+		return "unix:" + path.Join(utils.GetSSHXHome(), "sshx.sock")
+	}
+	sock := cm.SocketPath()
+	port := cm.Current().LocalTCPPort
+	if _, err := os.Stat(sock); err == nil || port == 0 {
+		return "unix:" + sock
+	}
+	return fmt.Sprintf("127.0.0.1:%d", port)
+}
+
 func (sender *Sender) GetAppCode() int32 {
 	return sender.Type >> flagLen
 }
@@ -59,9 +80,13 @@ func (sender *Sender) GetImpl() Impl {
 }
 
 func (sender *Sender) Send() (net.Conn, error) {
-	conn, err := net.Dial("tcp", sender.LocalEntry)
+	network, addr := "tcp", sender.LocalEntry
+	if strings.HasPrefix(addr, "unix:") {
+		network, addr = "unix", strings.TrimPrefix(addr, "unix:")
+	}
+	conn, err := net.Dial(network, addr)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("cannot reach the daemon, is it running? %v", err)
 	}
 	err = gob.NewEncoder(conn).Encode(sender)
 	if err != nil {
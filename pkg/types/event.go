@@ -0,0 +1,26 @@
+package types
+
+import "time"
+
+// kinds of connection lifecycle events
+const (
+	EVENT_PAIR_CREATED = "created"
+	EVENT_PAIR_READY   = "ready"
+	EVENT_TRANSPORT    = "transport"
+	EVENT_ICE_STATE    = "ice_state"
+	EVENT_PAIR_CLOSED  = "closed"
+	EVENT_CHILD_ADDED  = "child_added"
+)
+
+// Event is streamed to subscribers of the daemon
+type Event struct {
+	Time         time.Time
+	Type         string
+	PairId       string
+	ParentPairId string
+	TargetId     string
+	ImplType     int32
+	Transport    string
+	// transport name, ICE state or close reason, depends on Type
+	Detail string
+}
@@ -0,0 +1,16 @@
+package types
+
+import "time"
+
+// Version is announced to the signaling server, set it at build time with
+// -ldflags "-X github.com/suutaku/sshx/pkg/types.Version=v1.0.0"
+var Version = "dev"
+
+// PeerInfo is what a node announces about itself to the signaling server
+type PeerInfo struct {
+	ID       string    `json:"id"`
+	Version  string    `json:"version"`
+	Apps     []string  `json:"apps"`
+	LastSeen time.Time `json:"last_seen"`
+	Online   bool      `json:"online"`
+}
@@ -10,4 +10,7 @@ type SignalingInfo struct {
 	PeerType          int32  `json:"peer_type"`
 	RemoteRequestType int32  `json:"remote_request_type"`
 	RemotePort		  int32  `json:"remote_port"`
+	// host:port or unix:/path on the side of the peer, empty for its
+	// loopback at RemotePort
+	RemoteAddr        string `json:"remote_addr"`
 }
@@ -8,4 +8,17 @@ type Status struct {
 	ImplType     int32
 	PairId       string
 	ParentPairId string
+	// webrtc or direct
+	Transport string
+	// traffic with the peer since the pair started
+	BytesIn     int64
+	BytesOut    int64
+	MessagesIn  int64
+	MessagesOut int64
+	Errors      int64
+	// selected ICE candidate types like host, srflx or relay, webrtc only
+	LocalCandidate  string
+	RemoteCandidate string
+	// round trip time of the selected candidate pair, 0 if unknown
+	RTT time.Duration
 }
@@ -0,0 +1,19 @@
+package types
+
+// TunnelStatus is the state of a tunnel of the daemon
+type TunnelStatus struct {
+	Name       string
+	LocalPort  int32
+	Host       string
+	RemotePort int32
+	Profile    string
+	Enabled    bool
+	Listening  bool
+	// last listen or dial error, empty if none
+	Error string
+	// times the listener was started again after a failure
+	Restarts int64
+	// connections open now and since the daemon started
+	Active int64
+	Total  int64
+}
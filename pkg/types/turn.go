@@ -0,0 +1,10 @@
+package types
+
+// TurnCredential is a short lived TURN credential issued by the signaling
+// server with the TURN REST API shared secret scheme
+type TurnCredential struct {
+	URLs     []string `json:"urls"`
+	Username string   `json:"username"`
+	Password string   `json:"password"`
+	TTL      int64    `json:"ttl"`
+}
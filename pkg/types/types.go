@@ -5,6 +5,9 @@ const (
 	OPTION_TYPE_DOWN
 	OPTION_TYPE_STAT
 	OPTION_TYPE_ATTACH
+	OPTION_TYPE_SUBSCRIBE
+	OPTION_TYPE_RELOAD
+	OPTION_TYPE_TUNNELS
 )
 
 const (
@@ -19,6 +22,10 @@ const (
 	APP_TYPE_MESSAGER
 	APP_TYPE_TRANSFER_SERVICE
 	APP_TYPE_TRANSFER
+	APP_TYPE_REMOTE_STAT
+	APP_TYPE_UDP_PROXY_SERVICE
+	APP_TYPE_SOCKS_SERVICE
+	APP_TYPE_REVERSE_SERVICE
 )
 
 // some signaling request type
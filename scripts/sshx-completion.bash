@@ -0,0 +1,31 @@
+# bash completion for sshx, source it from ~/.bashrc or copy it to
+# /etc/bash_completion.d/sshx
+
+_sshx_hosts() {
+	sshx hosts ls -q 2>/dev/null
+}
+
+_sshx() {
+	local cur="${COMP_WORDS[COMP_CWORD]}"
+	if [ "$COMP_CWORD" -eq 1 ]; then
+		COMPREPLY=($(compgen -W "daemon conf conn cpyid scp proxy stat fs msg trans events peers hosts" -- "$cur"))
+		return
+	fi
+	case "${COMP_WORDS[1]}" in
+	conn | cpyid | scp | proxy | fs | msg | trans | hosts)
+		# user@name and name:path complete the name part
+		local prefix=""
+		if [[ "$cur" == *@* ]]; then
+			prefix="${cur%%@*}@"
+			cur="${cur#*@}"
+		fi
+		if [[ "$cur" == -* || "$cur" == */* ]]; then
+			COMPREPLY=($(compgen -f -- "$cur"))
+			return
+		fi
+		COMPREPLY=($(compgen -P "$prefix" -W "$(_sshx_hosts)" -- "$cur"))
+		;;
+	esac
+}
+
+complete -o default -F _sshx sshx